@@ -0,0 +1,407 @@
+package webapp
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Alert describes a group of ErrorEvents with the same fingerprint.
+// Count events happened between First and Last; the other fields are
+// taken from the first of them. Where is the caller for panics raised by
+// the runtime.
+type Alert struct {
+	Fingerprint string
+	Kind        string
+	Message     string
+	Type        string
+	Where       string
+	Stack       string
+	Method      string
+	URL         string
+	RequestID   string
+	Count       int
+	First       time.Time
+	Last        time.Time
+	// New is set when the fingerprint was never alerted before.
+	New bool
+}
+
+// Notification is a batch of alerts sent to a Notifier. Digest is set for
+// the periodic summary of repeated errors.
+type Notification struct {
+	Name   string
+	Digest bool
+	Alerts []Alert
+}
+
+// Notifier delivers notifications to humans, see EmailNotifier and
+// WebhookNotifier.
+type Notifier interface {
+	Notify(n *Notification) error
+}
+
+// NotifierFunc adapts a function to Notifier.
+type NotifierFunc func(n *Notification) error
+
+func (f NotifierFunc) Notify(n *Notification) error {
+	return f(n)
+}
+
+// inRuntime reports whether a "file:line (pc)" location is in the Go
+// runtime, as for nil map writes or index errors. Binaries built with
+// -trimpath have GOROOT paths relative to GOROOT/src.
+func inRuntime(where string) bool {
+	for _, dir := range []string{"runtime/", "internal/runtime/"} {
+		if strings.HasPrefix(where, dir) || strings.Contains(where, "/src/"+dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// callerOf returns the first frame of stack outside the Go runtime, or
+// where if there is none.
+func callerOf(where string, stack []byte) string {
+	if !inRuntime(where) {
+		return where
+	}
+	for _, line := range strings.Split(string(stack), "\n") {
+		if line != "" && line[0] != '\t' && !inRuntime(line) {
+			return line
+		}
+	}
+	return where
+}
+
+// EventFingerprint identifies the place of an error: the kind of the event,
+// the type of its value and where it happened, or the value itself if
+// the place is not known. Panics raised by the runtime are located by
+// their caller.
+func EventFingerprint(ev *ErrorEvent) string {
+	where := callerOf(ev.Where, ev.Stack)
+	if n := strings.LastIndex(where, " (0x"); n != -1 {
+		where = where[:n]
+	}
+	if where == "" {
+		where = fmt.Sprint(ev.Value)
+	}
+	h := sha1.Sum([]byte(ev.Kind + "\x00" + fmt.Sprintf("%T", ev.Value) + "\x00" + where))
+	return hex.EncodeToString(h[:6])
+}
+
+// Alerter notifies about new error fingerprints without flooding the
+// recipients. The first event of a fingerprint is sent right away, and so
+// is the next one after Repeat has passed; repeats in between are counted
+// and sent as a digest every Digest. At most Burst immediate alerts are
+// sent per Digest period, the rest wait for the digest, so a panic storm
+// results in a handful of messages.
+//
+// Zero values mean Repeat of one hour, Digest of 10 minutes, Burst of 5,
+// Kinds of EventPanic only and EventFingerprint. Notifier errors are sent
+// to Errors when it is set.
+type Alerter struct {
+	Notifier    Notifier
+	Name        string
+	Kinds       []string
+	Repeat      time.Duration
+	Digest      time.Duration
+	Burst       int
+	Fingerprint func(*ErrorEvent) string
+	Clock       Clock
+	Errors      chan *string
+
+	once      sync.Once
+	stopOnce  sync.Once
+	mu        sync.Mutex
+	seen      map[string]*alertState
+	immediate []Alert
+	digest    []string
+	sent      int
+	wake      chan struct{}
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+type alertState struct {
+	pending  Alert
+	notified time.Time
+	queued   bool
+}
+
+func NewAlerter(n Notifier) *Alerter {
+	return &Alerter{Notifier: n}
+}
+
+// AddAlerter sends the error events of app to a new Alerter for n, and
+// sends its pending digest on Shutdown unless the context of Shutdown is
+// done first. The Alerter, and n if it is an EmailNotifier without a
+// Clock, use the App Clock.
+func (app *App) AddAlerter(n Notifier) *Alerter {
+	if e, ok := n.(*EmailNotifier); ok && e.Clock == nil {
+		e.Clock = app.Clock
+	}
+	a := NewAlerter(n)
+	a.Clock = app.Clock
+	a.Errors = app.Errors
+	app.AddEventHandler(a.Handle)
+	app.CloseOnShutdown(a)
+	return a
+}
+
+func (a *Alerter) start() {
+	a.once.Do(func() {
+		if a.Repeat <= 0 {
+			a.Repeat = time.Hour
+		}
+		if a.Digest <= 0 {
+			a.Digest = 10 * time.Minute
+		}
+		if a.Burst <= 0 {
+			a.Burst = 5
+		}
+		if len(a.Kinds) == 0 {
+			a.Kinds = []string{EventPanic}
+		}
+		if a.Fingerprint == nil {
+			a.Fingerprint = EventFingerprint
+		}
+		if a.Name == "" {
+			a.Name = "webapp"
+		}
+		a.seen = make(map[string]*alertState)
+		a.wake = make(chan struct{}, 1)
+		a.done = make(chan struct{})
+		a.stopped = make(chan struct{})
+		go a.run()
+	})
+}
+
+func (a *Alerter) now() time.Time {
+	if a.Clock != nil {
+		return a.Clock.Now()
+	}
+	return SystemClock.Now()
+}
+
+func (a *Alerter) wants(kind string) bool {
+	for _, k := range a.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func newAlert(ev *ErrorEvent, fp string) Alert {
+	al := Alert{
+		Fingerprint: fp,
+		Kind:        ev.Kind,
+		Message:     fmt.Sprint(ev.Value),
+		Type:        fmt.Sprintf("%T", ev.Value),
+		Where:       callerOf(ev.Where, ev.Stack),
+		Stack:       string(ev.Stack),
+		RequestID:   ev.RequestID,
+		First:       ev.Time,
+	}
+	if ev.Request != nil {
+		al.Method = ev.Request.Method
+		al.URL = ev.Request.URL.String()
+	}
+	return al
+}
+
+// Handle counts ev and queues a notification if it is due. It is meant
+// to be passed to App.AddEventHandler. Events handled after Shutdown are
+// ignored.
+func (a *Alerter) Handle(ev *ErrorEvent) {
+	a.start()
+	if !a.wants(ev.Kind) {
+		return
+	}
+	select {
+	case <-a.done:
+		return
+	default:
+	}
+	if ev.Time.IsZero() {
+		ev.Time = a.now()
+	}
+	fp := a.Fingerprint(ev)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st, seen := a.seen[fp]
+	if !seen {
+		st = &alertState{}
+		a.seen[fp] = st
+	}
+	if st.pending.Count == 0 {
+		st.pending = newAlert(ev, fp)
+	}
+	st.pending.Count++
+	st.pending.Last = ev.Time
+	if (!seen || ev.Time.Sub(st.notified) >= a.Repeat) && a.sent < a.Burst {
+		a.sent++
+		al := st.pending
+		al.New = !seen
+		st.pending = Alert{}
+		st.notified = ev.Time
+		a.immediate = append(a.immediate, al)
+		select {
+		case a.wake <- struct{}{}:
+		default:
+		}
+	} else if !st.queued {
+		st.queued = true
+		a.digest = append(a.digest, fp)
+	}
+}
+
+func (a *Alerter) run() {
+	t := time.NewTicker(a.Digest)
+	defer t.Stop()
+	defer close(a.stopped)
+	for {
+		select {
+		case <-a.wake:
+			a.sendImmediate()
+		case <-t.C:
+			a.Flush()
+		case <-a.done:
+			a.sendImmediate()
+			a.Flush()
+			return
+		}
+	}
+}
+
+func (a *Alerter) sendImmediate() {
+	a.mu.Lock()
+	alerts := a.immediate
+	a.immediate = nil
+	a.mu.Unlock()
+	if len(alerts) != 0 {
+		a.notify(&Notification{Name: a.Name, Alerts: alerts})
+	}
+}
+
+// Flush sends the digest of repeated errors now and starts a new Burst
+// period.
+func (a *Alerter) Flush() error {
+	a.start()
+	a.mu.Lock()
+	now := a.now()
+	var alerts []Alert
+	for _, fp := range a.digest {
+		st := a.seen[fp]
+		st.queued = false
+		if st.pending.Count != 0 {
+			alerts = append(alerts, st.pending)
+			st.pending = Alert{}
+			st.notified = now
+		}
+	}
+	a.digest = nil
+	a.sent = 0
+	a.mu.Unlock()
+	if len(alerts) == 0 {
+		return nil
+	}
+	return a.notify(&Notification{Name: a.Name, Digest: true, Alerts: alerts})
+}
+
+func (a *Alerter) notify(n *Notification) error {
+	err := a.Notifier.Notify(n)
+	if err != nil && a.Errors != nil {
+		msg := fmt.Sprintf("[%s] [alert] %s: %v", FormatOptions{}.Timestamp(a.now()), n.Subject(), err)
+		select {
+		case a.Errors <- &msg:
+		default:
+		}
+	}
+	return err
+}
+
+// Close sends pending alerts and the digest and stops the Alerter.
+func (a *Alerter) Close() error {
+	return a.Shutdown(context.Background())
+}
+
+// Shutdown is Close giving up on the last notifications when ctx is done.
+// App.Shutdown calls it with its context. It may be called more than once.
+func (a *Alerter) Shutdown(ctx context.Context) error {
+	a.start()
+	a.stopOnce.Do(func() { close(a.done) })
+	select {
+	case <-a.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func firstLine(s string, max int) string {
+	if n := strings.IndexByte(s, '\n'); n != -1 {
+		s = s[:n]
+	}
+	if len(s) > max {
+		s = s[:max] + "..."
+	}
+	return s
+}
+
+// Subject returns a one-line summary of n.
+func (n *Notification) Subject() string {
+	count := 0
+	for _, al := range n.Alerts {
+		count += al.Count
+	}
+	switch {
+	case n.Digest:
+		return fmt.Sprintf("[%s] digest: %d errors in %d groups", n.Name, count, len(n.Alerts))
+	case len(n.Alerts) == 1:
+		return fmt.Sprintf("[%s] %s: %s", n.Name, n.Alerts[0].Kind, firstLine(n.Alerts[0].Message, 120))
+	default:
+		return fmt.Sprintf("[%s] %d errors", n.Name, len(n.Alerts))
+	}
+}
+
+// Text returns n as plain text. Stacks are left out of digests.
+func (n *Notification) Text() string {
+	var b strings.Builder
+	b.WriteString(n.Subject())
+	b.WriteString("\n")
+	for _, al := range n.Alerts {
+		fmt.Fprintf(&b, "\n%s: %s\n", al.Kind, al.Message)
+		if al.Where != "" {
+			fmt.Fprintf(&b, "  at %s\n", al.Where)
+		}
+		if al.Count > 1 {
+			fmt.Fprintf(&b, "  %d times from %s to %s\n", al.Count,
+				al.First.Format(time.RFC3339), al.Last.Format(time.RFC3339))
+		} else {
+			fmt.Fprintf(&b, "  on %s\n", al.First.Format(time.RFC3339))
+		}
+		if al.URL != "" {
+			fmt.Fprintf(&b, "  request %s %s", al.Method, al.URL)
+			if al.RequestID != "" {
+				fmt.Fprintf(&b, " (%s)", al.RequestID)
+			}
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "  fingerprint %s", al.Fingerprint)
+		if al.New {
+			b.WriteString(" (new)")
+		}
+		b.WriteString("\n")
+		if !n.Digest && al.Stack != "" {
+			b.WriteString("\n")
+			b.WriteString(al.Stack)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,244 @@
+package webapp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// notifications returns a Notifier sending to a channel.
+func notifications() (Notifier, chan *Notification) {
+	ch := make(chan *Notification, 10)
+	return NotifierFunc(func(n *Notification) error {
+		ch <- n
+		return nil
+	}), ch
+}
+
+func expectNone(t *testing.T, ch chan *Notification) {
+	t.Helper()
+	select {
+	case n := <-ch:
+		t.Errorf("unexpected notification %q", n.Subject())
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestAlerterThrottling(t *testing.T) {
+	n, ch := notifications()
+	a := NewAlerter(n)
+	a.Name, a.Repeat, a.Digest, a.Burst = "shop", time.Minute, time.Hour, 2
+	t0 := time.Date(2013, time.January, 2, 15, 4, 5, 0, time.UTC)
+	a.Clock = &fakeClock{t0.Add(2 * time.Minute)}
+	defer a.Close()
+	ev := func(where string, at time.Duration) *ErrorEvent {
+		return &ErrorEvent{Kind: EventPanic, Time: t0.Add(at), Value: "boom in " + where, Where: where + " (0x1)", Stack: []byte("stack of " + where)}
+	}
+
+	// the first event of a fingerprint is sent at once
+	a.Handle(ev("a.go:1", 0))
+	got := <-ch
+	if got.Digest || len(got.Alerts) != 1 || !got.Alerts[0].New || got.Alerts[0].Count != 1 || got.Subject() != "[shop] panic: boom in a.go:1" {
+		t.Fatalf("first notification %+v", got)
+	}
+	// a repeat within Repeat waits for the digest
+	a.Handle(ev("a.go:1", 10*time.Second))
+	expectNone(t, ch)
+	a.Handle(ev("b.go:2", 20*time.Second))
+	if got := <-ch; len(got.Alerts) != 1 || got.Alerts[0].Where != "b.go:2 (0x1)" || !strings.Contains(got.Text(), "stack of b.go:2") {
+		t.Fatalf("second notification %+v", got)
+	}
+	// Burst is used up: new fingerprints and repeats after Repeat wait too
+	a.Handle(ev("c.go:3", 30*time.Second))
+	a.Handle(ev("a.go:1", 2*time.Minute))
+	expectNone(t, ch)
+
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	got = <-ch
+	if !got.Digest || len(got.Alerts) != 2 || got.Subject() != "[shop] digest: 3 errors in 2 groups" {
+		t.Fatalf("digest %+v", got)
+	}
+	if al := got.Alerts[0]; al.Where != "a.go:1 (0x1)" || al.Count != 2 || !al.First.Equal(t0.Add(10*time.Second)) || !al.Last.Equal(t0.Add(2*time.Minute)) {
+		t.Errorf("digest alert %+v, want the two repeats of a.go:1", al)
+	}
+	if text := got.Text(); !strings.Contains(text, "2 times from 2013-01-02T15:04:15Z to 2013-01-02T15:06:05Z") || strings.Contains(text, "stack of") {
+		t.Errorf("digest text:\n%s", text)
+	}
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	expectNone(t, ch)
+
+	// Flush starts a new Burst period and counts Repeat from the digest
+	a.Handle(ev("a.go:1", 2*time.Minute+30*time.Second))
+	expectNone(t, ch)
+	a.Handle(ev("a.go:1", 4*time.Minute))
+	if got := <-ch; got.Digest || len(got.Alerts) != 1 || got.Alerts[0].New || got.Alerts[0].Count != 2 {
+		t.Fatalf("repeat after Repeat %+v, want both events since the digest", got)
+	}
+
+	// other kinds are ignored by default
+	a.Handle(&ErrorEvent{Kind: EventAuthFailure, Time: t0, Value: ErrUnauthorized})
+	a.Close()
+	a.Close()
+	expectNone(t, ch)
+}
+
+func TestAlerterClose(t *testing.T) {
+	n, ch := notifications()
+	a := NewAlerter(n)
+	a.Burst = 1
+	a.Handle(&ErrorEvent{Kind: EventPanic, Value: "one", Where: "a.go:1"})
+	a.Handle(&ErrorEvent{Kind: EventPanic, Value: "two", Where: "b.go:2"})
+	a.Close()
+	var alerts []string
+	for len(ch) > 0 {
+		for _, al := range (<-ch).Alerts {
+			alerts = append(alerts, al.Message)
+		}
+	}
+	if strings.Join(alerts, ",") != "one,two" {
+		t.Errorf("alerts sent by Close: %v", alerts)
+	}
+
+	// closing again, even concurrently, is harmless and later events are
+	// ignored
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.Close()
+		}()
+	}
+	wg.Wait()
+	a.Handle(&ErrorEvent{Kind: EventPanic, Value: "late", Where: "c.go:3"})
+	a.Flush()
+	expectNone(t, ch)
+}
+
+func TestEventFingerprint(t *testing.T) {
+	stack := []byte("/usr/local/go/src/runtime/map.go:10 (0x1)\n\tmapassign: panic\n/app/main.go:5 (0x2)\n\thandler: m[k] = v\n")
+	runtime := &ErrorEvent{Kind: EventPanic, Value: errors.New("assignment to entry in nil map"), Where: "/usr/local/go/src/runtime/map.go:10 (0x1)", Stack: stack}
+	caller := &ErrorEvent{Kind: EventPanic, Value: errors.New("other"), Where: "/app/main.go:5 (0x3)"}
+	if EventFingerprint(runtime) != EventFingerprint(caller) {
+		t.Error("runtime panic not located by its caller")
+	}
+	auth := &ErrorEvent{Kind: EventAuthFailure, Value: errors.New("other"), Where: "/app/main.go:5 (0x3)"}
+	elsewhere := &ErrorEvent{Kind: EventPanic, Value: errors.New("other"), Where: "/app/main.go:6 (0x3)"}
+	if fp := EventFingerprint(caller); fp == EventFingerprint(auth) || fp == EventFingerprint(elsewhere) || len(fp) != 12 {
+		t.Errorf("fingerprint %s shared by another kind or place", fp)
+	}
+	// without a place the value tells events apart
+	if EventFingerprint(&ErrorEvent{Value: "a"}) == EventFingerprint(&ErrorEvent{Value: "b"}) {
+		t.Error("events without a place share a fingerprint")
+	}
+}
+
+func TestAlerterErrors(t *testing.T) {
+	a := NewAlerter(NotifierFunc(func(n *Notification) error { return errors.New("down") }))
+	a.Errors = make(chan *string, 1)
+	defer a.Close()
+	a.Handle(&ErrorEvent{Kind: EventPanic, Value: "boom", Where: "a.go:1"})
+	select {
+	case msg := <-a.Errors:
+		if !strings.Contains(*msg, "[alert] [webapp] panic: boom: down") {
+			t.Errorf("error %q", *msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("notifier error not reported")
+	}
+}
+
+func TestAddAlerter(t *testing.T) {
+	app := NewApp(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}, false)
+	n, ch := notifications()
+	a := app.AddAlerter(n)
+	a.Burst = 1
+	for i := 0; i < 3; i++ {
+		app.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/items", nil))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := app.Shutdown(ctx, &http.Server{}, 0); err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for len(ch) > 0 {
+		for _, al := range (<-ch).Alerts {
+			count += al.Count
+			if al.Method != "GET" || al.URL != "/items" {
+				t.Errorf("alert for request %s %s", al.Method, al.URL)
+			}
+		}
+	}
+	if count != 3 {
+		t.Errorf("%d panics notified by Shutdown, want 3", count)
+	}
+}
+
+func TestInRuntime(t *testing.T) {
+	for _, tc := range []struct {
+		where string
+		want  bool
+	}{
+		{"/usr/local/go/src/runtime/panic.go:262 (0x43a1b2)", true},
+		{"/usr/local/go/src/internal/runtime/maps/runtime_faststr.go:263 (0x40f0a5)", true},
+		{"runtime/panic.go:262 (0x43a1b2)", true},
+		{"internal/runtime/maps/runtime_faststr.go:263 (0x40f0a5)", true},
+		{"/home/me/app/handler.go:12 (0x6a01c3)", false},
+		{"example.com/app/runtime/handler.go:12 (0x6a01c3)", false},
+	} {
+		if got := inRuntime(tc.where); got != tc.want {
+			t.Errorf("inRuntime(%q) = %v, want %v", tc.where, got, tc.want)
+		}
+	}
+}
+
+func TestTrimpathFingerprints(t *testing.T) {
+	// panics in two handlers raised by the runtime, as logged by a
+	// binary built with -trimpath
+	ev := func(caller string) *ErrorEvent {
+		return &ErrorEvent{Kind: EventPanic, Value: "index out of range",
+			Where: "runtime/panic.go:115 (0x4331e5)",
+			Stack: []byte("runtime/panic.go:115 (0x4331e5)\n\tgoPanicIndex: panicCheck1(pc, \"index out of range\")\n" +
+				caller + " (0x6a01c3)\n\thandler: x := a[i]\n")}
+	}
+	a, b := EventFingerprint(ev("example.com/app/a.go:12")), EventFingerprint(ev("example.com/app/b.go:40"))
+	if a == b {
+		t.Errorf("runtime panics in different handlers share fingerprint %s", a)
+	}
+}
+
+func TestAlerterShutdownDeadline(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	a := NewAlerter(NotifierFunc(func(n *Notification) error {
+		<-block
+		return nil
+	}))
+	a.Handle(&ErrorEvent{Kind: EventPanic, Value: "boom"})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := a.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown with a hung notifier = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestAddAlerterClock(t *testing.T) {
+	app := NewApp(http.NotFound, false)
+	app.Clock = &fakeClock{time.Now()}
+	e := &EmailNotifier{}
+	if a := app.AddAlerter(e); a.Clock != app.Clock || e.Clock != app.Clock {
+		t.Errorf("Alerter Clock %v, EmailNotifier Clock %v, want the App Clock", a.Clock, e.Clock)
+	}
+}
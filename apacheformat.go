@@ -0,0 +1,478 @@
+package webapp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ApacheFormat is a log format compiled from an Apache mod_log_config
+// format string. It both formats and parses LogRecords. Supported
+// directives are:
+//
+//	%h  client address         %l  ident          %u  user
+//	%t  [request time]         %r  request line   %s, %>s  status
+//	%b  bytes, "-" for zero    %B  bytes          %D  duration in µs
+//	%T  duration in seconds, %{ms}T, %{us}T and %{s}T select the unit
+//	%m  method                 %U  path           %q  query string
+//	%H  protocol               %v  virtual host   %%  percent sign
+//	%{Referer}i, %{User-Agent}i and %{X-Request-Id}i request headers
+//
+// Quotes, backslashes and control characters in the user, the request
+// and headers are escaped with a backslash as Apache does. Parsing relies
+// on the literal text between directives, so directives must be separated
+// by at least one character. Fields added with AddField follow the
+// formatted directives as key=value pairs.
+type ApacheFormat struct {
+	Layout string
+	parts  []formatPart
+}
+
+type formatPart struct {
+	verb byte // 0 for literal text
+	arg  string
+	text string // literal text, or the directive as written
+}
+
+// Directives which cannot be written in Apache format strings, used by
+// formats compiled from other syntaxes.
+const (
+	verbIgnored = '_'    // written as "-", skipped when parsing
+	argRawTime  = "raw"  // %t without the brackets
+	argSecMS    = "s.ms" // %T in seconds with millisecond fraction
+)
+
+// CompileFormat compiles an Apache format string.
+func CompileFormat(layout string) (*ApacheFormat, error) {
+	f := &ApacheFormat{Layout: layout}
+	var lit strings.Builder
+	flush := func() {
+		if lit.Len() > 0 {
+			f.parts = append(f.parts, formatPart{text: lit.String()})
+			lit.Reset()
+		}
+	}
+	for i := 0; i < len(layout); i++ {
+		if layout[i] != '%' {
+			lit.WriteByte(layout[i])
+			continue
+		}
+		start := i
+		i++
+		if i < len(layout) && layout[i] == '%' {
+			lit.WriteByte('%')
+			continue
+		}
+		var p formatPart
+		if i < len(layout) && layout[i] == '>' {
+			i++
+		}
+		if i < len(layout) && layout[i] == '{' {
+			end := strings.IndexByte(layout[i:], '}')
+			if end == -1 {
+				return nil, &ParseError{Column: start + 1, Msg: "missing '}' in format"}
+			}
+			p.arg = layout[i+1 : i+end]
+			i += end + 1
+		}
+		if i >= len(layout) {
+			return nil, &ParseError{Column: start + 1, Msg: "incomplete directive at end of format"}
+		}
+		p.verb = layout[i]
+		p.text = layout[start : i+1]
+		if !strings.ContainsRune("hlutrsbBDTmUqHiv", rune(p.verb)) {
+			return nil, &ParseError{Column: start + 1, Field: p.text, Msg: "unsupported directive"}
+		}
+		if p.verb == 'T' && p.arg != "" && p.arg != "s" && p.arg != "ms" && p.arg != "us" {
+			return nil, &ParseError{Column: start + 1, Field: p.text, Msg: "unsupported time unit"}
+		}
+		if p.verb == 'i' && headerField(p.arg) == "" {
+			return nil, &ParseError{Column: start + 1, Field: p.text, Msg: "header is not recorded in LogRecord"}
+		}
+		flush()
+		f.parts = append(f.parts, p)
+	}
+	flush()
+	return f, nil
+}
+
+func MustCompileFormat(layout string) *ApacheFormat {
+	f, err := CompileFormat(layout)
+	if err != nil {
+		panic(fmt.Sprintf("webapp: format %q: %v", layout, err))
+	}
+	return f
+}
+
+func headerField(name string) string {
+	switch strings.ToLower(name) {
+	case "referer":
+		return "Referer"
+	case "user-agent":
+		return "UserAgent"
+	case "x-request-id":
+		return "RequestID"
+	}
+	return ""
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// requestParts splits a "METHOD URI PROTO" request line.
+func requestParts(request string) (method, path, query, proto string) {
+	i := strings.IndexByte(request, ' ')
+	j := strings.IndexByte(request[i+1:], ' ')
+	if i == -1 || j == -1 {
+		return "-", request, "", "-"
+	}
+	method, path, proto = request[:i], request[i+1:i+1+j], request[i+2+j:]
+	if i := strings.IndexByte(path, '?'); i != -1 {
+		path, query = path[:i], path[i:]
+	}
+	return method, path, query, proto
+}
+
+func (f *ApacheFormat) appendFormat(b []byte, o FormatOptions, rec *LogRecord) []byte {
+	for _, p := range f.parts {
+		switch p.verb {
+		case 0:
+			b = append(b, p.text...)
+		case 'h':
+			b = append(b, rec.Host...)
+		case 'v':
+			b = append(b, dash(rec.VirtualHost)...)
+		case 'l':
+			b = append(b, rec.Indent...)
+		case 'u':
+			b = appendEscaped(b, rec.User)
+		case 't':
+			if p.arg == argRawTime {
+				b = o.AppendTimestamp(b, rec.RequestStarted)
+				break
+			}
+			b = append(b, '[')
+			b = o.AppendTimestamp(b, rec.RequestStarted)
+			b = append(b, ']')
+		case verbIgnored:
+			b = append(b, '-')
+		case 'r':
+			b = appendEscaped(b, rec.Request)
+		case 's':
+			b = strconv.AppendInt(b, int64(rec.Status), 10)
+		case 'b':
+			if rec.Bytes == 0 {
+				b = append(b, '-')
+			} else {
+				b = strconv.AppendUint(b, rec.Bytes, 10)
+			}
+		case 'B':
+			b = strconv.AppendUint(b, rec.Bytes, 10)
+		case 'D':
+			b = strconv.AppendInt(b, duration(rec).Microseconds(), 10)
+		case 'T':
+			d := duration(rec)
+			switch p.arg {
+			case argSecMS:
+				b = strconv.AppendFloat(b, d.Seconds(), 'f', 3, 64)
+			case "ms":
+				b = strconv.AppendInt(b, d.Milliseconds(), 10)
+			case "us":
+				b = strconv.AppendInt(b, d.Microseconds(), 10)
+			default:
+				b = strconv.AppendInt(b, int64(d/time.Second), 10)
+			}
+		case 'm', 'U', 'q', 'H':
+			method, path, query, proto := requestParts(rec.Request)
+			switch p.verb {
+			case 'm':
+				b = appendEscaped(b, method)
+			case 'U':
+				b = appendEscaped(b, path)
+			case 'q':
+				b = appendEscaped(b, query)
+			case 'H':
+				b = appendEscaped(b, proto)
+			}
+		case 'i':
+			switch headerField(p.arg) {
+			case "Referer":
+				b = appendEscaped(b, dash(rec.Referer))
+			case "UserAgent":
+				b = appendEscaped(b, dash(rec.UserAgent))
+			case "RequestID":
+				b = appendEscaped(b, dash(rec.RequestID))
+			}
+		}
+	}
+	return appendTextFields(b, rec)
+}
+
+// Format formats rec with default FormatOptions.
+func (f *ApacheFormat) Format(rec *LogRecord) string {
+	return string(f.appendFormat(nil, FormatOptions{}, rec))
+}
+
+func (f *ApacheFormat) Formatter(o FormatOptions) Formatter {
+	return f.AppendFormatter(o).Formatter()
+}
+
+func (f *ApacheFormat) AppendFormatter(o FormatOptions) AppendFormatter {
+	return func(b []byte, rec *LogRecord) []byte {
+		return f.appendFormat(b, o, rec)
+	}
+}
+
+func undash(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
+
+func needsEscape(c byte) bool {
+	return c < ' ' || c == '"' || c == '\\' || c == 0x7f
+}
+
+// appendEscaped appends s escaped like Apache writes request lines and
+// headers: quotes and backslashes are preceded by a backslash and control
+// characters written as \n, \t or \xhh, so that a value can neither end
+// its quotes nor the line.
+func appendEscaped(b []byte, s string) []byte {
+	i := 0
+	for i < len(s) && !needsEscape(s[i]) {
+		i++
+	}
+	b = append(b, s[:i]...)
+	for ; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b = append(b, '\\', c)
+		case c == '\b':
+			b = append(b, `\b`...)
+		case c == '\n':
+			b = append(b, `\n`...)
+		case c == '\r':
+			b = append(b, `\r`...)
+		case c == '\t':
+			b = append(b, `\t`...)
+		case c == '\v':
+			b = append(b, `\v`...)
+		case needsEscape(c):
+			const hex = "0123456789abcdef"
+			b = append(b, '\\', 'x', hex[c>>4], hex[c&0xf])
+		default:
+			b = append(b, c)
+		}
+	}
+	return b
+}
+
+// unescape reverses appendEscaped. The \xhh escapes nginx writes are
+// decoded as well, other backslashes are kept as they are.
+func unescape(s string) string {
+	if strings.IndexByte(s, '\\') == -1 {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b = append(b, s[i])
+			continue
+		}
+		switch c := s[i+1]; c {
+		case '"', '\\':
+			b = append(b, c)
+		case 'b':
+			b = append(b, '\b')
+		case 'n':
+			b = append(b, '\n')
+		case 'r':
+			b = append(b, '\r')
+		case 't':
+			b = append(b, '\t')
+		case 'v':
+			b = append(b, '\v')
+		case 'x', 'X':
+			if i+4 > len(s) {
+				b = append(b, s[i])
+				continue
+			}
+			x, err := strconv.ParseUint(s[i+2:i+4], 16, 8)
+			if err != nil {
+				b = append(b, s[i])
+				continue
+			}
+			b = append(b, byte(x))
+			i += 2
+		default:
+			b = append(b, s[i])
+			continue
+		}
+		i++
+	}
+	return string(b)
+}
+
+// indexUnescaped is strings.Index skipping the characters escaped by
+// appendEscaped.
+func indexUnescaped(s, substr string) int {
+	for i := 0; i < len(s); i++ {
+		if strings.HasPrefix(s[i:], substr) {
+			return i
+		}
+		if s[i] == '\\' {
+			i++
+		}
+	}
+	return -1
+}
+
+// Parse parses a line produced by the format.
+func (f *ApacheFormat) Parse(line string) (*LogRecord, error) {
+	rec := &LogRecord{Indent: "-", User: "-", Session: "-"}
+	line, rec.Fields = splitFields(line)
+	var method, path, query, proto string
+	var dur time.Duration
+	hasDur := false
+	pos := 0
+	for n, p := range f.parts {
+		fail := func(col int, format string, args ...interface{}) (*LogRecord, error) {
+			field := p.text
+			if p.verb == 0 {
+				field = ""
+			}
+			return nil, &ParseError{Column: col + 1, Field: field, Msg: fmt.Sprintf(format, args...)}
+		}
+		if p.verb == 0 {
+			if !strings.HasPrefix(line[pos:], p.text) {
+				return fail(pos, "expected %q", p.text)
+			}
+			pos += len(p.text)
+			continue
+		}
+		if p.verb == 't' && p.arg != argRawTime {
+			if pos >= len(line) || line[pos] != '[' {
+				return fail(pos, "expected '['")
+			}
+			end := strings.IndexByte(line[pos:], ']')
+			if end == -1 {
+				return fail(pos, "missing ']'")
+			}
+			t, err := time.Parse(ApacheTime, line[pos+1:pos+end])
+			if err != nil {
+				return fail(pos+1, "bad time %q", line[pos+1:pos+end])
+			}
+			rec.RequestStarted = t
+			pos += end + 1
+			continue
+		}
+
+		// the value runs up to the following literal text; the last
+		// literal of the format must end the line
+		end := len(line)
+		if n+1 < len(f.parts) && f.parts[n+1].verb == 0 {
+			next := f.parts[n+1].text
+			if n+2 == len(f.parts) {
+				if !strings.HasSuffix(line, next) || len(line)-len(next) < pos {
+					return fail(len(line), "expected %q at end of line", next)
+				}
+				end = len(line) - len(next)
+			} else if i := indexUnescaped(line[pos:], next); i != -1 {
+				end = pos + i
+			} else {
+				return fail(pos, "missing %q after value", next)
+			}
+		} else if n+1 < len(f.parts) {
+			if i := strings.IndexByte(line[pos:], ' '); i != -1 {
+				end = pos + i
+			}
+		}
+		v := line[pos:end]
+		switch p.verb {
+		case 'h':
+			rec.Host = v
+		case 'v':
+			rec.VirtualHost = undash(v)
+		case 'l':
+			rec.Indent = v
+		case 'u':
+			rec.User = unescape(v)
+		case 'r':
+			rec.Request = unescape(v)
+		case 's':
+			s, err := strconv.Atoi(v)
+			if err != nil {
+				return fail(pos, "bad status %q", v)
+			}
+			rec.Status = s
+		case 'b', 'B':
+			if v != "-" {
+				b, err := strconv.ParseUint(v, 10, 64)
+				if err != nil {
+					return fail(pos, "bad byte count %q", v)
+				}
+				rec.Bytes = b
+			}
+		case 't':
+			t, err := time.Parse(ApacheTime, v)
+			if err != nil {
+				return fail(pos, "bad time %q", v)
+			}
+			rec.RequestStarted = t
+		case 'D', 'T':
+			if p.arg == argSecMS {
+				sec, err := strconv.ParseFloat(v, 64)
+				if err != nil {
+					return fail(pos, "bad duration %q", v)
+				}
+				dur, hasDur = time.Duration(sec*float64(time.Second)), true
+				break
+			}
+			d, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return fail(pos, "bad duration %q", v)
+			}
+			unit := time.Second
+			if p.verb == 'D' || p.arg == "us" {
+				unit = time.Microsecond
+			} else if p.arg == "ms" {
+				unit = time.Millisecond
+			}
+			dur, hasDur = time.Duration(d)*unit, true
+		case 'm':
+			method = unescape(v)
+		case 'U':
+			path = unescape(v)
+		case 'q':
+			query = unescape(v)
+		case 'H':
+			proto = unescape(v)
+		case 'i':
+			switch headerField(p.arg) {
+			case "Referer":
+				rec.Referer = unescape(undash(v))
+			case "UserAgent":
+				rec.UserAgent = unescape(undash(v))
+			case "RequestID":
+				rec.RequestID = unescape(undash(v))
+			}
+		}
+		pos = end
+	}
+	if pos != len(line) {
+		return nil, &ParseError{Column: pos + 1, Msg: "unexpected text at end of line"}
+	}
+	if rec.Request == "" && method != "" && path != "" {
+		rec.Request = method + " " + path + query + " " + proto
+	}
+	if hasDur {
+		rec.RequestCompleted = rec.RequestStarted.Add(dur)
+	}
+	return rec, nil
+}
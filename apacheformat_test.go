@@ -0,0 +1,122 @@
+package webapp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompileFormatErrors(t *testing.T) {
+	for _, tc := range []struct {
+		layout string
+		column int
+		field  string
+	}{
+		{"%h %{Referer", 4, ""},
+		{"%h %", 4, ""},
+		{"%h %Z", 4, "%Z"},
+		{"%h %{min}T", 4, "%{min}T"},
+		{"%{Cookie}i", 1, "%{Cookie}i"},
+	} {
+		_, err := CompileFormat(tc.layout)
+		var perr *ParseError
+		if !errors.As(err, &perr) || perr.Column != tc.column || perr.Field != tc.field {
+			t.Errorf("CompileFormat(%q) = %v, want column %d, field %q", tc.layout, err, tc.column, tc.field)
+		}
+	}
+}
+
+func TestApacheFormatLayouts(t *testing.T) {
+	rec := formatRecord()
+	for layout, f := range map[string]Formatter{CombinedLayout: CombinedFormat, PerfLayout: PerfFormat} {
+		if got, want := MustCompileFormat(layout).Format(rec), f(rec); got != want {
+			t.Errorf("%s formats as\n%s\nwant\n%s", layout, got, want)
+		}
+	}
+}
+
+func TestApacheFormatRoundTrip(t *testing.T) {
+	rec := formatRecord()
+	rec.Request = "GET /search?q=tea HTTP/1.1"
+	for _, tc := range []struct {
+		layout   string
+		duration time.Duration
+	}{
+		{CombinedLayout, 0},
+		{PerfLayout, time.Millisecond},
+		{`%h %l %u %t "%m %U%q %H" %s %b %D "%{X-Request-Id}i"`, time.Microsecond},
+		{`%h|%t|%r|%>s|%B|%{us}T`, time.Microsecond},
+		{`%h %t "%r" %s %T`, time.Second},
+	} {
+		f := MustCompileFormat(tc.layout)
+		line := f.Format(rec)
+		got, err := f.Parse(line)
+		if err != nil {
+			t.Errorf("%s: parse %q: %v", tc.layout, line, err)
+			continue
+		}
+		if got.Host != rec.Host || got.Request != rec.Request || got.Status != rec.Status ||
+			!got.RequestStarted.Equal(rec.RequestStarted.Truncate(time.Second)) {
+			t.Errorf("%s: round trip of %q = %+v", tc.layout, line, got)
+		}
+		if tc.duration != 0 && duration(got) != duration(rec).Truncate(tc.duration) {
+			t.Errorf("%s: duration %v after a round trip", tc.layout, duration(got))
+		}
+	}
+
+	// %b writes "-" for an empty response
+	rec.Bytes = 0
+	f := MustCompileFormat(`%h %b`)
+	if line := f.Format(rec); line != "192.0.2.1 -" {
+		t.Errorf("%%b of 0 bytes = %q", line)
+	} else if got, err := f.Parse(line); err != nil || got.Bytes != 0 {
+		t.Errorf("parse %q = %+v, %v", line, got, err)
+	}
+}
+
+func TestApacheFormatEscaping(t *testing.T) {
+	rec := formatRecord()
+	rec.Request = `GET /a"b\c HTTP/1.1`
+	rec.Referer = "http://example.com/\" \"x"
+	rec.UserAgent = "evil\nagent\x01\t\"quoted\" "
+	want := `192.0.2.1 - frank [02/Jan/2013:15:04:05 +0100] "GET /a\"b\\c HTTP/1.1" 200 1234 "http://example.com/\" \"x" "evil\nagent\x01\t\"quoted\" "`
+	if got := CombinedFormat(rec); got != want {
+		t.Errorf("CombinedFormat =\n%s\nwant\n%s", got, want)
+	}
+	for _, tc := range []struct {
+		name   string
+		format Formatter
+		parser Parser
+	}{
+		{"combined", CombinedFormat, CombinedParser},
+		{"perf", PerfFormat, PerfParser},
+		{"vhost_combined", VHostCombinedFormat, VHostParser},
+		{"compiled combined", MustCompileFormat(CombinedLayout).Format, CombinedParser},
+		{"nginx combined", NginxCombinedFormat, NginxCombinedParser},
+		{"nginx main", NginxMainFormat, NginxMainParser},
+		{"request parts", MustCompileFormat(`%h "%m %U%q %H" "%{User-Agent}i"`).Format, MustCompileFormat(`%h "%m %U%q %H" "%{User-Agent}i"`)},
+	} {
+		line := tc.format(rec)
+		if strings.Contains(line, "\n") {
+			t.Errorf("%s: line break in %q", tc.name, line)
+		}
+		got, err := tc.parser.Parse(line)
+		if err != nil {
+			t.Errorf("%s: parse %q: %v", tc.name, line, err)
+			continue
+		}
+		if got.Request != rec.Request || tc.name != "perf" && got.UserAgent != rec.UserAgent {
+			t.Errorf("%s: Request %q, User-Agent %q after a round trip of %q", tc.name, got.Request, got.UserAgent, line)
+		}
+		if strings.Contains(tc.name, "combined") && got.Referer != rec.Referer {
+			t.Errorf("%s: Referer %q after a round trip of %q", tc.name, got.Referer, line)
+		}
+	}
+
+	// nginx escapes with \xhh
+	got, err := NginxCombinedParser.Parse(`192.0.2.1 - - [02/Jan/2013:15:04:05 +0100] "GET /\x22q\x22 HTTP/1.1" 200 5 "-" "a\x5Cb"`)
+	if err != nil || got.Request != `GET /"q" HTTP/1.1` || got.UserAgent != `a\b` {
+		t.Errorf("nginx escapes parsed as %+v, %v", got, err)
+	}
+}
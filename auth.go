@@ -0,0 +1,367 @@
+package webapp
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrUnauthorized = errors.New("webapp: invalid credentials")
+	ErrTokenExpired = errors.New("webapp: token expired")
+)
+
+// Principal is an authenticated user.
+type Principal struct {
+	Name   string
+	Method string
+	Claims map[string]interface{}
+}
+
+// Authenticator checks the credentials of a request. It returns nil, nil
+// if the request carries no credentials it understands.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Challenger is implemented by authenticators which want to send a
+// WWW-Authenticate header with 401 responses.
+type Challenger interface {
+	Challenge() string
+}
+
+// GetPrincipal returns the authenticated user of a request served by App,
+// or nil for anonymous requests.
+func GetPrincipal(r *http.Request) *Principal {
+	if rec := Record(r); rec != nil {
+		return rec.principal
+	}
+	return nil
+}
+
+// authenticate runs app.Auth and returns false if the request was rejected.
+func (app *App) authenticate(rec *LogRecord, r *http.Request) bool {
+	p, err := app.Auth.Authenticate(r)
+	if err == nil && p != nil {
+		rec.principal = p
+		rec.User = p.Name
+		return true
+	}
+	if err == nil && app.AuthOptional {
+		return true
+	}
+	if err != nil && len(app.Events) != 0 {
+		app.sendEvent(&ErrorEvent{Kind: EventAuthFailure, Time: app.now(), Value: err,
+			Request: r, RequestID: rec.RequestID})
+	}
+	if c, ok := app.Auth.(Challenger); ok {
+		rec.Header().Set("WWW-Authenticate", c.Challenge())
+	}
+	http.Error(rec, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	return false
+}
+
+type anyAuth []Authenticator
+
+// AnyAuth returns an Authenticator trying each of a in order and accepting
+// the first principal found.
+func AnyAuth(a ...Authenticator) Authenticator {
+	return anyAuth(a)
+}
+
+func (a anyAuth) Authenticate(r *http.Request) (*Principal, error) {
+	var last error
+	for _, auth := range a {
+		p, err := auth.Authenticate(r)
+		if err != nil {
+			last = err
+		} else if p != nil {
+			return p, nil
+		}
+	}
+	return nil, last
+}
+
+func (a anyAuth) Challenge() string {
+	for _, auth := range a {
+		if c, ok := auth.(Challenger); ok {
+			return c.Challenge()
+		}
+	}
+	return ""
+}
+
+// BasicAuth checks HTTP Basic credentials against bcrypt hashes as found
+// in htpasswd files created with "htpasswd -B".
+type BasicAuth struct {
+	Realm string
+
+	mu    sync.RWMutex
+	users map[string][]byte
+}
+
+var (
+	dummyOnce sync.Once
+	dummy     []byte
+)
+
+// dummyHash returns the hash compared against for unknown users so that
+// response times do not reveal which user names exist. It is made on
+// first use rather than at init, as bcrypt is deliberately slow.
+func dummyHash() []byte {
+	dummyOnce.Do(func() {
+		dummy, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+	})
+	return dummy
+}
+
+func NewBasicAuth(realm string, htpasswd io.Reader) (*BasicAuth, error) {
+	b := &BasicAuth{Realm: realm}
+	if err := b.load(htpasswd); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// HtpasswdFile returns a BasicAuth reading users from filename.
+func HtpasswdFile(filename, realm string) (*BasicAuth, error) {
+	b := &BasicAuth{Realm: realm}
+	if err := b.Reload(filename); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Reload replaces the users with the contents of filename.
+func (b *BasicAuth) Reload(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return b.load(f)
+}
+
+func (b *BasicAuth) load(htpasswd io.Reader) error {
+	users := make(map[string][]byte)
+	s := bufio.NewScanner(htpasswd)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i == -1 {
+			return fmt.Errorf("htpasswd line %d: missing ':'", n)
+		}
+		hash := line[i+1:]
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("htpasswd line %d: only bcrypt hashes are supported", n)
+		}
+		users[line[:i]] = []byte(hash)
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.users = users
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *BasicAuth) Authenticate(r *http.Request) (*Principal, error) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	b.mu.RLock()
+	hash, known := b.users[user]
+	b.mu.RUnlock()
+	if !known {
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(pass))
+		return nil, ErrUnauthorized
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(pass)) != nil {
+		return nil, ErrUnauthorized
+	}
+	return &Principal{Name: user, Method: "basic"}, nil
+}
+
+func (b *BasicAuth) Challenge() string {
+	return fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, b.Realm)
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(h[7:]), true
+}
+
+// BearerAuth accepts bearer tokens checked by Validate.
+type BearerAuth struct {
+	Realm    string
+	Validate func(r *http.Request, token string) (*Principal, error)
+}
+
+func (b *BearerAuth) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, nil
+	}
+	p, err := b.Validate(r, token)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, ErrUnauthorized
+	}
+	if p.Method == "" {
+		p.Method = "bearer"
+	}
+	return p, nil
+}
+
+func (b *BearerAuth) Challenge() string {
+	return fmt.Sprintf(`Bearer realm=%q`, b.Realm)
+}
+
+// JWTAuth verifies HMAC-signed (HS256, HS384, HS512) JSON web tokens sent
+// as bearer tokens. Every key in Keys is tried in order, which allows key
+// rotation. Issuer and Audience are checked when set. The principal name
+// is taken from NameClaim, "sub" by default.
+type JWTAuth struct {
+	Realm     string
+	Keys      [][]byte
+	Issuer    string
+	Audience  string
+	NameClaim string
+	Leeway    time.Duration
+}
+
+func jwtHash(alg string) func() hash.Hash {
+	switch alg {
+	case "HS256":
+		return sha256.New
+	case "HS384":
+		return sha512.New384
+	case "HS512":
+		return sha512.New
+	}
+	return nil
+}
+
+func (j *JWTAuth) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, nil
+	}
+	claims, err := j.Verify(token, requestClock(r).Now())
+	if err != nil {
+		return nil, err
+	}
+	name := j.NameClaim
+	if name == "" {
+		name = "sub"
+	}
+	p := &Principal{Method: "jwt", Claims: claims}
+	p.Name, _ = claims[name].(string)
+	if p.Name == "" {
+		return nil, ErrUnauthorized
+	}
+	return p, nil
+}
+
+// Verify checks the signature and the time, issuer and audience claims of
+// token and returns its claims.
+func (j *JWTAuth) Verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrUnauthorized
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrUnauthorized
+	}
+	h := jwtHash(header.Alg)
+	if h == nil {
+		return nil, ErrUnauthorized
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrUnauthorized
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	valid := false
+	for _, key := range j.Keys {
+		m := hmac.New(h, key)
+		m.Write(signed)
+		if hmac.Equal(sig, m.Sum(nil)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return nil, ErrUnauthorized
+	}
+	claims := make(map[string]interface{})
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrUnauthorized
+	}
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(j.Leeway)) {
+		return nil, ErrTokenExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0).Add(-j.Leeway)) {
+		return nil, ErrUnauthorized
+	}
+	if j.Issuer != "" && claims["iss"] != j.Issuer {
+		return nil, ErrUnauthorized
+	}
+	if j.Audience != "" && !hasAudience(claims["aud"], j.Audience) {
+		return nil, ErrUnauthorized
+	}
+	return claims, nil
+}
+
+func (j *JWTAuth) Challenge() string {
+	return fmt.Sprintf(`Bearer realm=%q`, j.Realm)
+}
+
+func decodeSegment(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func hasAudience(aud interface{}, want string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == want
+	case []interface{}:
+		for _, a := range aud {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
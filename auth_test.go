@@ -0,0 +1,238 @@
+package webapp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"hash"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// signJWT returns a token signed with key, or an unsigned one for "none".
+func signJWT(alg string, key []byte, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	var h func() hash.Hash
+	switch alg {
+	case "HS256":
+		h = sha256.New
+	case "HS384":
+		h = sha512.New384
+	case "HS512":
+		h = sha512.New
+	default:
+		return signed + "."
+	}
+	m := hmac.New(h, key)
+	m.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+func TestJWTAuthVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	oldKey, newKey := []byte("old secret"), []byte("new secret")
+	j := &JWTAuth{Keys: [][]byte{newKey, oldKey}, Issuer: "https://id.example.com", Audience: "shop", Leeway: time.Minute}
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"sub": "frank", "iss": j.Issuer, "aud": "shop", "exp": now.Add(time.Hour).Unix()}
+		for k, v := range extra {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	for _, tc := range []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"HS256", signJWT("HS256", newKey, claims(nil)), nil},
+		{"HS384", signJWT("HS384", newKey, claims(nil)), nil},
+		{"HS512", signJWT("HS512", newKey, claims(nil)), nil},
+		{"rotated key", signJWT("HS256", oldKey, claims(nil)), nil},
+		{"unknown key", signJWT("HS256", []byte("other"), claims(nil)), ErrUnauthorized},
+		{"alg none", signJWT("none", nil, claims(nil)), ErrUnauthorized},
+		{"alg RS256", strings.Replace(signJWT("HS256", newKey, claims(nil)), "eyJhbGciOiJIUzI1NiIs", "eyJhbGciOiJSUzI1NiIs", 1), ErrUnauthorized},
+		{"alg switched to HS512", func() string {
+			// a token signed as HS256 but claiming HS512
+			parts := strings.Split(signJWT("HS256", newKey, claims(nil)), ".")
+			other := strings.Split(signJWT("HS512", newKey, claims(nil)), ".")
+			return other[0] + "." + parts[1] + "." + parts[2]
+		}(), ErrUnauthorized},
+		{"malformed", "a.b", ErrUnauthorized},
+		{"expired", signJWT("HS256", newKey, claims(map[string]interface{}{"exp": now.Add(-2 * time.Minute).Unix()})), ErrTokenExpired},
+		{"expired within leeway", signJWT("HS256", newKey, claims(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()})), nil},
+		{"not yet valid", signJWT("HS256", newKey, claims(map[string]interface{}{"nbf": now.Add(2 * time.Minute).Unix()})), ErrUnauthorized},
+		{"not yet valid within leeway", signJWT("HS256", newKey, claims(map[string]interface{}{"nbf": now.Add(30 * time.Second).Unix()})), nil},
+		{"wrong issuer", signJWT("HS256", newKey, claims(map[string]interface{}{"iss": "https://evil.example.com"})), ErrUnauthorized},
+		{"no issuer", signJWT("HS256", newKey, claims(map[string]interface{}{"iss": nil})), ErrUnauthorized},
+		{"wrong audience", signJWT("HS256", newKey, claims(map[string]interface{}{"aud": "admin"})), ErrUnauthorized},
+		{"audience list", signJWT("HS256", newKey, claims(map[string]interface{}{"aud": []string{"admin", "shop"}})), nil},
+		{"audience list without ours", signJWT("HS256", newKey, claims(map[string]interface{}{"aud": []string{"admin"}})), ErrUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := j.Verify(tc.token, now)
+			if err != tc.err {
+				t.Fatalf("Verify = %v, %v, want error %v", got, err, tc.err)
+			}
+			if err == nil && got["sub"] != "frank" {
+				t.Errorf("claims = %v, want sub frank", got)
+			}
+		})
+	}
+}
+
+func TestJWTAuthNameClaim(t *testing.T) {
+	key := []byte("secret")
+	j := &JWTAuth{Keys: [][]byte{key}, NameClaim: "email"}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+signJWT("HS256", key, map[string]interface{}{"sub": "1", "email": "frank@example.com"}))
+	p, err := j.Authenticate(r)
+	if err != nil || p.Name != "frank@example.com" || p.Method != "jwt" {
+		t.Errorf("Authenticate = %+v, %v, want frank@example.com", p, err)
+	}
+	r.Header.Set("Authorization", "Bearer "+signJWT("HS256", key, map[string]interface{}{"sub": "1"}))
+	if p, err := j.Authenticate(r); err != ErrUnauthorized {
+		t.Errorf("Authenticate without the name claim = %+v, %v, want ErrUnauthorized", p, err)
+	}
+}
+
+func newBasicAuth(t *testing.T) *BasicAuth {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewBasicAuth("shop", strings.NewReader("# users\nfrank:"+string(hash)+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestBasicAuth(t *testing.T) {
+	b := newBasicAuth(t)
+	for _, tc := range []struct {
+		name       string
+		user, pass string
+		err        error
+	}{
+		{"valid", "frank", "secret", nil},
+		{"bad password", "frank", "guess", ErrUnauthorized},
+		{"unknown user", "joe", "secret", ErrUnauthorized},
+		{"empty password", "frank", "", ErrUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.SetBasicAuth(tc.user, tc.pass)
+			p, err := b.Authenticate(r)
+			if err != tc.err {
+				t.Fatalf("Authenticate = %+v, %v, want error %v", p, err, tc.err)
+			}
+			if err == nil && (p.Name != tc.user || p.Method != "basic") {
+				t.Errorf("principal = %+v", p)
+			}
+		})
+	}
+	if p, err := b.Authenticate(httptest.NewRequest("GET", "/", nil)); p != nil || err != nil {
+		t.Errorf("Authenticate without credentials = %+v, %v, want nil, nil", p, err)
+	}
+}
+
+func TestBasicAuthDummyHash(t *testing.T) {
+	// unknown users are compared against a hash as costly as real ones
+	if cost, err := bcrypt.Cost(dummyHash()); err != nil || cost != bcrypt.DefaultCost {
+		t.Errorf("dummy hash cost = %d, %v, want %d", cost, err, bcrypt.DefaultCost)
+	}
+}
+
+func TestBasicAuthBadHtpasswd(t *testing.T) {
+	for _, htpasswd := range []string{"frank\n", "frank:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"} {
+		if _, err := NewBasicAuth("shop", strings.NewReader(htpasswd)); err == nil {
+			t.Errorf("NewBasicAuth(%q) succeeded", htpasswd)
+		}
+	}
+}
+
+func TestAnyAuth(t *testing.T) {
+	key := []byte("secret")
+	a := AnyAuth(&JWTAuth{Realm: "api", Keys: [][]byte{key}}, newBasicAuth(t))
+	if c := a.(Challenger).Challenge(); c != `Bearer realm="api"` {
+		t.Errorf("Challenge = %q, want the first authenticator's", c)
+	}
+	basic := httptest.NewRequest("GET", "/", nil)
+	basic.SetBasicAuth("frank", "secret")
+	if p, err := a.Authenticate(basic); err != nil || p.Method != "basic" {
+		t.Errorf("Authenticate with basic credentials = %+v, %v", p, err)
+	}
+	bearer := httptest.NewRequest("GET", "/", nil)
+	bearer.Header.Set("Authorization", "Bearer "+signJWT("HS256", key, map[string]interface{}{"sub": "frank"}))
+	if p, err := a.Authenticate(bearer); err != nil || p.Method != "jwt" {
+		t.Errorf("Authenticate with a token = %+v, %v", p, err)
+	}
+	bad := httptest.NewRequest("GET", "/", nil)
+	bad.Header.Set("Authorization", "Bearer "+signJWT("HS256", []byte("other"), map[string]interface{}{"sub": "frank"}))
+	if p, err := a.Authenticate(bad); err != ErrUnauthorized {
+		t.Errorf("Authenticate with a bad token = %+v, %v, want ErrUnauthorized", p, err)
+	}
+	if p, err := a.Authenticate(httptest.NewRequest("GET", "/", nil)); p != nil || err != nil {
+		t.Errorf("Authenticate without credentials = %+v, %v, want nil, nil", p, err)
+	}
+}
+
+func TestAppAuth(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		optional bool
+		user     string
+		pass     string
+		status   int
+		logged   string
+	}{
+		{"valid", false, "frank", "secret", 200, "frank"},
+		{"anonymous", false, "", "", 401, "-"},
+		{"bad password", false, "frank", "guess", 401, "-"},
+		{"optional anonymous", true, "", "", 200, "-"},
+		{"optional bad password", true, "frank", "guess", 401, "-"},
+		{"optional valid", true, "frank", "secret", 200, "frank"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var principal *Principal
+			app := NewApp(func(w http.ResponseWriter, r *http.Request) {
+				principal = GetPrincipal(r)
+			}, false)
+			app.Auth = newBasicAuth(t)
+			app.AuthOptional = tc.optional
+			logs := make(chan *LogRecord, 1)
+			app.Loggers = append(app.Loggers, logs)
+			r := httptest.NewRequest("GET", "/", nil)
+			if tc.user != "" {
+				r.SetBasicAuth(tc.user, tc.pass)
+			}
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Errorf("status %d, want %d", w.Code, tc.status)
+			}
+			if tc.status == 401 && w.Header().Get("WWW-Authenticate") != `Basic realm="shop", charset="UTF-8"` {
+				t.Errorf("WWW-Authenticate = %q", w.Header().Get("WWW-Authenticate"))
+			}
+			if rec := <-logs; rec.User != tc.logged {
+				t.Errorf("logged user %q, want %q", rec.User, tc.logged)
+			}
+			if tc.status == 200 && (principal == nil) != (tc.user == "") {
+				t.Errorf("handler saw principal %+v", principal)
+			}
+		})
+	}
+}
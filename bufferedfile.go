@@ -0,0 +1,180 @@
+package webapp
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// SyncPolicy tells BufferedFile when to fsync the file.
+type SyncPolicy int
+
+const (
+	// SyncNever leaves syncing to the operating system.
+	SyncNever SyncPolicy = iota
+	// SyncInterval syncs after every periodic flush.
+	SyncInterval
+	// SyncAlways flushes and syncs after every write, which is the safest
+	// and the slowest choice.
+	SyncAlways
+)
+
+// BufferOptions configures a BufferedFile. Zero values mean 64KB buffer,
+// flush every second and SyncNever. Header, if set, is called to write the
+// first lines every time the file is opened, see W3CFormat.Header.
+type BufferOptions struct {
+	Size          int
+	FlushInterval time.Duration
+	Sync          SyncPolicy
+	Header        func() []byte
+}
+
+var errClosed = errors.New("webapp: file is closed")
+
+// BufferedFile is an append-only log file which collects writes in memory
+// and flushes them when the buffer is full, every FlushInterval and on
+// Close, saving a write syscall per log line.
+type BufferedFile struct {
+	mu     sync.Mutex
+	name   string
+	header func() []byte
+	f      *os.File
+	w      *bufio.Writer
+	sync   SyncPolicy
+	closed bool
+	done   chan struct{}
+}
+
+func OpenBufferedFile(filename string, o BufferOptions) (*BufferedFile, error) {
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if o.Header != nil {
+		if _, err := f.Write(o.Header()); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if o.Size <= 0 {
+		o.Size = 64 << 10
+	}
+	if o.FlushInterval <= 0 {
+		o.FlushInterval = time.Second
+	}
+	bf := &BufferedFile{
+		name:   filename,
+		header: o.Header,
+		f:      f,
+		w:      bufio.NewWriterSize(f, o.Size),
+		sync:   o.Sync,
+		done:   make(chan struct{}),
+	}
+	go bf.flusher(o.FlushInterval)
+	return bf, nil
+}
+
+// BufferedFileLogger is FileLogger over a BufferedFile. The file should be
+// closed on exit, or passed to App.CloseOnShutdown, so that buffered lines
+// are not lost.
+func BufferedFileLogger(filename string, o BufferOptions) (*log.Logger, *BufferedFile, error) {
+	bf, err := OpenBufferedFile(filename, o)
+	if err != nil {
+		return nil, nil, err
+	}
+	return log.New(bf, "", 0), bf, nil
+}
+
+func (bf *BufferedFile) flusher(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			bf.mu.Lock()
+			if bf.w.Buffered() > 0 {
+				bf.flush(bf.sync == SyncInterval)
+			}
+			bf.mu.Unlock()
+		case <-bf.done:
+			return
+		}
+	}
+}
+
+func (bf *BufferedFile) flush(sync bool) error {
+	if err := bf.w.Flush(); err != nil {
+		return err
+	}
+	if sync {
+		return bf.f.Sync()
+	}
+	return nil
+}
+
+func (bf *BufferedFile) Write(p []byte) (int, error) {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	if bf.closed {
+		return 0, errClosed
+	}
+	n, err := bf.w.Write(p)
+	if err == nil && bf.sync == SyncAlways {
+		err = bf.flush(true)
+	}
+	return n, err
+}
+
+// Flush writes the buffered data to the file, syncing it unless the
+// policy is SyncNever.
+func (bf *BufferedFile) Flush() error {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	if bf.closed {
+		return errClosed
+	}
+	return bf.flush(bf.sync != SyncNever)
+}
+
+// Reopen flushes the buffer and opens the file again by name, writing the
+// header, so that a rotated log file can be replaced by a new one.
+func (bf *BufferedFile) Reopen() error {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	if bf.closed {
+		return errClosed
+	}
+	if err := bf.flush(true); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(bf.name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	bf.f.Close()
+	bf.f = f
+	bf.w.Reset(f)
+	if bf.header != nil {
+		bf.w.Write(bf.header())
+	}
+	return nil
+}
+
+// Close flushes and syncs the buffered data and closes the file.
+func (bf *BufferedFile) Close() error {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	if bf.closed {
+		return errClosed
+	}
+	bf.closed = true
+	close(bf.done)
+	err := bf.flush(true)
+	if cerr := bf.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,142 @@
+package webapp
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readFile(t *testing.T, name string) string {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestBufferedFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "access.log")
+	bf, err := OpenBufferedFile(name, BufferOptions{FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bf.Write([]byte("one\n"))
+	if got := readFile(t, name); got != "" {
+		t.Errorf("file holds %q before a flush", got)
+	}
+	if err := bf.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, name); got != "one\n" {
+		t.Errorf("file holds %q after Flush", got)
+	}
+	bf.Write([]byte("two\n"))
+	if err := bf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, name); got != "one\ntwo\n" {
+		t.Errorf("file holds %q after Close", got)
+	}
+	if _, err := bf.Write([]byte("three\n")); err != errClosed {
+		t.Errorf("Write after Close = %v", err)
+	}
+	if err := bf.Close(); err != errClosed {
+		t.Errorf("second Close = %v", err)
+	}
+
+	// the file is appended to
+	bf, err = OpenBufferedFile(name, BufferOptions{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bf.Close()
+	bf.Write([]byte("four\n"))
+	if got := readFile(t, name); got != "one\ntwo\nfour\n" {
+		t.Errorf("file holds %q after a SyncAlways write", got)
+	}
+}
+
+func TestBufferedFileFlushInterval(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "access.log")
+	bf, err := OpenBufferedFile(name, BufferOptions{FlushInterval: 5 * time.Millisecond, Sync: SyncInterval})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bf.Close()
+	bf.Write([]byte("one\n"))
+	deadline := time.Now().Add(time.Second)
+	for readFile(t, name) == "" && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := readFile(t, name); got != "one\n" {
+		t.Errorf("file holds %q after FlushInterval", got)
+	}
+}
+
+func TestShutdownClosesFiles(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "access.log")
+	logger, bf, err := BufferedFileLogger(name, BufferOptions{FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := NewApp(func(w http.ResponseWriter, r *http.Request) {}, false)
+	app.AddLogger(CombinedFormat, logger)
+	app.CloseOnShutdown(bf)
+	for i := 0; i < 3; i++ {
+		app.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := app.Shutdown(ctx, &http.Server{}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(readFile(t, name), "\n"); n != 3 {
+		t.Errorf("%d lines in the log after Shutdown, want 3", n)
+	}
+	if _, err := bf.Write([]byte("late\n")); err != errClosed {
+		t.Errorf("Write after Shutdown = %v, want the file closed", err)
+	}
+}
+
+func BenchmarkFileLogger(b *testing.B) {
+	dir := b.TempDir()
+	b.Run("FileLogger", func(b *testing.B) {
+		logger, err := FileLogger(filepath.Join(dir, "file.log"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		app := NewApp(benchHandler, false)
+		app.AddLogger(CombinedFormat, logger)
+		benchServe(b, app)
+		app.flush()
+		logger.Writer().(io.Closer).Close()
+	})
+	b.Run("BufferedFileLogger", func(b *testing.B) {
+		logger, bf, err := BufferedFileLogger(filepath.Join(dir, "buffered.log"), BufferOptions{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		app := NewApp(benchHandler, false)
+		app.AddLogger(CombinedFormat, logger)
+		benchServe(b, app)
+		app.flush()
+		bf.Close()
+	})
+	b.Run("BufferedFileAppendLogger", func(b *testing.B) {
+		bf, err := OpenBufferedFile(filepath.Join(dir, "append.log"), BufferOptions{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		app := NewApp(benchHandler, false)
+		app.AddAppendLogger(AppendCombinedFormat, bf)
+		benchServe(b, app)
+		app.flush()
+		bf.Close()
+	})
+}
@@ -0,0 +1,405 @@
+package webapp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultCaptureBody is the body size limit of a Capture made by
+// NewCapture.
+const DefaultCaptureBody = 64 << 10
+
+const redacted = "[REDACTED]"
+
+// CaptureEntry is a request and its response recorded by Capture. Bodies
+// are cut at Capture.MaxBody bytes; the request body holds only what the
+// handler actually read.
+type CaptureEntry struct {
+	Started   time.Time
+	Completed time.Time
+	RequestID string
+	Panicked  bool
+
+	Method        string
+	URL           string
+	Proto         string
+	RequestHeader http.Header
+	RequestBody   []byte
+	RequestCut    bool
+
+	Status         int
+	ResponseHeader http.Header
+	ResponseBody   []byte
+	ResponseCut    bool
+	ResponseSize   uint64
+}
+
+// Capture keeps the last Size requests matching Filter, and all requests
+// which panicked, in a ring buffer so that they can be dumped with
+// WriteHAR. Headers listed in RedactHeaders and query parameters listed in
+// RedactParams are replaced by "[REDACTED]", and so are the fields of
+// form-encoded and JSON bodies named in RedactParams, at any depth for
+// JSON. JSON bodies which do not parse, as when they were cut, are
+// replaced as a whole. Other bodies are kept as they are.
+//
+// Bodies of every request are buffered up to MaxBody bytes while it is
+// served, since it is not known in advance whether the handler will
+// panic. Capture is meant to be switched on while chasing a bug.
+type Capture struct {
+	Size          int
+	MaxBody       int
+	Filter        func(r *http.Request, rec *LogRecord) bool
+	RedactHeaders []string
+	RedactParams  []string
+
+	mu      sync.Mutex
+	entries []*CaptureEntry
+	next    int
+}
+
+// Headers and query parameters redacted by default by Capture and
+// SentryReporter.
+var (
+	DefaultRedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+	DefaultRedactParams  = []string{"token", "access_token", "password", "api_key"}
+)
+
+func NewCapture(size int) *Capture {
+	return &Capture{
+		Size:          size,
+		MaxBody:       DefaultCaptureBody,
+		RedactHeaders: DefaultRedactHeaders,
+		RedactParams:  DefaultRedactParams,
+	}
+}
+
+// limitedBuffer keeps the first max bytes written to it.
+type limitedBuffer struct {
+	bytes.Buffer
+	max int
+	cut bool
+}
+
+func (b *limitedBuffer) keep(p []byte) {
+	if n := b.max - b.Len(); n < len(p) {
+		b.cut = true
+		if n <= 0 {
+			return
+		}
+		p = p[:n]
+	}
+	b.Buffer.Write(p)
+}
+
+type captureBody struct {
+	io.ReadCloser
+	buf *limitedBuffer
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.keep(p[:n])
+	return n, err
+}
+
+type captureWriter struct {
+	http.ResponseWriter
+	buf *limitedBuffer
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.buf.keep(p[:n])
+	return n, err
+}
+
+func (w *captureWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// captureState is the part of a request kept while it is served.
+type captureState struct {
+	entry    *CaptureEntry
+	req      *http.Request
+	reqBody  *limitedBuffer
+	respBody *limitedBuffer
+}
+
+// start records the request part of r and makes rec and r copy their
+// bodies.
+func (c *Capture) start(rec *LogRecord, r *http.Request) {
+	st := &captureState{
+		entry: &CaptureEntry{
+			RequestID:     rec.RequestID,
+			Method:        r.Method,
+			URL:           redactURL(requestURL(r), c.RedactParams),
+			Proto:         r.Proto,
+			RequestHeader: redactHeader(r.Header, c.RedactHeaders),
+		},
+		req:      r,
+		reqBody:  &limitedBuffer{max: c.MaxBody},
+		respBody: &limitedBuffer{max: c.MaxBody},
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &captureBody{r.Body, st.reqBody}
+	}
+	rec.ResponseWriter = &captureWriter{rec.ResponseWriter, st.respBody}
+	rec.capture = st
+}
+
+// finish stores the request of rec if it panicked or matches c.Filter.
+func (c *Capture) finish(rec *LogRecord) {
+	st := rec.capture
+	if !rec.panicked && (c.Filter == nil || !c.Filter(st.req, rec)) {
+		return
+	}
+	e := st.entry
+	e.Started = rec.RequestStarted
+	e.Completed = rec.RequestCompleted
+	e.Panicked = rec.panicked
+	e.RequestBody, e.RequestCut = redactBody(st.reqBody.Bytes(), st.req.Header.Get("Content-Type"), c.RedactParams), st.reqBody.cut
+	e.Status = rec.Status
+	e.ResponseHeader = redactHeader(rec.Header(), c.RedactHeaders)
+	e.ResponseBody, e.ResponseCut = redactBody(st.respBody.Bytes(), rec.Header().Get("Content-Type"), c.RedactParams), st.respBody.cut
+	e.ResponseSize = rec.Bytes
+	c.add(e)
+}
+
+func (c *Capture) add(e *CaptureEntry) {
+	if c.Size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) < c.Size {
+		c.entries = append(c.entries, e)
+		return
+	}
+	c.entries[c.next] = e
+	c.next = (c.next + 1) % len(c.entries)
+}
+
+// Entries returns the captured requests, oldest first.
+func (c *Capture) Entries() []*CaptureEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]*CaptureEntry, 0, len(c.entries))
+	out = append(out, c.entries[c.next:]...)
+	return append(out, c.entries[:c.next]...)
+}
+
+// Reset drops all captured requests.
+func (c *Capture) Reset() {
+	c.mu.Lock()
+	c.entries, c.next = nil, 0
+	c.mu.Unlock()
+}
+
+func redactHeader(h http.Header, names []string) http.Header {
+	h = h.Clone()
+	for _, name := range names {
+		if vs := h.Values(name); len(vs) != 0 {
+			for i := range vs {
+				vs[i] = redacted
+			}
+		}
+	}
+	return h
+}
+
+func redactURL(s string, names []string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.RawQuery == "" {
+		return s
+	}
+	q := u.Query()
+	changed := false
+	for _, name := range names {
+		if vs, ok := q[name]; ok {
+			for i := range vs {
+				vs[i] = redacted
+			}
+			changed = true
+		}
+	}
+	if changed {
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// redactBody redacts the fields listed in names from a form-encoded or
+// JSON body.
+func redactBody(body []byte, contentType string, names []string) []byte {
+	if len(body) == 0 || len(names) == 0 {
+		return body
+	}
+	mt, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mt == "application/x-www-form-urlencoded":
+		q, err := url.ParseQuery(string(body))
+		if err != nil {
+			return []byte(redacted)
+		}
+		changed := false
+		for _, name := range names {
+			if vs, ok := q[name]; ok {
+				for i := range vs {
+					vs[i] = redacted
+				}
+				changed = true
+			}
+		}
+		if changed {
+			return []byte(q.Encode())
+		}
+	case mt == "application/json" || strings.HasSuffix(mt, "+json"):
+		d := json.NewDecoder(bytes.NewReader(body))
+		d.UseNumber()
+		var v interface{}
+		if err := d.Decode(&v); err != nil {
+			return []byte(redacted)
+		}
+		if redactJSON(v, names) {
+			if b, err := json.Marshal(v); err == nil {
+				return b
+			}
+			return []byte(redacted)
+		}
+	}
+	return body
+}
+
+// redactJSON replaces the values of object members named in names,
+// reporting whether it did.
+func redactJSON(v interface{}, names []string) bool {
+	changed := false
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, x := range v {
+			if containsString(names, k) {
+				v[k] = redacted
+				changed = true
+			} else if redactJSON(x, names) {
+				changed = true
+			}
+		}
+	case []interface{}:
+		for _, x := range v {
+			if redactJSON(x, names) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// requestURL returns the absolute URL requested by r.
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.RequestURI()
+}
+
+func cutComment(cut bool) string {
+	if cut {
+		return "truncated"
+	}
+	return ""
+}
+
+func (e *CaptureEntry) har() harEntry {
+	ms := float64(e.Completed.Sub(e.Started)) / float64(time.Millisecond)
+	he := harEntry{
+		StartedDateTime: e.Started.Format(time.RFC3339Nano),
+		Time:            ms,
+		Timings:         harTimings{Wait: ms},
+	}
+	if e.RequestID != "" {
+		he.Comment = "request " + e.RequestID
+	}
+	if e.Panicked {
+		he.Comment = strings.TrimSpace(he.Comment + " panicked")
+	}
+	req := harRequest{
+		Method:      e.Method,
+		URL:         e.URL,
+		HTTPVersion: e.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(e.RequestHeader),
+		QueryString: []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    len(e.RequestBody),
+	}
+	if u, err := url.Parse(e.URL); err == nil {
+		req.QueryString = harQuery(u.RawQuery)
+	}
+	if len(e.RequestBody) != 0 || e.RequestCut {
+		req.PostData = &harPostData{
+			MimeType: e.RequestHeader.Get("Content-Type"),
+			Text:     string(e.RequestBody),
+			Comment:  cutComment(e.RequestCut),
+		}
+	}
+	resp := harResponse{
+		Status:      e.Status,
+		StatusText:  http.StatusText(e.Status),
+		HTTPVersion: e.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(e.ResponseHeader),
+		Content: harContent{
+			Size:     int64(e.ResponseSize),
+			MimeType: e.ResponseHeader.Get("Content-Type"),
+			Comment:  cutComment(e.ResponseCut),
+		},
+		RedirectURL: e.ResponseHeader.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    int64(e.ResponseSize),
+	}
+	if utf8.Valid(e.ResponseBody) {
+		resp.Content.Text = string(e.ResponseBody)
+	} else {
+		resp.Content.Text = base64.StdEncoding.EncodeToString(e.ResponseBody)
+		resp.Content.Encoding = "base64"
+	}
+	he.Request, he.Response = req, resp
+	return he
+}
+
+// WriteHAR writes the captured requests to w as a HAR 1.2 archive, which
+// can be loaded into browser developer tools or replayed.
+func (c *Capture) WriteHAR(w io.Writer) error {
+	entries := c.Entries()
+	hes := make([]harEntry, len(entries))
+	for i, e := range entries {
+		hes[i] = e.har()
+	}
+	return writeHAR(w, hes)
+}
+
+// HARHandler serves the captured requests as a HAR download. It should
+// only be mounted behind authentication.
+func (c *Capture) HARHandler(w http.ResponseWriter, r *http.Request) {
+	setHARHeaders(w, "capture.har")
+	c.WriteHAR(w)
+}
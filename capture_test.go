@@ -0,0 +1,148 @@
+package webapp
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func captureApp(c *Capture) *App {
+	app := NewApp(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/panic":
+			panic("boom")
+		case "/echo":
+			b, _ := io.ReadAll(io.LimitReader(r.Body, 5))
+			w.Header().Set("Set-Cookie", "session=secret")
+			w.Write(b)
+			w.Write([]byte(" and more"))
+		default:
+			w.Write([]byte("ok"))
+		}
+	}, false)
+	app.Capture = c
+	return app
+}
+
+func TestCapture(t *testing.T) {
+	c := NewCapture(2)
+	c.MaxBody = 8
+	c.Filter = func(r *http.Request, rec *LogRecord) bool { return r.URL.Path == "/echo" }
+	app := captureApp(c)
+
+	app.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/other", nil))
+	if n := len(c.Entries()); n != 0 {
+		t.Fatalf("%d entries captured for a request not matching Filter", n)
+	}
+
+	r := httptest.NewRequest("POST", "/echo?id=1&token=abc", strings.NewReader("hello world"))
+	r.Header.Set("Authorization", "Bearer abc")
+	r.Header.Set("Content-Type", "text/plain")
+	app.ServeHTTP(httptest.NewRecorder(), r)
+	entries := c.Entries()
+	if len(entries) != 1 {
+		t.Fatalf("%d entries captured, want 1", len(entries))
+	}
+	e := entries[0]
+	if e.Method != "POST" || e.URL != "http://example.com/echo?id=1&token=%5BREDACTED%5D" || e.Status != 200 {
+		t.Errorf("entry %s %s = %d", e.Method, e.URL, e.Status)
+	}
+	if e.RequestHeader.Get("Authorization") != redacted || r.Header.Get("Authorization") != "Bearer abc" {
+		t.Errorf("Authorization %q, request header %q", e.RequestHeader.Get("Authorization"), r.Header.Get("Authorization"))
+	}
+	if e.ResponseHeader.Get("Set-Cookie") != redacted {
+		t.Errorf("Set-Cookie %q, want it redacted", e.ResponseHeader.Get("Set-Cookie"))
+	}
+	// the handler read 5 bytes of the request body and wrote 14
+	if string(e.RequestBody) != "hello" || e.RequestCut {
+		t.Errorf("request body %q, cut %v", e.RequestBody, e.RequestCut)
+	}
+	if string(e.ResponseBody) != "hello an" || !e.ResponseCut || e.ResponseSize != 14 {
+		t.Errorf("response body %q, cut %v, size %d", e.ResponseBody, e.ResponseCut, e.ResponseSize)
+	}
+}
+
+func TestCaptureRing(t *testing.T) {
+	c := NewCapture(2)
+	app := captureApp(c)
+	for _, path := range []string{"/panic", "/a", "/panic?n=2", "/b", "/panic?n=3"} {
+		app.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	entries := c.Entries()
+	if len(entries) != 2 || !strings.HasSuffix(entries[0].URL, "n=2") || !strings.HasSuffix(entries[1].URL, "n=3") {
+		t.Fatalf("entries %v, want the last two requests which panicked", entries)
+	}
+	if !entries[1].Panicked || entries[1].Status != 500 {
+		t.Errorf("entry = %+v, want a panicked 500", entries[1])
+	}
+	c.Reset()
+	if n := len(c.Entries()); n != 0 {
+		t.Errorf("%d entries after Reset", n)
+	}
+}
+
+func TestCaptureHAR(t *testing.T) {
+	c := NewCapture(10)
+	c.Filter = func(*http.Request, *LogRecord) bool { return true }
+	app := captureApp(c)
+	r := httptest.NewRequest("POST", "/echo?q=tea", strings.NewReader("hello"))
+	r.Header.Set("X-Request-Id", "req-1")
+	app.ServeHTTP(httptest.NewRecorder(), r)
+
+	w := httptest.NewRecorder()
+	c.HARHandler(w, httptest.NewRequest("GET", "/debug/capture.har", nil))
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("HAR response headers %v", w.Header())
+	}
+	var doc harLog
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Log.Version != "1.2" || len(doc.Log.Entries) != 1 {
+		t.Fatalf("HAR log %+v", doc.Log)
+	}
+	he := doc.Log.Entries[0]
+	if he.Request.Method != "POST" || he.Request.PostData == nil || he.Request.PostData.Text != "hello" ||
+		len(he.Request.QueryString) != 1 || he.Request.QueryString[0] != (harNameValue{"q", "tea"}) {
+		t.Errorf("HAR request %+v", he.Request)
+	}
+	if he.Response.Status != 200 || he.Response.Content.Text != "hello and more" || he.Comment != "request req-1" {
+		t.Errorf("HAR response %+v, comment %q", he.Response, he.Comment)
+	}
+}
+
+func TestCaptureRedactsBodies(t *testing.T) {
+	for _, tc := range []struct {
+		name, contentType, body string
+	}{
+		{"form", "application/x-www-form-urlencoded", "user=frank&password=hunter2"},
+		{"JSON", "application/json; charset=utf-8", `{"user":"frank","auth":{"password":"hunter2"}}`},
+		{"cut JSON", "application/json", `{"user":"frank","password":"hunt`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			app := NewApp(func(w http.ResponseWriter, r *http.Request) {
+				io.ReadAll(r.Body)
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"access_token":"hunter2","expires_in":3600}`))
+			}, false)
+			app.Capture = NewCapture(10)
+			app.Capture.Filter = func(r *http.Request, rec *LogRecord) bool { return true }
+			r := httptest.NewRequest("POST", "/login", strings.NewReader(tc.body))
+			r.Header.Set("Content-Type", tc.contentType)
+			app.ServeHTTP(httptest.NewRecorder(), r)
+			entries := app.Capture.Entries()
+			if len(entries) != 1 {
+				t.Fatalf("%d entries captured, want 1", len(entries))
+			}
+			e := entries[0]
+			for _, body := range [][]byte{e.RequestBody, e.ResponseBody} {
+				if strings.Contains(string(body), "hunter2") || !strings.Contains(string(body), "REDACTED") {
+					t.Errorf("body not redacted: %s", body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package webapp
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// CEFDevice identifies the producer in the header of CEF lines.
+type CEFDevice struct {
+	Vendor  string
+	Product string
+	Version string
+}
+
+// DefaultCEFDevice is used by CEFFormat and CEFEventFormat.
+var DefaultCEFDevice = CEFDevice{Vendor: "go-webapp", Product: "webapp", Version: "1.0"}
+
+// appendCEFHeader appends s escaping '|' and '\' as required in header
+// fields.
+func appendCEFHeader(b []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '|', '\\':
+			b = append(b, '\\', c)
+		case '\n', '\r':
+			b = append(b, ' ')
+		default:
+			b = append(b, c)
+		}
+	}
+	return append(b, '|')
+}
+
+// appendCEFExt appends " key=value" escaping '=', '\' and newlines in the
+// value; the space is left out for the first extension, which starts at
+// ext. Empty values are left out.
+func appendCEFExt(b []byte, ext int, key, value string) []byte {
+	if value == "" {
+		return b
+	}
+	if len(b) > ext {
+		b = append(b, ' ')
+	}
+	b = append(b, key...)
+	b = append(b, '=')
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '=', '\\':
+			b = append(b, '\\', c)
+		case '\n':
+			b = append(b, '\\', 'n')
+		case '\r':
+			b = append(b, '\\', 'r')
+		default:
+			b = append(b, c)
+		}
+	}
+	return b
+}
+
+// header appends the CEF header up to the extension.
+func (d CEFDevice) header(b []byte, signature, name string, severity int) []byte {
+	b = append(b, "CEF:0|"...)
+	b = appendCEFHeader(b, d.Vendor)
+	b = appendCEFHeader(b, d.Product)
+	b = appendCEFHeader(b, d.Version)
+	b = appendCEFHeader(b, signature)
+	b = appendCEFHeader(b, name)
+	b = strconv.AppendInt(b, int64(severity), 10)
+	return append(b, '|')
+}
+
+// Format returns a formatter writing access log records as CEF lines with
+// signature "access" and severity 3, or 6 for server errors:
+//
+//	CEF:0|go-webapp|webapp|1.0|access|HTTP request|3|rt=1704207845000 src=10.0.0.1 requestMethod=GET request=/a ...
+func (d CEFDevice) Format() Formatter {
+	return func(rec *LogRecord) string {
+		method, path, query, _ := requestParts(rec.Request)
+		severity := 3
+		if rec.Status >= 500 {
+			severity = 6
+		}
+		outcome := "success"
+		if rec.Status >= 400 {
+			outcome = "failure"
+		}
+		b := d.header(make([]byte, 0, 256), "access", "HTTP request", severity)
+		ext := len(b)
+		b = appendCEFExt(b, ext, "rt", strconv.FormatInt(rec.RequestStarted.UnixMilli(), 10))
+		b = appendCEFExt(b, ext, "src", rec.Host)
+		if rec.User != "-" {
+			b = appendCEFExt(b, ext, "suser", rec.User)
+		}
+		b = appendCEFExt(b, ext, "dhost", rec.VirtualHost)
+		b = appendCEFExt(b, ext, "requestMethod", method)
+		b = appendCEFExt(b, ext, "request", path+query)
+		b = appendCEFExt(b, ext, "requestContext", rec.Referer)
+		b = appendCEFExt(b, ext, "requestClientApplication", rec.UserAgent)
+		b = appendCEFExt(b, ext, "outcome", outcome)
+		b = appendCEFExt(b, ext, "cn1", strconv.Itoa(rec.Status))
+		b = appendCEFExt(b, ext, "cn1Label", "status")
+		b = appendCEFExt(b, ext, "out", strconv.FormatUint(rec.Bytes, 10))
+		b = appendCEFExt(b, ext, "cn2", strconv.FormatInt(duration(rec).Milliseconds(), 10))
+		b = appendCEFExt(b, ext, "cn2Label", "durationMs")
+		b = appendCEFExt(b, ext, "externalId", rec.RequestID)
+		return string(b)
+	}
+}
+
+// EventFormat returns an EventFormatter writing panics with severity 8 and
+// authentication failures with severity 5 as CEF lines. The panic value
+// or the authentication error is in msg.
+func (d CEFDevice) EventFormat() EventFormatter {
+	return func(ev *ErrorEvent) string {
+		name, severity := "Error", 5
+		switch ev.Kind {
+		case EventPanic:
+			name, severity = "Panic", 8
+		case EventAuthFailure:
+			name = "Authentication failure"
+		}
+		b := d.header(make([]byte, 0, 256), ev.Kind, name, severity)
+		ext := len(b)
+		b = appendCEFExt(b, ext, "rt", strconv.FormatInt(ev.Time.UnixMilli(), 10))
+		b = appendCEFExt(b, ext, "src", eventClient(ev))
+		if r := ev.Request; r != nil {
+			if user, _, ok := r.BasicAuth(); ok {
+				b = appendCEFExt(b, ext, "suser", user)
+			}
+			b = appendCEFExt(b, ext, "dhost", virtualHost(r))
+			b = appendCEFExt(b, ext, "requestMethod", r.Method)
+			b = appendCEFExt(b, ext, "request", r.URL.RequestURI())
+			b = appendCEFExt(b, ext, "requestClientApplication", r.UserAgent())
+		}
+		b = appendCEFExt(b, ext, "outcome", "failure")
+		b = appendCEFExt(b, ext, "msg", fmt.Sprint(ev.Value))
+		if ev.Kind == EventPanic {
+			b = appendCEFExt(b, ext, "cs1", ev.Where)
+			b = appendCEFExt(b, ext, "cs1Label", "where")
+		}
+		b = appendCEFExt(b, ext, "externalId", ev.RequestID)
+		return string(b)
+	}
+}
+
+var (
+	cefFormat      = DefaultCEFDevice.Format()
+	cefEventFormat = DefaultCEFDevice.EventFormat()
+)
+
+func CEFFormat(rec *LogRecord) string {
+	return cefFormat(rec)
+}
+
+func CEFEventFormat(ev *ErrorEvent) string {
+	return cefEventFormat(ev)
+}
@@ -0,0 +1,57 @@
+package webapp
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCEFFormat(t *testing.T) {
+	rec := formatRecord()
+	rec.Status = 503
+	rec.Request = "GET /a?x=1 HTTP/1.1"
+	rec.UserAgent = "curl\\8.0\nx"
+	const want = `CEF:0|go-webapp|webapp|1.0|access|HTTP request|6|rt=1357135445123 src=192.0.2.1 suser=frank requestMethod=GET request=/a?x\=1 requestContext=http://example.com/ requestClientApplication=curl\\8.0\nx outcome=failure cn1=503 cn1Label=status out=1234 cn2=42 cn2Label=durationMs externalId=req-1`
+	if got := CEFFormat(rec); got != want {
+		t.Errorf("CEFFormat =\n%s\nwant\n%s", got, want)
+	}
+
+	d := CEFDevice{Vendor: "Acme|Corp", Product: `Web\Shop`, Version: "2"}
+	rec.Status, rec.User = 200, "-"
+	got := d.Format()(rec)
+	if !strings.HasPrefix(got, `CEF:0|Acme\|Corp|Web\\Shop|2|access|HTTP request|3|`) || strings.Contains(got, "suser=") ||
+		!strings.Contains(got, "outcome=success") {
+		t.Errorf("Format with a custom device = %s", got)
+	}
+}
+
+func TestCEFEventFormat(t *testing.T) {
+	r := httptest.NewRequest("POST", "/login", nil)
+	r.SetBasicAuth("frank", "secret")
+	r.Header.Set("User-Agent", "curl/8.0")
+	ev := &ErrorEvent{Kind: EventAuthFailure, Time: time.Unix(1357135445, 0), Value: ErrUnauthorized, Request: r, RequestID: "req-1"}
+	want := `CEF:0|go-webapp|webapp|1.0|auth_failure|Authentication failure|5|rt=1357135445000 src=192.0.2.1 suser=frank dhost=example.com requestMethod=POST request=/login requestClientApplication=curl/8.0 outcome=failure msg=` +
+		ErrUnauthorized.Error() + ` externalId=req-1`
+	if got := CEFEventFormat(ev); got != want {
+		t.Errorf("CEFEventFormat =\n%s\nwant\n%s", got, want)
+	}
+
+	ev = &ErrorEvent{Kind: EventPanic, Time: time.Unix(1357135445, 0), Value: "a=b", Where: "main.go:10"}
+	want = `CEF:0|go-webapp|webapp|1.0|panic|Panic|8|rt=1357135445000 outcome=failure msg=a\=b cs1=main.go:10 cs1Label=where`
+	if got := CEFEventFormat(ev); got != want {
+		t.Errorf("CEFEventFormat of a panic =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCEFValueEndingInPipe(t *testing.T) {
+	rec := benchRecord()
+	rec.Request = "GET /a| HTTP/1.1"
+	line := CEFFormat(rec)
+	if !strings.Contains(line, "|3|rt=") {
+		t.Errorf("first extension not right after the header: %q", line)
+	}
+	if !strings.Contains(line, " request=/a| requestContext=") {
+		t.Errorf("extension after a value ending in '|' not separated: %q", line)
+	}
+}
@@ -0,0 +1,259 @@
+// Command webapp-logstat reads access logs written by the webapp
+// CombinedFormat, PerfFormat, JSONFormat or LogfmtFormat formatters and
+// prints reports: top URLs, status distribution, latency percentiles per
+// route, top clients and error spikes over time.
+//
+// Usage:
+//
+//	webapp-logstat [-format auto|combined|vhost_combined|perf|json|logfmt|nginx_main|w3c|LAYOUT] [-top N] [-bucket 1m] [file ...]
+//
+// Any other -format value is compiled as an Apache format string. Logs are
+// read from standard input if no files are given.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	webapp "github.com/abbot/go-webapp"
+)
+
+var (
+	format = flag.String("format", "auto", "log format: auto, combined, vhost_combined, perf, json, logfmt, nginx_main, w3c or an Apache format string")
+	top    = flag.Int("top", 10, "number of entries in top lists")
+	bucket = flag.Duration("bucket", time.Minute, "time bucket for error spike detection")
+	spike  = flag.Float64("spike", 3, "report buckets with more than this many times the average number of errors")
+)
+
+// idSegment matches path segments which look like identifiers.
+var idSegment = regexp.MustCompile(`^([0-9]+|[0-9a-fA-F]{16,}|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})$`)
+
+// requestPath returns the path of a "METHOD URI PROTO" request line.
+func requestPath(request string) string {
+	fields := strings.Fields(request)
+	if len(fields) < 2 {
+		return request
+	}
+	if i := strings.IndexByte(fields[1], '?'); i != -1 {
+		return fields[1][:i]
+	}
+	return fields[1]
+}
+
+// route replaces identifier segments of a path with ":id" so that latency
+// can be aggregated per handler.
+func route(path string) string {
+	segs := strings.Split(path, "/")
+	for i, s := range segs {
+		if idSegment.MatchString(s) {
+			segs[i] = ":id"
+		}
+	}
+	return strings.Join(segs, "/")
+}
+
+type stats struct {
+	lines, failed  int
+	first, last    time.Time
+	urls, clients  map[string]int
+	statuses       map[int]int
+	latency        map[string][]time.Duration
+	requests, errs map[int64]int
+}
+
+func newStats() *stats {
+	return &stats{
+		urls:     make(map[string]int),
+		clients:  make(map[string]int),
+		statuses: make(map[int]int),
+		latency:  make(map[string][]time.Duration),
+		requests: make(map[int64]int),
+		errs:     make(map[int64]int),
+	}
+}
+
+func (st *stats) add(rec *webapp.LogRecord) {
+	t := rec.RequestStarted
+	if st.first.IsZero() || t.Before(st.first) {
+		st.first = t
+	}
+	if t.After(st.last) {
+		st.last = t
+	}
+	path := requestPath(rec.Request)
+	st.urls[path]++
+	st.clients[rec.Host]++
+	st.statuses[rec.Status]++
+	if !rec.RequestCompleted.IsZero() {
+		r := route(path)
+		st.latency[r] = append(st.latency[r], rec.RequestCompleted.Sub(rec.RequestStarted))
+	}
+	b := t.Truncate(*bucket).Unix()
+	st.requests[b]++
+	if rec.Status >= 500 {
+		st.errs[b]++
+	}
+}
+
+func (st *stats) read(r io.Reader, p webapp.Parser, name string) error {
+	ls := webapp.NewLogScanner(r, p)
+	for ls.Scan() {
+		st.lines++
+		rec, err := ls.Record()
+		if err != nil {
+			st.failed++
+			if st.failed <= 10 {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			}
+			continue
+		}
+		st.add(rec)
+	}
+	return ls.Err()
+}
+
+type counted struct {
+	key   string
+	count int
+}
+
+func topN(m map[string]int, n int) []counted {
+	list := make([]counted, 0, len(m))
+	for k, c := range m {
+		list = append(list, counted{k, c})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].count != list[j].count {
+			return list[i].count > list[j].count
+		}
+		return list[i].key < list[j].key
+	})
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(p*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+func ms(d time.Duration) string {
+	return fmt.Sprintf("%.1fms", float64(d)/float64(time.Millisecond))
+}
+
+func (st *stats) report(w io.Writer) {
+	total := st.lines - st.failed
+	fmt.Fprintf(w, "Requests: %d (%d unparsable lines)\n", total, st.failed)
+	if total == 0 {
+		return
+	}
+	fmt.Fprintf(w, "Period:   %s - %s\n", st.first.Format(webapp.ApacheTime), st.last.Format(webapp.ApacheTime))
+
+	fmt.Fprintf(w, "\nTop URLs:\n")
+	for _, c := range topN(st.urls, *top) {
+		fmt.Fprintf(w, "%8d  %s\n", c.count, c.key)
+	}
+
+	fmt.Fprintf(w, "\nStatus codes:\n")
+	codes := make([]int, 0, len(st.statuses))
+	for code := range st.statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		n := st.statuses[code]
+		fmt.Fprintf(w, "%8d  %d  %5.1f%%\n", n, code, 100*float64(n)/float64(total))
+	}
+
+	fmt.Fprintf(w, "\nLatency per route:\n")
+	if len(st.latency) == 0 {
+		fmt.Fprintf(w, "  no durations in this log format\n")
+	} else {
+		routes := make([]string, 0, len(st.latency))
+		for r := range st.latency {
+			routes = append(routes, r)
+		}
+		sort.Slice(routes, func(i, j int) bool { return len(st.latency[routes[i]]) > len(st.latency[routes[j]]) })
+		if len(routes) > *top {
+			routes = routes[:*top]
+		}
+		fmt.Fprintf(w, "%8s %10s %10s %10s %10s  %s\n", "count", "p50", "p90", "p99", "max", "route")
+		for _, r := range routes {
+			d := st.latency[r]
+			sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+			fmt.Fprintf(w, "%8d %10s %10s %10s %10s  %s\n", len(d),
+				ms(percentile(d, 0.5)), ms(percentile(d, 0.9)), ms(percentile(d, 0.99)), ms(d[len(d)-1]), r)
+		}
+	}
+
+	fmt.Fprintf(w, "\nTop clients:\n")
+	for _, c := range topN(st.clients, *top) {
+		fmt.Fprintf(w, "%8d  %s\n", c.count, c.key)
+	}
+
+	fmt.Fprintf(w, "\nError spikes (5xx per %s):\n", *bucket)
+	nerrs := 0
+	for _, n := range st.errs {
+		nerrs += n
+	}
+	avg := float64(nerrs) / float64(len(st.requests))
+	var spikes []int64
+	for b, n := range st.errs {
+		if float64(n) > *spike*avg && n > 1 {
+			spikes = append(spikes, b)
+		}
+	}
+	sort.Slice(spikes, func(i, j int) bool { return spikes[i] < spikes[j] })
+	if len(spikes) == 0 {
+		fmt.Fprintf(w, "  none (%.2f errors per bucket on average)\n", avg)
+	}
+	for _, b := range spikes {
+		n, all := st.errs[b], st.requests[b]
+		fmt.Fprintf(w, "  %s  %d errors of %d requests (%.1f%%)\n",
+			time.Unix(b, 0).In(st.first.Location()).Format(webapp.ApacheTime), n, all, 100*float64(n)/float64(all))
+	}
+}
+
+func main() {
+	flag.Parse()
+	parse, err := webapp.ParserByName(*format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bad format %q: %v\n", *format, err)
+		os.Exit(2)
+	}
+	st := newStats()
+	if flag.NArg() == 0 {
+		if err := st.read(os.Stdin, parse, "stdin"); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	for _, name := range flag.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		err = st.read(f, parse, name)
+		f.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	st.report(os.Stdout)
+}
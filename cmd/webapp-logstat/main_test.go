@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	webapp "github.com/abbot/go-webapp"
+)
+
+func TestRoute(t *testing.T) {
+	for request, want := range map[string]string{
+		"GET /users/42/orders?page=2 HTTP/1.1":                   "/users/:id/orders",
+		"GET /items/0123456789abcdef0123 HTTP/1.1":               "/items/:id",
+		"GET /o/123e4567-e89b-12d3-a456-426614174000/x HTTP/1.1": "/o/:id/x",
+		"GET /v2/static/app.js HTTP/1.1":                         "/v2/static/app.js",
+		"garbage":                                                "garbage",
+	} {
+		if got := route(requestPath(request)); got != want {
+			t.Errorf("route of %q = %s, want %s", request, got, want)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	start := time.Date(2013, time.January, 2, 15, 0, 0, 0, time.UTC)
+	var log strings.Builder
+	add := func(offset time.Duration, host, path string, status int, d time.Duration) {
+		rec := &webapp.LogRecord{Host: host, Indent: "-", User: "-", Request: "GET " + path + " HTTP/1.1",
+			Status: status, RequestStarted: start.Add(offset), RequestCompleted: start.Add(offset + d)}
+		log.WriteString(webapp.PerfFormat(rec) + "\n")
+	}
+	for i := 0; i < 10; i++ {
+		add(time.Duration(i)*time.Minute, "192.0.2.1", "/users/"+string(rune('0'+i)), 200, time.Duration(i+1)*10*time.Millisecond)
+		add(time.Duration(i)*time.Minute, "192.0.2.2", "/", 200, time.Millisecond)
+	}
+	for i := 0; i < 5; i++ {
+		add(5*time.Minute, "192.0.2.3", "/", 503, time.Millisecond)
+	}
+	log.WriteString("not a log line\n\n")
+
+	st := newStats()
+	if err := st.read(strings.NewReader(log.String()), webapp.AutoParser, "test"); err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	st.report(&out)
+	report := out.String()
+	for _, want := range []string{
+		"Requests: 25 (1 unparsable lines)",
+		"      15  /\n",
+		"      20  200   80.0%",
+		"      10     50.0ms     90.0ms    100.0ms    100.0ms  /users/:id",
+		"      10  192.0.2.1",
+		"02/Jan/2013:15:05:00 +0000  5 errors of 7 requests",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report does not contain %q:\n%s", want, report)
+		}
+	}
+}
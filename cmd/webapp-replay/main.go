@@ -0,0 +1,282 @@
+// Command webapp-replay replays the GET requests of an access log written
+// by the webapp formatters against a target server, preserving their
+// relative timing, and reports responses whose status differs from the
+// original or which became markedly slower.
+//
+// Usage:
+//
+//	webapp-replay -target http://localhost:8080 [-speed 2] [-format auto] access.log
+//
+// With -speed 0 requests are sent as fast as -concurrency allows. The
+// exit status is 1 if any regression was found.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	webapp "github.com/abbot/go-webapp"
+)
+
+var (
+	target      = flag.String("target", "", "base URL of the server to replay against")
+	format      = flag.String("format", "auto", "log format: auto, combined, vhost_combined, perf, json, logfmt, nginx_main, w3c or an Apache format string")
+	speed       = flag.Float64("speed", 1, "replay speed multiplier, 0 for no delays")
+	concurrency = positiveFlag("concurrency", 16, "maximum number of requests in flight")
+	timeout     = flag.Duration("timeout", 10*time.Second, "request timeout")
+	factor      = flag.Float64("latency-factor", 2, "report requests slower than this many times the original")
+	minDelta    = flag.Duration("min-delta", 50*time.Millisecond, "ignore latency increases smaller than this")
+	limit       = flag.Int("limit", 0, "replay at most this many requests")
+	show        = flag.Int("show", 20, "number of regressions to list")
+)
+
+// positiveInt is an int flag which must be at least 1.
+type positiveInt int
+
+func positiveFlag(name string, value int, usage string) *int {
+	p := new(int)
+	*p = value
+	flag.Var((*positiveInt)(p), name, usage)
+	return p
+}
+
+func (n *positiveInt) String() string {
+	return strconv.Itoa(int(*n))
+}
+
+func (n *positiveInt) Set(s string) error {
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return errors.New("parse error")
+	}
+	if v < 1 {
+		return errors.New("must be at least 1")
+	}
+	*n = positiveInt(v)
+	return nil
+}
+
+type result struct {
+	rec     *webapp.LogRecord
+	uri     string
+	status  int
+	latency time.Duration
+	err     error
+}
+
+func (r *result) original() time.Duration {
+	if r.rec.RequestCompleted.IsZero() {
+		return -1
+	}
+	return r.rec.RequestCompleted.Sub(r.rec.RequestStarted)
+}
+
+func (r *result) statusChanged() bool {
+	return r.err == nil && r.status != r.rec.Status
+}
+
+func (r *result) slower() bool {
+	orig := r.original()
+	return r.err == nil && orig >= 0 &&
+		float64(r.latency) > *factor*float64(orig) && r.latency-orig > *minDelta
+}
+
+// readGets returns the GET requests of a log sorted by start time.
+func readGets(r io.Reader, p webapp.Parser, name string) ([]*webapp.LogRecord, error) {
+	var recs []*webapp.LogRecord
+	ls := webapp.NewLogScanner(r, p)
+	for ls.Scan() {
+		rec, err := ls.Record()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			continue
+		}
+		if strings.HasPrefix(rec.Request, "GET ") {
+			recs = append(recs, rec)
+		}
+	}
+	sort.SliceStable(recs, func(i, j int) bool { return recs[i].RequestStarted.Before(recs[j].RequestStarted) })
+	return recs, ls.Err()
+}
+
+func replay(client *http.Client, base string, rec *webapp.LogRecord) *result {
+	res := &result{rec: rec}
+	if fields := strings.Fields(rec.Request); len(fields) >= 2 {
+		res.uri = fields[1]
+	}
+	req, err := http.NewRequest("GET", base+res.uri, nil)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	if rec.UserAgent != "" {
+		req.Header.Set("User-Agent", rec.UserAgent)
+	}
+	if rec.Referer != "" {
+		req.Header.Set("Referer", rec.Referer)
+	}
+	if rec.VirtualHost != "" {
+		req.Host = rec.VirtualHost
+	}
+	req.Header.Set("X-Replay", "1")
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	res.latency = time.Since(start)
+	res.status = resp.StatusCode
+	return res
+}
+
+// run replays recs, sleeping between requests to reproduce the original
+// timing scaled by speed.
+func run(client *http.Client, base string, recs []*webapp.LogRecord) []*result {
+	results := make([]*result, len(recs))
+	sem := make(chan struct{}, *concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i, rec := range recs {
+		if *speed > 0 {
+			offset := rec.RequestStarted.Sub(recs[0].RequestStarted)
+			if wait := time.Duration(float64(offset) / *speed) - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, rec *webapp.LogRecord) {
+			defer wg.Done()
+			results[i] = replay(client, base, rec)
+			<-sem
+		}(i, rec)
+	}
+	wg.Wait()
+	return results
+}
+
+func percentiles(d []time.Duration) string {
+	if len(d) == 0 {
+		return "n/a"
+	}
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	p := func(q float64) time.Duration { return d[int(q*float64(len(d)-1))] }
+	return fmt.Sprintf("p50 %s  p90 %s  p99 %s", p(0.5), p(0.9), p(0.99))
+}
+
+func report(w io.Writer, results []*result) (regressions int) {
+	var failed, changed, slower int
+	var orig, replayed []time.Duration
+	transitions := make(map[string]int)
+	var bad []*result
+	for _, r := range results {
+		if r.err != nil {
+			failed++
+			continue
+		}
+		replayed = append(replayed, r.latency)
+		if o := r.original(); o >= 0 {
+			orig = append(orig, o)
+		}
+		if r.statusChanged() {
+			changed++
+			transitions[fmt.Sprintf("%d -> %d", r.rec.Status, r.status)]++
+		}
+		if r.slower() {
+			slower++
+		}
+		if r.statusChanged() || r.slower() {
+			bad = append(bad, r)
+		}
+	}
+	fmt.Fprintf(w, "Replayed: %d requests, %d failed\n", len(results), failed)
+	fmt.Fprintf(w, "Original latency: %s\n", percentiles(orig))
+	fmt.Fprintf(w, "Replay latency:   %s\n", percentiles(replayed))
+	fmt.Fprintf(w, "Status changed:   %d\n", changed)
+	keys := make([]string, 0, len(transitions))
+	for k := range transitions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "  %-12s %d\n", k, transitions[k])
+	}
+	fmt.Fprintf(w, "Slower:           %d (more than %.1fx and %s)\n", slower, *factor, *minDelta)
+	if len(bad) > 0 {
+		sort.SliceStable(bad, func(i, j int) bool {
+			return bad[i].latency-bad[i].original() > bad[j].latency-bad[j].original()
+		})
+		if len(bad) > *show {
+			bad = bad[:*show]
+		}
+		fmt.Fprintf(w, "\nRegressions:\n")
+		for _, r := range bad {
+			orig := "-"
+			if o := r.original(); o >= 0 {
+				orig = o.String()
+			}
+			fmt.Fprintf(w, "  %d -> %d  %s -> %s  %s\n", r.rec.Status, r.status, orig, r.latency.Round(time.Microsecond), r.uri)
+		}
+	}
+	for _, r := range results {
+		if r.err != nil {
+			fmt.Fprintf(w, "\nFirst failure: %s: %v\n", r.uri, r.err)
+			break
+		}
+	}
+	return changed + slower + failed
+}
+
+func main() {
+	flag.Parse()
+	if *target == "" || flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: webapp-replay -target URL [flags] access.log")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	p, err := webapp.ParserByName(*format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bad format %q: %v\n", *format, err)
+		os.Exit(2)
+	}
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	recs, err := readGets(f, p, flag.Arg(0))
+	f.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *limit > 0 && len(recs) > *limit {
+		recs = recs[:*limit]
+	}
+	if len(recs) == 0 {
+		fmt.Fprintln(os.Stderr, "no GET requests in log")
+		os.Exit(1)
+	}
+	client := &http.Client{
+		Timeout: *timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	results := run(client, strings.TrimRight(*target, "/"), recs)
+	if report(os.Stdout, results) > 0 {
+		os.Exit(1)
+	}
+}
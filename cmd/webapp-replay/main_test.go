@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	webapp "github.com/abbot/go-webapp"
+)
+
+func TestReplay(t *testing.T) {
+	*speed = 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Replay") != "1" || r.UserAgent() != "tester" {
+			t.Errorf("replayed request headers %v", r.Header)
+		}
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+		case "/gone":
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	start := time.Date(2013, time.January, 2, 15, 0, 0, 0, time.UTC)
+	var log strings.Builder
+	add := func(offset time.Duration, request string, status int) {
+		rec := &webapp.LogRecord{Host: "192.0.2.1", Indent: "-", User: "-", Request: request, Status: status,
+			UserAgent: "tester", RequestStarted: start.Add(offset), RequestCompleted: start.Add(offset + time.Millisecond)}
+		log.WriteString(webapp.JSONFormat(rec) + "\n")
+	}
+	add(2*time.Second, "GET /gone HTTP/1.1", 200)
+	add(time.Second, "GET /ok?x=1 HTTP/1.1", 200)
+	add(3*time.Second, "POST /ok HTTP/1.1", 201)
+	add(4*time.Second, "GET /slow HTTP/1.1", 200)
+	log.WriteString("garbage\n")
+
+	recs, err := readGets(strings.NewReader(log.String()), webapp.AutoParser, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 3 || recs[0].Request != "GET /ok?x=1 HTTP/1.1" {
+		t.Fatalf("readGets = %d records, want the 3 GETs in time order", len(recs))
+	}
+	results := run(srv.Client(), srv.URL, recs)
+	for i, want := range []int{200, 404, 200} {
+		if r := results[i]; r.err != nil || r.status != want {
+			t.Errorf("replay of %s = %d, %v, want %d", r.uri, r.status, r.err, want)
+		}
+	}
+	var out strings.Builder
+	if n := report(&out, results); n != 2 {
+		t.Errorf("report found %d regressions, want 2:\n%s", n, out.String())
+	}
+	for _, want := range []string{"Replayed: 3 requests, 0 failed", "  200 -> 404   1", "Slower:           1", "/slow\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report does not contain %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestReplayVirtualHost(t *testing.T) {
+	hosts := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts <- r.Host
+	}))
+	defer srv.Close()
+	rec := &webapp.LogRecord{Request: "GET / HTTP/1.1", Status: 200, VirtualHost: "shop.example.com"}
+	if res := replay(srv.Client(), srv.URL, rec); res.err != nil || res.status != 200 {
+		t.Fatalf("replay = %d, %v", res.status, res.err)
+	}
+	if host := <-hosts; host != "shop.example.com" {
+		t.Errorf("replayed with Host %s, want the logged virtual host", host)
+	}
+}
+
+func TestConcurrencyFlag(t *testing.T) {
+	for _, tc := range []struct {
+		arg string
+		ok  bool
+	}{
+		{"1", true},
+		{"64", true},
+		{"0", false},
+		{"-4", false},
+		{"many", false},
+	} {
+		n := positiveInt(16)
+		err := n.Set(tc.arg)
+		if (err == nil) != tc.ok || tc.ok && n.String() != tc.arg {
+			t.Errorf("-concurrency %s = %v, %v", tc.arg, n, err)
+		}
+	}
+	if f := flag.Lookup("concurrency"); f == nil || f.Value.Set("0") == nil || *concurrency != 16 {
+		t.Errorf("-concurrency 0 accepted by the registered flag")
+	}
+}
@@ -0,0 +1,215 @@
+package webapp
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ECSVersion is the Elastic Common Schema version of ECS output.
+const ECSVersion = "8.11.0"
+
+type ecsEvent struct {
+	Kind     string   `json:"kind"`
+	Category []string `json:"category"`
+	Type     []string `json:"type"`
+	Outcome  string   `json:"outcome,omitempty"`
+	Duration int64    `json:"duration,omitempty"`
+	Action   string   `json:"action,omitempty"`
+}
+
+type ecsRequest struct {
+	Method   string `json:"method,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Referrer string `json:"referrer,omitempty"`
+}
+
+type ecsBody struct {
+	Bytes uint64 `json:"bytes"`
+}
+
+type ecsResponse struct {
+	StatusCode int      `json:"status_code,omitempty"`
+	Body       *ecsBody `json:"body,omitempty"`
+}
+
+type ecsHTTP struct {
+	Request  ecsRequest   `json:"request"`
+	Response *ecsResponse `json:"response,omitempty"`
+	Version  string       `json:"version,omitempty"`
+}
+
+type ecsURL struct {
+	Original string `json:"original,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Query    string `json:"query,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+}
+
+type ecsIP struct {
+	IP string `json:"ip,omitempty"`
+}
+
+type ecsName struct {
+	Name string `json:"name,omitempty"`
+}
+
+type ecsOriginal struct {
+	Original string `json:"original,omitempty"`
+}
+
+type ecsError struct {
+	Message    string `json:"message"`
+	Type       string `json:"type,omitempty"`
+	StackTrace string `json:"stack_trace,omitempty"`
+}
+
+type ecsLog struct {
+	Origin struct {
+		Function string `json:"function,omitempty"`
+	} `json:"origin"`
+}
+
+type ecsVersion struct {
+	Version string `json:"version"`
+}
+
+type ecsDocument struct {
+	Timestamp string            `json:"@timestamp"`
+	ECS       ecsVersion        `json:"ecs"`
+	Message   string            `json:"message,omitempty"`
+	Event     ecsEvent          `json:"event"`
+	HTTP      ecsHTTP           `json:"http"`
+	URL       ecsURL            `json:"url"`
+	Client    ecsIP             `json:"client"`
+	Host      *ecsName          `json:"host,omitempty"`
+	User      *ecsName          `json:"user,omitempty"`
+	UserAgent *ecsOriginal      `json:"user_agent,omitempty"`
+	Error     *ecsError         `json:"error,omitempty"`
+	Log       *ecsLog           `json:"log,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+func ecsURLOf(path, query string) ecsURL {
+	return ecsURL{Original: path + query, Path: path, Query: strings.TrimPrefix(query, "?")}
+}
+
+func ecsHTTPVersion(proto string) string {
+	return strings.TrimPrefix(proto, "HTTP/")
+}
+
+// ECS returns a formatter writing access log records as Elastic Common
+// Schema JSON documents: http.request.method, url.path, client.ip,
+// event.duration in nanoseconds and so on. Fields attached with AddField
+// become labels.
+func (o FormatOptions) ECS() Formatter {
+	return func(rec *LogRecord) string {
+		method, path, query, proto := requestParts(rec.Request)
+		doc := ecsDocument{
+			Timestamp: o.RFC3339(rec.RequestStarted),
+			Event: ecsEvent{
+				Kind:     "event",
+				Category: []string{"web"},
+				Type:     []string{"access"},
+				Outcome:  "success",
+				Duration: int64(duration(rec)),
+			},
+			HTTP: ecsHTTP{
+				Request:  ecsRequest{Method: method, ID: rec.RequestID, Referrer: rec.Referer},
+				Response: &ecsResponse{StatusCode: rec.Status, Body: &ecsBody{rec.Bytes}},
+				Version:  ecsHTTPVersion(proto),
+			},
+			URL:    ecsURLOf(path, query),
+			Client: ecsIP{IP: strings.Trim(rec.Host, "[]")}, // records parsed from old logs may have brackets
+			ECS:    ecsVersion{ECSVersion},
+		}
+		if rec.VirtualHost != "" {
+			doc.URL.Domain = rec.VirtualHost
+			doc.Host = &ecsName{rec.VirtualHost}
+		}
+		if rec.Status >= 400 {
+			doc.Event.Outcome = "failure"
+			doc.Event.Type = append(doc.Event.Type, "error")
+		}
+		if rec.User != "" && rec.User != "-" {
+			doc.User = &ecsName{rec.User}
+		}
+		if rec.UserAgent != "" {
+			doc.UserAgent = &ecsOriginal{rec.UserAgent}
+		}
+		if len(rec.Fields) != 0 {
+			doc.Labels = make(map[string]string, len(rec.Fields))
+			for _, f := range rec.Fields {
+				doc.Labels[f.Key] = string(appendFieldValue(nil, f.Value))
+			}
+		}
+		b, _ := json.Marshal(&doc)
+		return string(b)
+	}
+}
+
+// ECSEvent returns an EventFormatter writing panics and authentication
+// failures as ECS documents, with error.message and error.stack_trace
+// for panics.
+func (o FormatOptions) ECSEvent() EventFormatter {
+	return func(ev *ErrorEvent) string {
+		doc := ecsDocument{
+			Timestamp: o.RFC3339(ev.Time),
+			Event: ecsEvent{
+				Kind:     "alert",
+				Category: []string{"web"},
+				Type:     []string{"error"},
+				Outcome:  "failure",
+				Action:   ev.Kind,
+			},
+			HTTP:   ecsHTTP{Request: ecsRequest{ID: ev.RequestID}},
+			Client: ecsIP{IP: eventClient(ev)},
+			Error:  &ecsError{Message: fmt.Sprint(ev.Value), Type: fmt.Sprintf("%T", ev.Value)},
+			ECS:    ecsVersion{ECSVersion},
+		}
+		switch ev.Kind {
+		case EventPanic:
+			doc.Message = "panic: " + doc.Error.Message
+			doc.Error.StackTrace = string(ev.Stack)
+			doc.Log = &ecsLog{}
+			doc.Log.Origin.Function = ev.Where
+		case EventAuthFailure:
+			doc.Message = "authentication failed: " + doc.Error.Message
+			doc.Event.Kind = "event"
+			doc.Event.Category = []string{"authentication"}
+			doc.Event.Type = []string{"start"}
+		}
+		if r := ev.Request; r != nil {
+			doc.HTTP.Request.Method = r.Method
+			doc.HTTP.Request.Referrer = r.Referer()
+			doc.HTTP.Version = ecsHTTPVersion(r.Proto)
+			query := ""
+			if r.URL.RawQuery != "" {
+				query = "?" + r.URL.RawQuery
+			}
+			doc.URL = ecsURLOf(r.URL.Path, query)
+			if vhost := virtualHost(r); vhost != "" {
+				doc.URL.Domain = vhost
+				doc.Host = &ecsName{vhost}
+			}
+			if ua := r.UserAgent(); ua != "" {
+				doc.UserAgent = &ecsOriginal{ua}
+			}
+		}
+		b, _ := json.Marshal(&doc)
+		return string(b)
+	}
+}
+
+var (
+	ecsFormat      = FormatOptions{}.ECS()
+	ecsEventFormat = FormatOptions{}.ECSEvent()
+)
+
+func ECSFormat(rec *LogRecord) string {
+	return ecsFormat(rec)
+}
+
+func ECSEventFormat(ev *ErrorEvent) string {
+	return ecsEventFormat(ev)
+}
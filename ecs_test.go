@@ -0,0 +1,115 @@
+package webapp
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestECSFormat(t *testing.T) {
+	rec := formatRecord()
+	rec.Request = "GET /search?q=tea HTTP/1.1"
+	rec.VirtualHost = "shop.example.com"
+	rec.Status = 404
+	rec.Fields = []Field{{"user_id", 42}}
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(ECSFormat(rec)), &doc); err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) interface{} {
+		var v interface{} = doc
+		for _, key := range strings.Split(path, ".") {
+			m, _ := v.(map[string]interface{})
+			v = m[key]
+		}
+		return v
+	}
+	for path, want := range map[string]interface{}{
+		"@timestamp":                "2013-01-02T15:04:05.123+01:00",
+		"ecs.version":               ECSVersion,
+		"event.outcome":             "failure",
+		"event.duration":            float64(42 * time.Millisecond),
+		"http.request.method":       "GET",
+		"http.request.id":           "req-1",
+		"http.request.referrer":     "http://example.com/",
+		"http.response.status_code": 404.0,
+		"http.response.body.bytes":  1234.0,
+		"http.version":              "1.1",
+		"url.original":              "/search?q=tea",
+		"url.path":                  "/search",
+		"url.query":                 "q=tea",
+		"url.domain":                "shop.example.com",
+		"client.ip":                 "192.0.2.1",
+		"user.name":                 "frank",
+		"user_agent.original":       "Mozilla/5.0",
+		"labels.user_id":            "42",
+	} {
+		if got := get(path); got != want {
+			t.Errorf("%s = %#v, want %#v", path, got, want)
+		}
+	}
+	if types, _ := get("event.type").([]interface{}); len(types) != 2 || types[1] != "error" {
+		t.Errorf("event.type = %v, want access and error", types)
+	}
+
+	// anonymous successful requests leave out user and error type
+	rec.Status, rec.User = 200, "-"
+	line := ECSFormat(rec)
+	if strings.Contains(line, `"user"`) || strings.Contains(line, `"error"`) || !strings.Contains(line, `"outcome":"success"`) {
+		t.Errorf("ECSFormat = %s", line)
+	}
+}
+
+func TestECSEventFormat(t *testing.T) {
+	var out lockedBuffer
+	app := NewApp(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}, false)
+	app.Clock = &fakeClock{time.Date(2013, time.January, 2, 15, 4, 5, 0, time.UTC)}
+	app.Auth = &BearerAuth{Validate: func(r *http.Request, token string) (*Principal, error) {
+		if token == "good" {
+			return &Principal{Name: "frank"}, nil
+		}
+		return nil, errors.New("bad token")
+	}}
+	done := make(chan struct{}, 2)
+	app.AddEventLogger(ECSEventFormat, log.New(&out, "", 0))
+	app.AddEventHandler(func(*ErrorEvent) { done <- struct{}{} })
+
+	for _, token := range []string{"bad", "good"} {
+		r := httptest.NewRequest("GET", "/a?b=c", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		app.ServeHTTP(httptest.NewRecorder(), r)
+		<-done
+	}
+	// no credentials: not reported
+	app.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	select {
+	case <-done:
+		t.Error("request without credentials reported")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	lines := waitLines(t, &out, 2)
+	if len(lines) != 2 {
+		t.Fatalf("logged %q, want an auth failure and a panic", lines)
+	}
+	for i, want := range []string{
+		`"message":"authentication failed: bad token","event":{"kind":"event","category":["authentication"],"type":["start"],"outcome":"failure","action":"auth_failure"}`,
+		`"message":"panic: boom","event":{"kind":"alert","category":["web"],"type":["error"],"outcome":"failure","action":"panic"}`,
+	} {
+		if !strings.HasPrefix(lines[i], `{"@timestamp":"2013-01-02T15:04:05.000Z"`) || !strings.Contains(lines[i], want) ||
+			!strings.Contains(lines[i], `"url":{"original":"/a?b=c","path":"/a","query":"b=c","domain":"example.com"}`) ||
+			!strings.Contains(lines[i], `"client":{"ip":"192.0.2.1"}`) {
+			t.Errorf("event %d = %s, want %s", i, lines[i], want)
+		}
+	}
+	if !strings.Contains(lines[1], `"stack_trace":"`) || !strings.Contains(lines[1], `"log":{"origin":{"function":"`) || !strings.Contains(lines[1], `ecs_test.go`) {
+		t.Errorf("panic event without stack: %s", lines[1])
+	}
+}
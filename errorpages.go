@@ -0,0 +1,180 @@
+package webapp
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrorPageData is passed to ErrorPage templates.
+type ErrorPageData struct {
+	Status     int
+	StatusText string
+	Path       string
+	RequestID  string
+}
+
+// ErrorPage renders the HTML body of an error response.
+type ErrorPage interface {
+	RenderError(w io.Writer, data *ErrorPageData) error
+}
+
+type htmlErrorPage struct {
+	tmpl *template.Template
+}
+
+func (p htmlErrorPage) RenderError(w io.Writer, data *ErrorPageData) error {
+	return p.tmpl.Execute(w, data)
+}
+
+// NewErrorPage parses an html/template executed with *ErrorPageData.
+func NewErrorPage(text string) (ErrorPage, error) {
+	tmpl, err := template.New("error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return htmlErrorPage{tmpl}, nil
+}
+
+type templatesErrorPage struct {
+	t    *Templates
+	name string
+}
+
+func (p templatesErrorPage) RenderError(w io.Writer, data *ErrorPageData) error {
+	return p.t.Execute(w, p.name, data)
+}
+
+// ErrorPage returns an ErrorPage rendering page name with *ErrorPageData.
+func (t *Templates) ErrorPage(name string) ErrorPage {
+	return templatesErrorPage{t, name}
+}
+
+// SetErrorPage registers the page shown for responses with the given
+// status.
+//
+// When a handler sends such a status without a body, or with a plain text
+// body like http.Error and http.NotFound do, the body is discarded and
+// replaced: clients accepting HTML get the page, clients preferring JSON
+// get an APIError envelope and others a short text message. Responses with
+// any other content type, or with a body but no Content-Type, are passed
+// through untouched. The original status is kept in the LogRecord.
+//
+// The page registered for 500 is also used by HandlePanic unless
+// StackIn500 or JSONErrors are set.
+func (app *App) SetErrorPage(status int, page ErrorPage) {
+	if app.ErrorPages == nil {
+		app.ErrorPages = make(map[int]ErrorPage)
+	}
+	app.ErrorPages[status] = page
+}
+
+func (app *App) interceptError(status int, h http.Header) bool {
+	if app.ErrorPages[status] == nil {
+		return false
+	}
+	ct := h.Get("Content-Type")
+	return ct == "" || strings.HasPrefix(ct, "text/plain")
+}
+
+// errorCode turns "Method Not Allowed" into "method_not_allowed".
+func errorCode(status int) string {
+	code := strings.ToLower(http.StatusText(status))
+	code = strings.NewReplacer(" ", "_", "-", "_", "'", "").Replace(code)
+	if code == "" {
+		code = "error"
+	}
+	return code
+}
+
+// negotiate returns the offer best matching an Accept header, or the first
+// offer if nothing matches.
+func negotiate(accept string, offers ...string) string {
+	if accept == "" {
+		return offers[0]
+	}
+	best, bestQ := offers[0], -1.0
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		for _, offer := range offers {
+			if q > bestQ && q > 0 && (mt == offer || mt == "*/*" ||
+				strings.HasSuffix(mt, "/*") && strings.HasPrefix(offer, mt[:len(mt)-1])) {
+				best, bestQ = offer, q
+			}
+		}
+	}
+	return best
+}
+
+// writeErrorPage writes the error page for rec.Status to the underlying
+// writer, bypassing interception.
+func (app *App) writeErrorPage(rec *LogRecord, r *http.Request) {
+	status := rec.Status
+	data := &ErrorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Path:       r.URL.Path,
+		RequestID:  rec.RequestID,
+	}
+	h := rec.Header()
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	h.Set("X-Content-Type-Options", "nosniff")
+
+	var body bytes.Buffer
+	var ctype string
+	switch negotiate(r.Header.Get("Accept"), "text/html", "application/json", "text/plain") {
+	case "text/html":
+		if err := app.ErrorPages[status].RenderError(&body, data); err == nil {
+			ctype = "text/html; charset=utf-8"
+			break
+		}
+		body.Reset()
+		fallthrough
+	case "text/plain":
+		ctype = "text/plain; charset=utf-8"
+		body.WriteString(strconv.Itoa(status) + " " + data.StatusText + "\n")
+	case "application/json":
+		WriteError(&rawWriter{rec}, r, &APIError{Status: status, Code: errorCode(status), Message: data.StatusText})
+		return
+	}
+	h.Set("Content-Type", ctype)
+	rec.ResponseWriter.WriteHeader(status)
+	if r.Method != "HEAD" {
+		n, _ := rec.ResponseWriter.Write(body.Bytes())
+		rec.Bytes += uint64(n)
+	}
+}
+
+// rawWriter writes to the writer under a LogRecord, counting bytes but
+// without interception.
+type rawWriter struct {
+	rec *LogRecord
+}
+
+func (w *rawWriter) Header() http.Header {
+	return w.rec.Header()
+}
+
+func (w *rawWriter) Write(p []byte) (int, error) {
+	n, err := w.rec.ResponseWriter.Write(p)
+	w.rec.Bytes += uint64(n)
+	return n, err
+}
+
+func (w *rawWriter) WriteHeader(status int) {
+	w.rec.ResponseWriter.WriteHeader(status)
+}
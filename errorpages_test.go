@@ -0,0 +1,145 @@
+package webapp
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func errorPageApp(t *testing.T, h http.HandlerFunc) *App {
+	page, err := NewErrorPage(`<h1>{{.Status}} {{.StatusText}}</h1><p>{{.Path}}</p>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := NewApp(h, false)
+	app.SetErrorPage(404, page)
+	app.SetErrorPage(500, page)
+	return app
+}
+
+func getWithAccept(app http.Handler, method, path, accept string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	return w
+}
+
+func TestErrorPages(t *testing.T) {
+	app := errorPageApp(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/empty":
+			w.WriteHeader(404)
+		case "/json":
+			WriteJSON(w, 404, map[string]string{"own": "body"})
+		case "/gone":
+			http.Error(w, "gone", http.StatusGone)
+		case "/own":
+			// a body without a Content-Type is the handler's own page
+			w.WriteHeader(404)
+			w.Write([]byte("<p>custom</p>"))
+		case "/copied":
+			w.WriteHeader(404)
+			io.Copy(w, strings.NewReader("<p>copied</p>"))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	for _, tc := range []struct {
+		path, accept string
+		ctype        string
+		body         string
+	}{
+		{"/missing", "text/html,application/xhtml+xml,*/*;q=0.8", "text/html; charset=utf-8", "<h1>404 Not Found</h1><p>/missing</p>"},
+		{"/<script>", "text/html", "text/html; charset=utf-8", "<h1>404 Not Found</h1><p>/&lt;script&gt;</p>"},
+		{"/empty", "", "text/html; charset=utf-8", "<h1>404 Not Found</h1><p>/empty</p>"},
+		{"/missing", "text/plain", "text/plain; charset=utf-8", "404 Not Found\n"},
+		{"/missing", "application/json", "application/json; charset=utf-8", `"code":"not_found"`},
+		{"/json", "text/html", "application/json; charset=utf-8", `{"own":"body"}`},
+		{"/gone", "text/html", "text/plain; charset=utf-8", "gone\n"},
+		{"/own", "text/html", "", "<p>custom</p>"},
+		{"/copied", "text/html", "", "<p>copied</p>"},
+	} {
+		w := getWithAccept(app, "GET", tc.path, tc.accept)
+		if w.Code != 404 && tc.path != "/gone" || w.Header().Get("Content-Type") != tc.ctype || !strings.Contains(w.Body.String(), tc.body) {
+			t.Errorf("GET %s, Accept %q = %d %q %q, want %q %q", tc.path, tc.accept, w.Code, w.Header().Get("Content-Type"), w.Body, tc.ctype, tc.body)
+		}
+	}
+	if w := getWithAccept(app, "HEAD", "/missing", "text/html"); w.Code != 404 || w.Body.Len() != 0 {
+		t.Errorf("HEAD = %d %q, want 404 without a body", w.Code, w.Body)
+	}
+}
+
+func TestErrorPageLogged(t *testing.T) {
+	app := errorPageApp(t, http.NotFound)
+	logs := make(chan *LogRecord, 1)
+	app.Loggers = append(app.Loggers, logs)
+	w := getWithAccept(app, "GET", "/missing", "text/html")
+	if rec := <-logs; rec.Status != 404 || rec.Bytes != uint64(w.Body.Len()) {
+		t.Errorf("logged %d with %d bytes, want 404 with the %d bytes of the page", rec.Status, rec.Bytes, w.Body.Len())
+	}
+}
+
+func TestErrorPagePanic(t *testing.T) {
+	app := errorPageApp(t, func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+	w := getWithAccept(app, "GET", "/", "text/html")
+	if w.Code != 500 || w.Body.String() != "<h1>500 Internal Server Error</h1><p>/</p>" {
+		t.Errorf("panic response = %d %q, want the 500 page", w.Code, w.Body)
+	}
+	var env errorEnvelope
+	w = getWithAccept(app, "GET", "/", "application/json")
+	if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil || env.Error.Code != "internal_server_error" {
+		t.Errorf("panic response for JSON clients = %q, %v", w.Body, err)
+	}
+}
+
+func TestTemplatesErrorPage(t *testing.T) {
+	fsys := templateFS()
+	fsys["pages/error.html"] = &fstest.MapFile{Data: []byte(`{{define "layout"}}error {{.Status}}{{end}}`)}
+	tmpl := NewTemplates(fsys, false)
+	if err := tmpl.Load(); err != nil {
+		t.Fatal(err)
+	}
+	app := NewApp(http.NotFound, false)
+	app.SetErrorPage(404, tmpl.ErrorPage("error.html"))
+	if w := getWithAccept(app, "GET", "/", "text/html"); w.Body.String() != "error 404" {
+		t.Errorf("response = %q, want the page", w.Body)
+	}
+	// plain.html uses a field ErrorPageData lacks, so the text fallback is sent
+	app.SetErrorPage(404, tmpl.ErrorPage("plain.html"))
+	if w := getWithAccept(app, "GET", "/", "text/html"); w.Header().Get("Content-Type") != "text/plain; charset=utf-8" || w.Body.String() != "404 Not Found\n" {
+		t.Errorf("response = %q %q, want the text fallback", w.Header().Get("Content-Type"), w.Body)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	offers := []string{"text/html", "application/json", "text/plain"}
+	for accept, want := range map[string]string{
+		"":                                  "text/html",
+		"application/json":                  "application/json",
+		"text/*":                            "text/html",
+		"text/plain, text/html;q=0.5":       "text/plain",
+		"application/json;q=0, */*;q=0.1":   "text/html",
+		"image/png":                         "text/html",
+		"application/json;q=0.9, text/html": "text/html",
+		"bogus;;, application/json":         "application/json",
+	} {
+		if got := negotiate(accept, offers...); got != want {
+			t.Errorf("negotiate(%q) = %s, want %s", accept, got, want)
+		}
+	}
+	if code := errorCode(http.StatusMethodNotAllowed); code != "method_not_allowed" {
+		t.Errorf("errorCode(405) = %s", code)
+	}
+	if code := errorCode(999); code != "error" {
+		t.Errorf("errorCode(999) = %s", code)
+	}
+}
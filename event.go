@@ -0,0 +1,79 @@
+package webapp
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// Kinds of ErrorEvent.
+const (
+	EventPanic       = "panic"
+	EventAuthFailure = "auth_failure"
+)
+
+// ErrorEvent describes a problem that happened while serving a request.
+// For panics, Value is the recovered value and Where and Stack point to
+// the place of the panic. For authentication failures Value is the error
+// of the Authenticator; requests without credentials are not reported.
+type ErrorEvent struct {
+	Kind      string
+	Time      time.Time
+	Value     interface{}
+	Where     string
+	Stack     []byte
+	Request   *http.Request
+	RequestID string
+	Record    *LogRecord
+}
+
+// AddEventHandler calls h for every ErrorEvent of the App. Events are
+// delivered in order from a separate goroutine.
+func (app *App) AddEventHandler(h func(*ErrorEvent)) {
+	ch := make(chan *ErrorEvent, 1000)
+	app.Events = append(app.Events, ch)
+	handle := func(ev *ErrorEvent) {
+		h(ev)
+		if ev.Record != nil {
+			ev.Record.Release()
+		}
+	}
+	flush := app.addFlush()
+	go func() {
+		for {
+			select {
+			case ev := <-ch:
+				handle(ev)
+			case done := <-flush:
+				for len(ch) > 0 {
+					handle(<-ch)
+				}
+				close(done)
+			}
+		}
+	}()
+}
+
+// EventFormatter formats an ErrorEvent as a log line.
+type EventFormatter func(*ErrorEvent) string
+
+// AddEventLogger writes every ErrorEvent formatted by f to log.
+func (app *App) AddEventLogger(f EventFormatter, log *log.Logger) {
+	app.AddEventHandler(func(ev *ErrorEvent) {
+		log.Output(1, f(ev))
+	})
+}
+
+// eventClient returns the client address of the request of ev.
+func eventClient(ev *ErrorEvent) string {
+	if ev.Request == nil {
+		return ""
+	}
+	return remoteHost(ev.Request)
+}
+
+func (app *App) sendEvent(ev *ErrorEvent) {
+	for _, ch := range app.Events {
+		ch <- ev
+	}
+}
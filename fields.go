@@ -0,0 +1,257 @@
+package webapp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Field is a key/value pair attached to a request by its handler.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// AddField attaches a field to the log line of a request served by App,
+// replacing an earlier field with the same key:
+//
+//	webapp.AddField(r, "user_id", 42)
+//
+// Text formats append fields as key=value after the standard columns, JSON
+// adds them as properties. Keys are made of letters, digits, '_', '.' and
+// '-' and start with a letter or '_'; other characters are replaced by
+// '_', so that "user id" becomes "user_id" and the line can still be
+// parsed. Values are formatted with fmt unless they are strings, numbers,
+// booleans, errors or durations.
+func AddField(r *http.Request, key string, value interface{}) {
+	rec := Record(r)
+	if rec == nil {
+		return
+	}
+	key = fieldKey(key)
+	for i := range rec.Fields {
+		if rec.Fields[i].Key == key {
+			rec.Fields[i].Value = value
+			return
+		}
+	}
+	rec.Fields = append(rec.Fields, Field{key, value})
+}
+
+// Field returns the value of a field attached to rec, or nil.
+func (rec *LogRecord) Field(key string) interface{} {
+	key = fieldKey(key)
+	for _, f := range rec.Fields {
+		if f.Key == key {
+			return f.Value
+		}
+	}
+	return nil
+}
+
+// fieldKey makes key match the keys of textFields.
+func fieldKey(key string) string {
+	valid := key != ""
+	for i := 0; valid && i < len(key); i++ {
+		valid = fieldKeyChar(key[i], i == 0)
+	}
+	if valid {
+		return key
+	}
+	b := []byte(key)
+	for i, c := range b {
+		if !fieldKeyChar(c, i == 0) {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 {
+		return "_"
+	}
+	return string(b)
+}
+
+func fieldKeyChar(c byte, first bool) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', c == '_':
+		return true
+	case '0' <= c && c <= '9', c == '.', c == '-':
+		return !first
+	}
+	return false
+}
+
+// appendFieldValue appends v in its text form without quoting.
+func appendFieldValue(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return b
+	case string:
+		return append(b, v...)
+	case []byte:
+		return append(b, v...)
+	case int:
+		return strconv.AppendInt(b, int64(v), 10)
+	case int32:
+		return strconv.AppendInt(b, int64(v), 10)
+	case int64:
+		return strconv.AppendInt(b, v, 10)
+	case uint:
+		return strconv.AppendUint(b, uint64(v), 10)
+	case uint32:
+		return strconv.AppendUint(b, uint64(v), 10)
+	case uint64:
+		return strconv.AppendUint(b, v, 10)
+	case float32:
+		return strconv.AppendFloat(b, float64(v), 'g', -1, 32)
+	case float64:
+		return strconv.AppendFloat(b, v, 'g', -1, 64)
+	case bool:
+		return strconv.AppendBool(b, v)
+	case time.Duration:
+		return append(b, v.String()...)
+	case error:
+		return append(b, v.Error()...)
+	case fmt.Stringer:
+		return append(b, v.String()...)
+	}
+	return fmt.Append(b, v)
+}
+
+// needsQuote reports whether a text field value must be quoted to be read
+// back.
+func needsQuote(s []byte) bool {
+	if len(s) == 0 {
+		return true
+	}
+	for _, c := range s {
+		if c <= ' ' || c == '"' || c == '=' || c == '\\' || c >= utf8.RuneSelf {
+			return true
+		}
+	}
+	return false
+}
+
+// appendTextFields appends the fields of rec as " key=value" pairs,
+// quoting values which contain spaces, quotes or equal signs.
+func appendTextFields(b []byte, rec *LogRecord) []byte {
+	for _, f := range rec.Fields {
+		b = append(b, ' ')
+		b = append(b, f.Key...)
+		b = append(b, '=')
+		start := len(b)
+		b = appendFieldValue(b, f.Value)
+		if needsQuote(b[start:]) {
+			v := string(b[start:])
+			b = strconv.AppendQuote(b[:start], v)
+		}
+	}
+	return b
+}
+
+// textFields matches the key=value pairs at the end of a text log line.
+var textFields = regexp.MustCompile(`(?: [A-Za-z_][A-Za-z0-9_.\-]*=(?:"(?:[^"\\]|\\.)*"|[^ "=\\]+))+$`)
+
+// splitFields separates the fields written by appendTextFields from the
+// rest of a log line.
+func splitFields(line string) (string, []Field) {
+	loc := textFields.FindStringIndex(line)
+	if loc == nil {
+		return line, nil
+	}
+	var fields []Field
+	rest := line[loc[0]:]
+	for rest != "" {
+		rest = rest[1:] // the space
+		eq := strings.IndexByte(rest, '=')
+		key := rest[:eq]
+		rest = rest[eq+1:]
+		var value string
+		if rest[0] == '"' {
+			quoted, err := strconv.QuotedPrefix(rest)
+			if err != nil {
+				return line, nil
+			}
+			value, _ = strconv.Unquote(quoted)
+			rest = rest[len(quoted):]
+		} else {
+			end := strings.IndexByte(rest, ' ')
+			if end == -1 {
+				end = len(rest)
+			}
+			value, rest = rest[:end], rest[end:]
+		}
+		fields = append(fields, Field{key, value})
+	}
+	return line[:loc[0]], fields
+}
+
+// jsonFieldValue encodes a field value. Errors, durations and values
+// which cannot be marshaled are written as text.
+func jsonFieldValue(v interface{}) []byte {
+	switch v.(type) {
+	case error, time.Duration:
+	default:
+		if b, err := json.Marshal(v); err == nil {
+			return b
+		}
+	}
+	b, _ := json.Marshal(string(appendFieldValue(nil, v)))
+	return b
+}
+
+// jsonFields adds the fields of rec to the JSON object obj. Fields named
+// like standard properties get a "field_" prefix.
+func jsonFields(obj []byte, rec *LogRecord) []byte {
+	if len(rec.Fields) == 0 {
+		return obj
+	}
+	obj = obj[:len(obj)-1]
+	for _, f := range rec.Fields {
+		key := f.Key
+		if jsonStandard[key] {
+			key = "field_" + key
+		}
+		k, _ := json.Marshal(key)
+		obj = append(obj, ',')
+		obj = append(obj, k...)
+		obj = append(obj, ':')
+		obj = append(obj, jsonFieldValue(f.Value)...)
+	}
+	return append(obj, '}')
+}
+
+// jsonStandard are the properties written by the JSON formatter.
+var jsonStandard = map[string]bool{
+	"time": true, "host": true, "vhost": true, "ident": true, "user": true,
+	"request": true, "status": true, "bytes": true, "referer": true,
+	"user_agent": true, "duration_ms": true, "request_id": true, "session": true,
+}
+
+// parseJSONFields returns the non-standard properties of a JSON log line
+// sorted by name, without the "field_" prefix added by jsonFields.
+func parseJSONFields(line string) []Field {
+	var props map[string]json.RawMessage
+	if json.Unmarshal([]byte(line), &props) != nil {
+		return nil
+	}
+	var fields []Field
+	for k, raw := range props {
+		if jsonStandard[k] {
+			continue
+		}
+		if name := strings.TrimPrefix(k, "field_"); jsonStandard[name] {
+			k = name
+		}
+		var v interface{}
+		json.Unmarshal(raw, &v)
+		fields = append(fields, Field{k, v})
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Key < fields[j].Key })
+	return fields
+}
@@ -0,0 +1,133 @@
+package webapp
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAddField(t *testing.T) {
+	app := NewApp(func(w http.ResponseWriter, r *http.Request) {
+		AddField(r, "user_id", 42)
+		AddField(r, "cart", "two items")
+		AddField(r, "user_id", 43)
+		AddField(r, "took", 1500*time.Millisecond)
+		AddField(r, "err", errors.New(`bad "input"`))
+		AddField(r, "ok", false)
+	}, false)
+	logs := make(chan *LogRecord, 1)
+	app.Loggers = append(app.Loggers, logs)
+	app.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	rec := <-logs
+	if len(rec.Fields) != 5 || rec.Field("user_id") != 43 || rec.Field("missing") != nil {
+		t.Errorf("fields %v, want user_id replaced by the second AddField", rec.Fields)
+	}
+
+	// outside an App AddField does nothing
+	AddField(httptest.NewRequest("GET", "/", nil), "user_id", 1)
+}
+
+func TestTextFields(t *testing.T) {
+	rec := formatRecord()
+	rec.Fields = []Field{
+		{"user_id", 43},
+		{"cart", "two items"},
+		{"took", 1500 * time.Millisecond},
+		{"err", errors.New(`bad "input"`)},
+		{"empty", ""},
+		{"ratio", 0.5},
+	}
+	const want = ` user_id=43 cart="two items" took=1.5s err="bad \"input\"" empty="" ratio=0.5`
+	for name, f := range map[string]Formatter{
+		"CombinedFormat": CombinedFormat,
+		"PerfFormat":     PerfFormat,
+		"ApacheFormat":   MustCompileFormat(`%h %>s`).Format,
+	} {
+		line := f(rec)
+		plain := *rec
+		plain.Fields = nil
+		if line != f(&plain)+want {
+			t.Errorf("%s = %q, want the fields %q appended", name, line, want)
+		}
+	}
+
+	for _, p := range []Parser{CombinedParser, PerfParser, AutoParser} {
+		var line string
+		if p == PerfParser {
+			line = PerfFormat(rec)
+		} else {
+			line = CombinedFormat(rec)
+		}
+		got, err := p.Parse(line)
+		if err != nil {
+			t.Fatalf("parse %q: %v", line, err)
+		}
+		if got.UserAgent != rec.UserAgent && p != PerfParser || len(got.Fields) != len(rec.Fields) {
+			t.Fatalf("parse %q = %+v", line, got)
+		}
+		for i, f := range got.Fields {
+			if want := string(appendFieldValue(nil, rec.Fields[i].Value)); f.Key != rec.Fields[i].Key || f.Value != want {
+				t.Errorf("field %d = %s=%v, want %s=%s", i, f.Key, f.Value, rec.Fields[i].Key, want)
+			}
+		}
+	}
+}
+
+func TestJSONFields(t *testing.T) {
+	rec := formatRecord()
+	rec.Fields = []Field{
+		{"user_id", 43},
+		{"took", 1500 * time.Millisecond},
+		{"status", "shadowed"},
+		{"tags", []string{"a", "b"}},
+	}
+	line := JSONFormat(rec)
+	got, err := ParseJSON(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != 200 {
+		t.Errorf("status %d, want the standard property kept", got.Status)
+	}
+	want := map[string]interface{}{"user_id": 43.0, "took": "1.5s", "status": "shadowed"}
+	if len(got.Fields) != 4 {
+		t.Fatalf("fields parsed from %s = %v", line, got.Fields)
+	}
+	for _, f := range got.Fields {
+		if w, ok := want[f.Key]; ok && f.Value != w {
+			t.Errorf("field %s = %#v, want %#v", f.Key, f.Value, w)
+		}
+	}
+	if tags, ok := got.Field("tags").([]interface{}); !ok || len(tags) != 2 {
+		t.Errorf("tags = %#v", got.Field("tags"))
+	}
+}
+
+func TestAddFieldKeys(t *testing.T) {
+	for key, want := range map[string]string{
+		"user_id":    "user_id",
+		"user id":    "user_id",
+		"cart.total": "cart.total",
+		"2fa":        "_fa",
+		"naïve":      "na__ve",
+		`a"b=c`:      "a_b_c",
+		"":           "_",
+	} {
+		app := NewApp(func(w http.ResponseWriter, r *http.Request) {
+			AddField(r, key, "v")
+		}, false)
+		logged := make(chan *LogRecord, 1)
+		app.Loggers = append(app.Loggers, logged)
+		app.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		rec := <-logged
+		if got := rec.Fields[0].Key; got != want {
+			t.Errorf("AddField(%q) key = %q, want %q", key, got, want)
+		}
+		line := CombinedFormat(rec)
+		if _, fields := splitFields(line); len(fields) != 1 || fields[0].Key != want {
+			t.Errorf("fields parsed from %q = %v", line, fields)
+		}
+	}
+}
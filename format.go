@@ -0,0 +1,241 @@
+package webapp
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type Formatter func(*LogRecord) string
+
+// FormatOptions control how formatters write timestamps. Times are
+// converted to Location, e.g. time.UTC, if it is set, and written as
+// reported by the App Clock otherwise, which is local time for the
+// SystemClock. Precision is the resolution of timestamps, rounded down to
+// seconds, milliseconds, microseconds or nanoseconds; zero means seconds
+// for Apache-style formats and milliseconds for JSON.
+type FormatOptions struct {
+	Location  *time.Location
+	Precision time.Duration
+}
+
+// fraction returns the layout of fractional seconds for the precision.
+func (o FormatOptions) fraction(def string) string {
+	switch p := o.Precision; {
+	case p == 0:
+		return def
+	case p >= time.Second:
+		return ""
+	case p >= time.Millisecond:
+		return ".000"
+	case p >= time.Microsecond:
+		return ".000000"
+	}
+	return ".000000000"
+}
+
+func (o FormatOptions) time(t time.Time) time.Time {
+	if o.Location != nil {
+		return t.In(o.Location)
+	}
+	return t
+}
+
+// Timestamp formats t like ApacheTime, with fractional seconds if required
+// by the precision.
+func (o FormatOptions) Timestamp(t time.Time) string {
+	return o.time(t).Format("02/Jan/2006:15:04:05" + o.fraction("") + " -0700")
+}
+
+// RFC3339 formats t for JSON formats.
+func (o FormatOptions) RFC3339(t time.Time) string {
+	return o.time(t).Format("2006-01-02T15:04:05" + o.fraction(".000") + "Z07:00")
+}
+
+// AppendRFC3339 appends t formatted as by RFC3339 to dst.
+func (o FormatOptions) AppendRFC3339(dst []byte, t time.Time) []byte {
+	switch o.fraction(".000") {
+	case "":
+		return o.time(t).AppendFormat(dst, "2006-01-02T15:04:05Z07:00")
+	case ".000":
+		return o.time(t).AppendFormat(dst, "2006-01-02T15:04:05.000Z07:00")
+	case ".000000":
+		return o.time(t).AppendFormat(dst, "2006-01-02T15:04:05.000000Z07:00")
+	}
+	return o.time(t).AppendFormat(dst, "2006-01-02T15:04:05.000000000Z07:00")
+}
+
+func duration(rec *LogRecord) time.Duration {
+	return rec.RequestCompleted.Sub(rec.RequestStarted)
+}
+
+// AppendFormatter appends a formatted record to dst and returns the
+// extended buffer, like the Append functions of strconv. It must not keep
+// dst or rec.
+type AppendFormatter func(dst []byte, rec *LogRecord) []byte
+
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 512)
+		return &b
+	},
+}
+
+// Formatter returns a Formatter calling f with a pooled buffer.
+func (f AppendFormatter) Formatter() Formatter {
+	return func(rec *LogRecord) string {
+		bp := bufPool.Get().(*[]byte)
+		b := f((*bp)[:0], rec)
+		s := string(b)
+		*bp = b
+		bufPool.Put(bp)
+		return s
+	}
+}
+
+// AppendTimestamp appends t formatted as by Timestamp to dst.
+func (o FormatOptions) AppendTimestamp(dst []byte, t time.Time) []byte {
+	switch o.fraction("") {
+	case "":
+		return o.time(t).AppendFormat(dst, "02/Jan/2006:15:04:05 -0700")
+	case ".000":
+		return o.time(t).AppendFormat(dst, "02/Jan/2006:15:04:05.000 -0700")
+	case ".000000":
+		return o.time(t).AppendFormat(dst, "02/Jan/2006:15:04:05.000000 -0700")
+	}
+	return o.time(t).AppendFormat(dst, "02/Jan/2006:15:04:05.000000000 -0700")
+}
+
+// appendCommon appends the fields shared by Combined and Perf formats.
+func (o FormatOptions) appendCommon(b []byte, rec *LogRecord) []byte {
+	b = append(b, rec.Host...)
+	b = append(b, ' ')
+	b = append(b, rec.Indent...)
+	b = append(b, ' ')
+	b = appendEscaped(b, rec.User)
+	b = append(b, " ["...)
+	b = o.AppendTimestamp(b, rec.RequestStarted)
+	b = append(b, "] \""...)
+	b = appendEscaped(b, rec.Request)
+	b = append(b, "\" "...)
+	b = strconv.AppendInt(b, int64(rec.Status), 10)
+	b = append(b, ' ')
+	return strconv.AppendUint(b, rec.Bytes, 10)
+}
+
+func (o FormatOptions) AppendCombined() AppendFormatter {
+	return func(b []byte, rec *LogRecord) []byte {
+		b = o.appendCommon(b, rec)
+		b = append(b, " \""...)
+		b = appendEscaped(b, rec.Referer)
+		b = append(b, "\" \""...)
+		b = appendEscaped(b, rec.UserAgent)
+		b = append(b, '"')
+		return appendTextFields(b, rec)
+	}
+}
+
+func (o FormatOptions) AppendPerf() AppendFormatter {
+	return func(b []byte, rec *LogRecord) []byte {
+		b = o.appendCommon(b, rec)
+		b = append(b, ' ')
+		b = strconv.AppendInt(b, duration(rec).Nanoseconds()/1e6, 10)
+		b = append(b, "ms"...)
+		return appendTextFields(b, rec)
+	}
+}
+
+// AppendVHostCombined is AppendCombined prefixed with the virtual host,
+// like the vhost_combined format of Apache.
+func (o FormatOptions) AppendVHostCombined() AppendFormatter {
+	combined := o.AppendCombined()
+	return func(b []byte, rec *LogRecord) []byte {
+		b = append(b, dash(rec.VirtualHost)...)
+		b = append(b, ' ')
+		return combined(b, rec)
+	}
+}
+
+func (o FormatOptions) Combined() Formatter {
+	return o.AppendCombined().Formatter()
+}
+
+func (o FormatOptions) Perf() Formatter {
+	return o.AppendPerf().Formatter()
+}
+
+func (o FormatOptions) VHostCombined() Formatter {
+	return o.AppendVHostCombined().Formatter()
+}
+
+type jsonRecord struct {
+	Time       string  `json:"time"`
+	Host       string  `json:"host"`
+	VHost      string  `json:"vhost,omitempty"`
+	Ident      string  `json:"ident"`
+	User       string  `json:"user"`
+	Request    string  `json:"request"`
+	Status     int     `json:"status"`
+	Bytes      uint64  `json:"bytes"`
+	Referer    string  `json:"referer"`
+	UserAgent  string  `json:"user_agent"`
+	DurationMS float64 `json:"duration_ms"`
+	RequestID  string  `json:"request_id,omitempty"`
+	Session    string  `json:"session,omitempty"`
+}
+
+// JSON returns a formatter writing records as single-line JSON objects.
+func (o FormatOptions) JSON() Formatter {
+	return func(rec *LogRecord) string {
+		j := jsonRecord{
+			Time:       o.RFC3339(rec.RequestStarted),
+			Host:       rec.Host,
+			VHost:      rec.VirtualHost,
+			Ident:      rec.Indent,
+			User:       rec.User,
+			Request:    rec.Request,
+			Status:     rec.Status,
+			Bytes:      rec.Bytes,
+			Referer:    rec.Referer,
+			UserAgent:  rec.UserAgent,
+			DurationMS: float64(duration(rec)) / float64(time.Millisecond),
+			RequestID:  rec.RequestID,
+		}
+		if rec.Session != "-" {
+			j.Session = rec.Session
+		}
+		b, _ := json.Marshal(&j)
+		return string(jsonFields(b, rec))
+	}
+}
+
+var (
+	// AppendCombinedFormat and AppendPerfFormat are the allocation free
+	// versions of CombinedFormat and PerfFormat, see AddAppendLogger.
+	AppendCombinedFormat = FormatOptions{}.AppendCombined()
+	AppendPerfFormat     = FormatOptions{}.AppendPerf()
+
+	AppendVHostCombinedFormat = FormatOptions{}.AppendVHostCombined()
+
+	combinedFormat = FormatOptions{}.Combined()
+	perfFormat     = FormatOptions{}.Perf()
+	vhostFormat    = FormatOptions{}.VHostCombined()
+	jsonFormat     = FormatOptions{}.JSON()
+)
+
+func CombinedFormat(rec *LogRecord) string {
+	return combinedFormat(rec)
+}
+
+func PerfFormat(rec *LogRecord) string {
+	return perfFormat(rec)
+}
+
+func VHostCombinedFormat(rec *LogRecord) string {
+	return vhostFormat(rec)
+}
+
+func JSONFormat(rec *LogRecord) string {
+	return jsonFormat(rec)
+}
@@ -0,0 +1,91 @@
+package webapp
+
+import (
+	"testing"
+	"time"
+)
+
+func formatRecord() *LogRecord {
+	started := time.Date(2013, time.January, 2, 15, 4, 5, 123456789, time.FixedZone("", 3600))
+	return &LogRecord{
+		Host:             "192.0.2.1",
+		Indent:           "-",
+		User:             "frank",
+		RequestStarted:   started,
+		RequestCompleted: started.Add(42 * time.Millisecond),
+		Request:          "GET /index.html HTTP/1.1",
+		Status:           200,
+		Bytes:            1234,
+		Referer:          "http://example.com/",
+		UserAgent:        "Mozilla/5.0",
+		Session:          "-",
+		RequestID:        "req-1",
+	}
+}
+
+func TestFormats(t *testing.T) {
+	rec := formatRecord()
+	for _, tc := range []struct {
+		name string
+		f    Formatter
+		want string
+	}{
+		{"CombinedFormat", CombinedFormat, `192.0.2.1 - frank [02/Jan/2013:15:04:05 +0100] "GET /index.html HTTP/1.1" 200 1234 "http://example.com/" "Mozilla/5.0"`},
+		{"PerfFormat", PerfFormat, `192.0.2.1 - frank [02/Jan/2013:15:04:05 +0100] "GET /index.html HTTP/1.1" 200 1234 42ms`},
+		{"JSONFormat", JSONFormat, `{"time":"2013-01-02T15:04:05.123+01:00","host":"192.0.2.1","ident":"-","user":"frank","request":"GET /index.html HTTP/1.1","status":200,"bytes":1234,"referer":"http://example.com/","user_agent":"Mozilla/5.0","duration_ms":42,"request_id":"req-1"}`},
+		{"UTC milliseconds", FormatOptions{Location: time.UTC, Precision: time.Millisecond}.Combined(), `192.0.2.1 - frank [02/Jan/2013:14:04:05.123 +0000] "GET /index.html HTTP/1.1" 200 1234 "http://example.com/" "Mozilla/5.0"`},
+		{"JSON seconds", FormatOptions{Precision: time.Second}.JSON(), `{"time":"2013-01-02T15:04:05+01:00","host":"192.0.2.1","ident":"-","user":"frank","request":"GET /index.html HTTP/1.1","status":200,"bytes":1234,"referer":"http://example.com/","user_agent":"Mozilla/5.0","duration_ms":42,"request_id":"req-1"}`},
+	} {
+		if got := tc.f(rec); got != tc.want {
+			t.Errorf("%s =\n%s\nwant\n%s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestFormatOptionsPrecision(t *testing.T) {
+	ts := time.Date(2013, time.January, 2, 15, 4, 5, 123456789, time.UTC)
+	for _, tc := range []struct {
+		precision time.Duration
+		apache    string
+		rfc3339   string
+	}{
+		{0, "02/Jan/2013:15:04:05 +0000", "2013-01-02T15:04:05.123Z"},
+		{time.Second, "02/Jan/2013:15:04:05 +0000", "2013-01-02T15:04:05Z"},
+		{time.Millisecond, "02/Jan/2013:15:04:05.123 +0000", "2013-01-02T15:04:05.123Z"},
+		{time.Microsecond, "02/Jan/2013:15:04:05.123456 +0000", "2013-01-02T15:04:05.123456Z"},
+		{time.Nanosecond, "02/Jan/2013:15:04:05.123456789 +0000", "2013-01-02T15:04:05.123456789Z"},
+	} {
+		o := FormatOptions{Precision: tc.precision}
+		if got := o.Timestamp(ts); got != tc.apache {
+			t.Errorf("Timestamp with precision %v = %s, want %s", tc.precision, got, tc.apache)
+		}
+		if got := o.RFC3339(ts); got != tc.rfc3339 {
+			t.Errorf("RFC3339 with precision %v = %s, want %s", tc.precision, got, tc.rfc3339)
+		}
+		if got := string(o.AppendTimestamp([]byte("t="), ts)); got != "t="+tc.apache {
+			t.Errorf("AppendTimestamp with precision %v = %s, want t=%s", tc.precision, got, tc.apache)
+		}
+	}
+}
+
+func TestAppendFormats(t *testing.T) {
+	rec := formatRecord()
+	o := FormatOptions{Location: time.UTC, Precision: time.Millisecond}
+	for _, tc := range []struct {
+		name string
+		f    AppendFormatter
+		want Formatter
+	}{
+		{"AppendCombinedFormat", AppendCombinedFormat, CombinedFormat},
+		{"AppendPerfFormat", AppendPerfFormat, PerfFormat},
+		{"AppendCombined with options", o.AppendCombined(), o.Combined()},
+	} {
+		// appends to what dst already holds
+		if got, want := string(tc.f([]byte("> "), rec)), "> "+tc.want(rec); got != want {
+			t.Errorf("%s =\n%s\nwant\n%s", tc.name, got, want)
+		}
+		if got, want := tc.f.Formatter()(rec), tc.want(rec); got != want {
+			t.Errorf("%s.Formatter() =\n%s\nwant\n%s", tc.name, got, want)
+		}
+	}
+}
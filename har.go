@@ -0,0 +1,281 @@
+package webapp
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HAR 1.2 structures, see http://www.softwareishard.com/blog/har-12-spec/.
+
+type harLog struct {
+	Log struct {
+		Version string `json:"version"`
+		Creator struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"creator"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	out := []harNameValue{}
+	for _, name := range sortedKeys(h) {
+		for _, v := range h[name] {
+			out = append(out, harNameValue{name, v})
+		}
+	}
+	return out
+}
+
+func sortedKeys(h http.Header) []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeHAR(w io.Writer, entries []harEntry) error {
+	var doc harLog
+	doc.Log.Version = "1.2"
+	doc.Log.Creator.Name = "go-webapp"
+	doc.Log.Creator.Version = "1"
+	doc.Log.Entries = entries
+	if entries == nil {
+		doc.Log.Entries = []harEntry{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&doc)
+}
+
+func setHARHeaders(w http.ResponseWriter, filename string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+func harQuery(rawQuery string) []harNameValue {
+	out := []harNameValue{}
+	q, _ := url.ParseQuery(rawQuery)
+	for _, name := range sortedKeys(http.Header(q)) {
+		for _, v := range q[name] {
+			out = append(out, harNameValue{name, v})
+		}
+	}
+	return out
+}
+
+// harURL returns the absolute URL of rec: the one recorded by App.Capture,
+// or else one made of VirtualHost and the request line, taking the scheme,
+// which is not logged, to be http. Parameters listed in redact are
+// redacted.
+func harURL(rec *LogRecord, path, query string, redact []string) string {
+	if rec.capture != nil && rec.capture.entry.URL != "" {
+		return redactURL(rec.capture.entry.URL, redact)
+	}
+	host := rec.VirtualHost
+	if host == "" {
+		host = "localhost"
+	}
+	return redactURL("http://"+host+path+query, redact)
+}
+
+// recordHAR converts rec to a HAR entry. The request headers known to
+// LogRecord are always included; full headers are used when rec was
+// recorded by App.Capture.
+func recordHAR(rec *LogRecord, redact []string) harEntry {
+	ms := -1.0
+	if !rec.RequestCompleted.IsZero() {
+		ms = float64(rec.RequestCompleted.Sub(rec.RequestStarted)) / float64(time.Millisecond)
+	}
+	method, path, query, proto := requestParts(rec.Request)
+	reqURL := harURL(rec, path, query, redact)
+	if u, err := url.Parse(reqURL); err == nil {
+		query = u.RawQuery
+	}
+	reqHeader := http.Header{}
+	respHeader := http.Header{}
+	if rec.capture != nil {
+		reqHeader = rec.capture.entry.RequestHeader
+		if h := rec.capture.entry.ResponseHeader; h != nil {
+			respHeader = h
+		}
+	} else {
+		if rec.Referer != "" {
+			reqHeader.Set("Referer", rec.Referer)
+		}
+		if rec.UserAgent != "" {
+			reqHeader.Set("User-Agent", rec.UserAgent)
+		}
+	}
+	if rec.RequestID != "" {
+		respHeader = respHeader.Clone()
+		respHeader.Set("X-Request-Id", rec.RequestID)
+	}
+	he := harEntry{
+		StartedDateTime: rec.RequestStarted.Format(time.RFC3339Nano),
+		Time:            ms,
+		Timings:         harTimings{Wait: ms},
+		Request: harRequest{
+			Method:      method,
+			URL:         reqURL,
+			HTTPVersion: proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(reqHeader),
+			QueryString: harQuery(query),
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Response: harResponse{
+			Status:      rec.Status,
+			StatusText:  http.StatusText(rec.Status),
+			HTTPVersion: proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(respHeader),
+			Content:     harContent{Size: int64(rec.Bytes), MimeType: respHeader.Get("Content-Type")},
+			RedirectURL: respHeader.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    int64(rec.Bytes),
+		},
+	}
+	if rec.User != "" && rec.User != "-" {
+		he.Comment = "user " + rec.User
+	}
+	return he
+}
+
+// WriteHAR writes recs to w as a HAR 1.2 archive, reusing the timings of
+// the records and redacting DefaultRedactParams from their URLs.
+func WriteHAR(w io.Writer, recs []*LogRecord) error {
+	entries := make([]harEntry, len(recs))
+	for i, rec := range recs {
+		entries[i] = recordHAR(rec, DefaultRedactParams)
+	}
+	return writeHAR(w, entries)
+}
+
+// HARLog keeps the last requests of an App as HAR entries, see
+// App.AddHARLog. Query parameters listed in RedactParams are redacted
+// from the URLs.
+type HARLog struct {
+	RedactParams []string
+
+	mu      sync.Mutex
+	size    int
+	entries []harEntry
+	next    int
+}
+
+// AddHARLog keeps the last size requests of app for download from the
+// HARLog handler.
+func (app *App) AddHARLog(size int) *HARLog {
+	hl := &HARLog{size: size, RedactParams: DefaultRedactParams}
+	ch := make(chan *LogRecord, 1000)
+	app.Loggers = append(app.Loggers, ch)
+	app.serveRecords(ch, func(rec *LogRecord) {
+		hl.Add(rec)
+		rec.Release()
+	})
+	return hl
+}
+
+// Add converts rec to a HAR entry and appends it, dropping the oldest
+// entry when the log is full.
+func (hl *HARLog) Add(rec *LogRecord) {
+	he := recordHAR(rec, hl.RedactParams)
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+	if hl.size <= 0 {
+		return
+	}
+	if len(hl.entries) < hl.size {
+		hl.entries = append(hl.entries, he)
+		return
+	}
+	hl.entries[hl.next] = he
+	hl.next = (hl.next + 1) % len(hl.entries)
+}
+
+// WriteHAR writes the logged requests to w, oldest first.
+func (hl *HARLog) WriteHAR(w io.Writer) error {
+	hl.mu.Lock()
+	entries := make([]harEntry, 0, len(hl.entries))
+	entries = append(entries, hl.entries[hl.next:]...)
+	entries = append(entries, hl.entries[:hl.next]...)
+	hl.mu.Unlock()
+	return writeHAR(w, entries)
+}
+
+// ServeHTTP serves the logged requests as a HAR download. It should only
+// be mounted behind authentication.
+func (hl *HARLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	setHARHeaders(w, "requests.har")
+	hl.WriteHAR(w)
+}
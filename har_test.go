@@ -0,0 +1,121 @@
+package webapp
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteHAR(t *testing.T) {
+	rec := formatRecord()
+	rec.Request = "GET /search?q=tea&page=2 HTTP/1.1"
+	var b bytes.Buffer
+	if err := WriteHAR(&b, []*LogRecord{rec}); err != nil {
+		t.Fatal(err)
+	}
+	var doc harLog
+	if err := json.Unmarshal(b.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Log.Entries) != 1 {
+		t.Fatalf("%d entries", len(doc.Log.Entries))
+	}
+	he := doc.Log.Entries[0]
+	if he.Time != 42 || he.Timings.Wait != 42 || he.StartedDateTime != rec.RequestStarted.Format(time.RFC3339Nano) {
+		t.Errorf("timings %v %+v, started %s, want the 42ms of the record", he.Time, he.Timings, he.StartedDateTime)
+	}
+	req := he.Request
+	if req.Method != "GET" || req.URL != "http://localhost/search?q=tea&page=2" || req.HTTPVersion != "HTTP/1.1" || len(req.QueryString) != 2 {
+		t.Errorf("request %+v", req)
+	}
+	if len(req.Headers) != 2 || req.Headers[0] != (harNameValue{"Referer", rec.Referer}) || req.Headers[1] != (harNameValue{"User-Agent", rec.UserAgent}) {
+		t.Errorf("request headers %v, want those of the record", req.Headers)
+	}
+	resp := he.Response
+	if resp.Status != 200 || resp.BodySize != 1234 || resp.Headers[0] != (harNameValue{"X-Request-Id", "req-1"}) {
+		t.Errorf("response %+v", resp)
+	}
+	if he.Comment != "user frank" {
+		t.Errorf("comment %q", he.Comment)
+	}
+
+	// records without a completion time have unknown timings
+	rec.RequestCompleted = time.Time{}
+	if he := recordHAR(rec, nil); he.Time != -1 {
+		t.Errorf("time of an incomplete record = %v, want -1", he.Time)
+	}
+}
+
+func TestHARLog(t *testing.T) {
+	hl := &HARLog{size: 2}
+	for _, path := range []string{"/a", "/b", "/c"} {
+		rec := formatRecord()
+		rec.Request = "GET " + path + " HTTP/1.1"
+		hl.Add(rec)
+	}
+	w := httptest.NewRecorder()
+	hl.ServeHTTP(w, httptest.NewRequest("GET", "/debug/requests.har", nil))
+	if w.Header().Get("Content-Disposition") != `attachment; filename="requests.har"` {
+		t.Errorf("headers %v", w.Header())
+	}
+	var doc harLog
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if e := doc.Log.Entries; len(e) != 2 || e[0].Request.URL != "http://localhost/b" || e[1].Request.URL != "http://localhost/c" {
+		t.Errorf("entries %+v, want /b and /c", e)
+	}
+}
+
+func TestAddHARLog(t *testing.T) {
+	app := NewApp(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("ok"))
+	}, false)
+	app.Capture = NewCapture(0)
+	app.Capture.Filter = func(*http.Request, *LogRecord) bool { return true }
+	hl := app.AddHARLog(10)
+	r := httptest.NewRequest("GET", "/x", nil)
+	r.Header.Set("Accept", "text/plain")
+	app.ServeHTTP(httptest.NewRecorder(), r)
+
+	var doc harLog
+	deadline := time.Now().Add(time.Second)
+	for len(doc.Log.Entries) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+		var b bytes.Buffer
+		hl.WriteHAR(&b)
+		json.Unmarshal(b.Bytes(), &doc)
+	}
+	if len(doc.Log.Entries) != 1 {
+		t.Fatalf("HARLog has %d entries, want 1", len(doc.Log.Entries))
+	}
+	// full headers are taken from the capture
+	he := doc.Log.Entries[0]
+	if he.Response.Content.MimeType != "text/plain" || len(he.Request.Headers) != 1 || he.Request.Headers[0].Name != "Accept" {
+		t.Errorf("entry %+v, want the captured headers", he)
+	}
+}
+
+func TestRecordHARURL(t *testing.T) {
+	rec := benchRecord()
+	rec.VirtualHost = "shop.example.com"
+	rec.Request = "GET /items?access_token=abc123&page=2 HTTP/1.1"
+	he := recordHAR(rec, DefaultRedactParams)
+	if want := "http://shop.example.com/items?access_token=" + url.QueryEscape(redacted) + "&page=2"; he.Request.URL != want {
+		t.Errorf("URL = %q, want %q", he.Request.URL, want)
+	}
+	for _, nv := range he.Request.QueryString {
+		if strings.Contains(nv.Value, "abc123") {
+			t.Errorf("queryString leaks %s=%s", nv.Name, nv.Value)
+		}
+	}
+	if len(he.Request.QueryString) != 2 {
+		t.Errorf("queryString = %v, want access_token and page", he.Request.QueryString)
+	}
+}
@@ -0,0 +1,287 @@
+package webapp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthCheck reports a problem by returning an error. It should give up
+// when ctx is done.
+type HealthCheck func(ctx context.Context) error
+
+var errCheckTimeout = errors.New("check timed out")
+
+type healthCheck struct {
+	name    string
+	fn      HealthCheck
+	timeout time.Duration
+
+	mu      sync.Mutex
+	result  CheckResult
+	checked time.Time
+}
+
+// CheckResult is the outcome of a single health check.
+type CheckResult struct {
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS float64   `json:"duration_ms"`
+	CheckedAt  time.Time `json:"checked_at"`
+}
+
+// HealthReport is the JSON body of health endpoint responses.
+type HealthReport struct {
+	Status       string                 `json:"status"`
+	ShuttingDown bool                   `json:"shutting_down,omitempty"`
+	Checks       map[string]CheckResult `json:"checks"`
+}
+
+// Health serves liveness and readiness endpoints for App. Checks run in
+// parallel, each with its own timeout, and their results are cached for
+// CacheTTL so that frequent probes do not overload dependencies.
+//
+// Readiness fails as soon as shutdown begins, see App.Shutdown and Watch.
+// Requests to the health endpoints are not sent to App loggers unless
+// LogRequests is set.
+type Health struct {
+	Clock       Clock
+	LivePaths   []string
+	ReadyPaths  []string
+	Timeout     time.Duration
+	CacheTTL    time.Duration
+	LogRequests bool
+
+	mu           sync.Mutex
+	live, ready  []*healthCheck
+	shuttingDown int32
+}
+
+func NewHealth() *Health {
+	return &Health{
+		LivePaths:  []string{"/healthz", "/livez"},
+		ReadyPaths: []string{"/readyz"},
+		Timeout:    5 * time.Second,
+		CacheTTL:   time.Second,
+	}
+}
+
+func (h *Health) newCheck(name string, timeout time.Duration, fn HealthCheck) *healthCheck {
+	if timeout <= 0 {
+		timeout = h.Timeout
+	}
+	return &healthCheck{name: name, fn: fn, timeout: timeout}
+}
+
+// AddLivenessCheck registers a check for the liveness endpoints. A zero
+// timeout means Health.Timeout.
+func (h *Health) AddLivenessCheck(name string, timeout time.Duration, fn HealthCheck) {
+	h.mu.Lock()
+	h.live = append(h.live, h.newCheck(name, timeout, fn))
+	h.mu.Unlock()
+}
+
+// AddReadinessCheck registers a check for the readiness endpoint.
+func (h *Health) AddReadinessCheck(name string, timeout time.Duration, fn HealthCheck) {
+	h.mu.Lock()
+	h.ready = append(h.ready, h.newCheck(name, timeout, fn))
+	h.mu.Unlock()
+}
+
+// clock returns h.Clock, or the Clock of the App serving r.
+func (h *Health) clock(r *http.Request) Clock {
+	if h.Clock != nil {
+		return h.Clock
+	}
+	if r != nil {
+		return requestClock(r)
+	}
+	return SystemClock
+}
+
+// SetShuttingDown makes readiness fail from now on.
+func (h *Health) SetShuttingDown() {
+	atomic.StoreInt32(&h.shuttingDown, 1)
+}
+
+func (h *Health) ShuttingDown() bool {
+	return atomic.LoadInt32(&h.shuttingDown) != 0
+}
+
+// Watch flips readiness to failing when srv.Shutdown is called.
+func (h *Health) Watch(srv *http.Server) {
+	srv.RegisterOnShutdown(h.SetShuttingDown)
+}
+
+func (c *healthCheck) run(ctx context.Context, ttl time.Duration, clock Clock) CheckResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := clock.Now()
+	if !c.checked.IsZero() && now.Sub(c.checked) < ttl {
+		return c.result
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if e := recover(); e != nil {
+				done <- errors.New("check panicked")
+			}
+		}()
+		done <- c.fn(ctx)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = errCheckTimeout
+	}
+	c.result = CheckResult{Status: "ok", CheckedAt: now,
+		DurationMS: float64(clock.Now().Sub(now)) / float64(time.Millisecond)}
+	if err != nil {
+		c.result.Status = "fail"
+		c.result.Error = err.Error()
+	}
+	c.checked = now
+	return c.result
+}
+
+func (h *Health) report(ctx context.Context, checks []*healthCheck, clock Clock) *HealthReport {
+	rep := &HealthReport{Status: "ok", Checks: make(map[string]CheckResult, len(checks))}
+	results := make([]CheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c *healthCheck) {
+			defer wg.Done()
+			results[i] = c.run(ctx, h.CacheTTL, clock)
+		}(i, c)
+	}
+	wg.Wait()
+	for i, c := range checks {
+		rep.Checks[c.name] = results[i]
+		if results[i].Status != "ok" {
+			rep.Status = "fail"
+		}
+	}
+	return rep
+}
+
+// Live runs the liveness checks.
+func (h *Health) Live(ctx context.Context) *HealthReport {
+	return h.liveReport(ctx, h.clock(nil))
+}
+
+// Ready runs the readiness checks.
+func (h *Health) Ready(ctx context.Context) *HealthReport {
+	return h.readyReport(ctx, h.clock(nil))
+}
+
+func (h *Health) liveReport(ctx context.Context, clock Clock) *HealthReport {
+	h.mu.Lock()
+	checks := h.live
+	h.mu.Unlock()
+	return h.report(ctx, checks, clock)
+}
+
+func (h *Health) readyReport(ctx context.Context, clock Clock) *HealthReport {
+	h.mu.Lock()
+	checks := h.ready
+	h.mu.Unlock()
+	rep := h.report(ctx, checks, clock)
+	if h.ShuttingDown() {
+		rep.Status = "fail"
+		rep.ShuttingDown = true
+	}
+	return rep
+}
+
+func writeReport(w http.ResponseWriter, rep *HealthReport) {
+	w.Header().Set("Cache-Control", "no-store")
+	status := http.StatusOK
+	if rep.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	WriteJSON(w, status, rep)
+}
+
+func (h *Health) LiveHandler(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, h.liveReport(r.Context(), h.clock(r)))
+}
+
+func (h *Health) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, h.readyReport(r.Context(), h.clock(r)))
+}
+
+// serve handles r if it is for one of the health endpoints.
+func (h *Health) serve(w http.ResponseWriter, r *http.Request) bool {
+	for _, p := range h.LivePaths {
+		if r.URL.Path == p {
+			h.LiveHandler(w, r)
+			return true
+		}
+	}
+	for _, p := range h.ReadyPaths {
+		if r.URL.Path == p {
+			h.ReadyHandler(w, r)
+			return true
+		}
+	}
+	return false
+}
+
+// Shutdown gracefully stops srv: readiness starts failing at once, then
+// after drain, to give load balancers time to notice, srv.Shutdown is
+// called. Once the server has stopped, Shutdown waits until the records
+// and events queued for the loggers, event handlers and dispatchers added
+// by App methods have been written, even if ctx is done, and then closes
+// what was passed to CloseOnShutdown. Channels appended to Loggers and
+// Events directly are not waited for. Closers with a Shutdown(ctx) method,
+// such as Alerter and SentryReporter, have it called instead of Close so
+// that they give up when ctx is done.
+func (app *App) Shutdown(ctx context.Context, srv *http.Server, drain time.Duration) error {
+	if app.Health != nil {
+		app.Health.SetShuttingDown()
+	}
+	select {
+	case <-time.After(drain):
+	case <-ctx.Done():
+	}
+	err := srv.Shutdown(ctx)
+	app.flush()
+	for _, c := range app.closers {
+		var cerr error
+		if s, ok := c.(shutdowner); ok {
+			cerr = s.Shutdown(ctx)
+		} else {
+			cerr = c.Close()
+		}
+		if err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+type shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// CloseOnShutdown makes Shutdown close c, typically a BufferedFile, after
+// the last request has been logged.
+func (app *App) CloseOnShutdown(c io.Closer) {
+	app.closers = append(app.closers, c)
+}
+
+// flush waits until the queues of app have been handled.
+func (app *App) flush() {
+	flushAll(app.flushes)
+	for _, d := range app.Dispatchers {
+		d.Flush()
+	}
+}
@@ -0,0 +1,186 @@
+package webapp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthChecks(t *testing.T) {
+	h := NewHealth()
+	h.AddLivenessCheck("ok", 0, func(ctx context.Context) error { return nil })
+	h.AddReadinessCheck("db", 0, func(ctx context.Context) error { return errors.New("connection refused") })
+	h.AddReadinessCheck("panics", 0, func(ctx context.Context) error { panic("oops") })
+
+	rep := h.Live(context.Background())
+	if rep.Status != "ok" || rep.Checks["ok"].Status != "ok" {
+		t.Errorf("Live = %+v", rep)
+	}
+	rep = h.Ready(context.Background())
+	if rep.Status != "fail" || rep.Checks["db"].Error != "connection refused" || rep.Checks["panics"].Error != "check panicked" {
+		t.Errorf("Ready = %+v", rep)
+	}
+}
+
+func TestHealthCheckTimeout(t *testing.T) {
+	h := NewHealth()
+	release := make(chan struct{})
+	defer close(release)
+	h.AddReadinessCheck("slow", 20*time.Millisecond, func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+	h.AddReadinessCheck("polite", 20*time.Millisecond, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	start := time.Now()
+	rep := h.Ready(context.Background())
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Ready took %v with 20ms check timeouts", d)
+	}
+	if c := rep.Checks["slow"]; c.Status != "fail" || c.Error != errCheckTimeout.Error() {
+		t.Errorf("check ignoring its context = %+v, want a timeout", c)
+	}
+	if c := rep.Checks["polite"]; c.Status != "fail" {
+		t.Errorf("check giving up on its context = %+v, want a failure", c)
+	}
+}
+
+func TestHealthCacheTTL(t *testing.T) {
+	h := NewHealth()
+	h.CacheTTL = time.Hour
+	var calls int32
+	h.AddLivenessCheck("counted", 0, func(ctx context.Context) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	})
+	first := h.Live(context.Background())
+	second := h.Live(context.Background())
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("check ran %d times within CacheTTL, want once", n)
+	}
+	if !first.Checks["counted"].CheckedAt.Equal(second.Checks["counted"].CheckedAt) {
+		t.Errorf("cached result has a new CheckedAt")
+	}
+	h.CacheTTL = 0
+	h.Live(context.Background())
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("check ran %d times without CacheTTL, want twice", n)
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	logs := make(chan *LogRecord, 10)
+	app := NewApp(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("app"))
+	}, false)
+	app.Loggers = append(app.Loggers, logs)
+	app.Health = NewHealth()
+	app.Health.AddReadinessCheck("db", 0, func(ctx context.Context) error { return nil })
+
+	get := func(path string) (*httptest.ResponseRecorder, *HealthReport) {
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		var rep HealthReport
+		json.Unmarshal(w.Body.Bytes(), &rep)
+		return w, &rep
+	}
+	for _, path := range []string{"/healthz", "/livez", "/readyz"} {
+		w, rep := get(path)
+		if w.Code != 200 || rep.Status != "ok" || w.Header().Get("Cache-Control") != "no-store" {
+			t.Errorf("GET %s = %d %+v", path, w.Code, rep)
+		}
+	}
+	if w, _ := get("/other"); w.Body.String() != "app" {
+		t.Errorf("GET /other = %q, want the app handler", w.Body)
+	}
+	if n := len(logs); n != 1 {
+		t.Errorf("%d requests logged, want only the one to the app handler", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := app.Shutdown(ctx, &http.Server{}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	w, rep := get("/readyz")
+	if w.Code != http.StatusServiceUnavailable || rep.Status != "fail" || !rep.ShuttingDown {
+		t.Errorf("GET /readyz after Shutdown = %d %+v", w.Code, rep)
+	}
+	if w, _ := get("/healthz"); w.Code != 200 {
+		t.Errorf("GET /healthz after Shutdown = %d, want liveness unaffected", w.Code)
+	}
+}
+
+func TestHealthWatch(t *testing.T) {
+	h := NewHealth()
+	srv := &http.Server{}
+	h.Watch(srv)
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// RegisterOnShutdown functions run in their own goroutine
+	deadline := time.Now().Add(time.Second)
+	for !h.ShuttingDown() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if rep := h.Ready(context.Background()); rep.Status != "fail" {
+		t.Errorf("Ready after srv.Shutdown = %+v", rep)
+	}
+}
+
+// slowWriter lets writes through one at a time on release, so that
+// records are still queued when Shutdown starts.
+type slowWriter struct {
+	release chan struct{}
+	buf     bytes.Buffer
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return w.buf.Write(p)
+}
+
+func TestShutdownWritesQueuedRecords(t *testing.T) {
+	const n = 50
+	dir := t.TempDir()
+	app := NewApp(benchHandler, false)
+	logger, bf, err := BufferedFileLogger(filepath.Join(dir, "access.log"), BufferOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.AddLogger(CombinedFormat, logger)
+	app.CloseOnShutdown(bf)
+	slow := &slowWriter{release: make(chan struct{})}
+	app.AddShardedLogger(AppendCombinedFormat, slow, 2)
+	for i := 0; i < n; i++ {
+		app.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	go close(slow.release)
+
+	// a done context must not cut the wait for queued records short
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := app.Shutdown(ctx, &http.Server{}, 0); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "access.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bytes.Count(data, []byte("\n")); got != n {
+		t.Errorf("%d lines in the log file, want %d", got, n)
+	}
+	if got := bytes.Count(slow.buf.Bytes(), []byte("\n")); got != n {
+		t.Errorf("%d lines written by the sharded logger, want %d", got, n)
+	}
+}
@@ -0,0 +1,152 @@
+package webapp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// DefaultMaxJSONBody is the request body limit used by DecodeJSON.
+const DefaultMaxJSONBody = 1 << 20
+
+// APIError is an error reported to API clients in a JSON envelope:
+//
+//	{"error": {"status": 400, "code": "invalid_json", "message": "...", "request_id": "..."}}
+type APIError struct {
+	Status    int         `json:"status"`
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Field     string      `json:"field,omitempty"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("%s: %s (field %s)", e.Code, e.Message, e.Field)
+	}
+	return e.Code + ": " + e.Message
+}
+
+// FieldError is a validation error about a single field.
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// Validator is implemented by request types checking their contents after
+// they are decoded by DecodeJSON.
+type Validator interface {
+	Validate() error
+}
+
+// DecodeJSON decodes the body of r into v with DefaultMaxJSONBody limit.
+func DecodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	return DecodeJSONLimit(w, r, v, DefaultMaxJSONBody)
+}
+
+// DecodeJSONLimit decodes a single JSON value from the body of r into v,
+// rejecting unknown fields, trailing data and bodies larger than limit,
+// and then runs v.Validate if v is a Validator. Errors are returned as
+// *APIError ready to be passed to WriteError.
+func DecodeJSONLimit(w http.ResponseWriter, r *http.Request, v interface{}, limit int64) error {
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		if mt, _, _ := mime.ParseMediaType(ct); mt != "application/json" {
+			return &APIError{Status: http.StatusUnsupportedMediaType, Code: "unsupported_media_type",
+				Message: "content type must be application/json"}
+		}
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return decodeError(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return &APIError{Status: http.StatusBadRequest, Code: "invalid_json",
+			Message: "body must contain a single JSON value"}
+	}
+	if val, ok := v.(Validator); ok {
+		if err := val.Validate(); err != nil {
+			return validationError(err)
+		}
+	}
+	return nil
+}
+
+func decodeError(err error) *APIError {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var sizeErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return &APIError{Status: http.StatusBadRequest, Code: "invalid_json",
+			Message: fmt.Sprintf("malformed JSON at offset %d", syntaxErr.Offset)}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &APIError{Status: http.StatusBadRequest, Code: "invalid_json", Message: "malformed JSON"}
+	case errors.As(err, &typeErr):
+		return &APIError{Status: http.StatusBadRequest, Code: "invalid_field", Field: typeErr.Field,
+			Message: fmt.Sprintf("expected %s, got %s", typeErr.Type, typeErr.Value)}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		return &APIError{Status: http.StatusBadRequest, Code: "unknown_field", Field: field, Message: "unknown field"}
+	case errors.Is(err, io.EOF):
+		return &APIError{Status: http.StatusBadRequest, Code: "empty_body", Message: "request body is empty"}
+	case errors.As(err, &sizeErr):
+		return &APIError{Status: http.StatusRequestEntityTooLarge, Code: "body_too_large",
+			Message: fmt.Sprintf("request body exceeds %d bytes", sizeErr.Limit)}
+	}
+	return &APIError{Status: http.StatusBadRequest, Code: "invalid_json", Message: err.Error()}
+}
+
+func validationError(err error) *APIError {
+	var apiErr *APIError
+	var fieldErr *FieldError
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr
+	case errors.As(err, &fieldErr):
+		return &APIError{Status: http.StatusUnprocessableEntity, Code: "validation_failed",
+			Field: fieldErr.Field, Message: fieldErr.Message}
+	}
+	return &APIError{Status: http.StatusUnprocessableEntity, Code: "validation_failed", Message: err.Error()}
+}
+
+// WriteJSON writes v as a JSON response with the given status.
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// WriteError writes err as a JSON error envelope. Errors other than
+// *APIError are reported as 500 without revealing their text. The request
+// ID is taken from the request LogRecord.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) error {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		apiErr = &APIError{Status: http.StatusInternalServerError, Code: "internal_error",
+			Message: http.StatusText(http.StatusInternalServerError)}
+	}
+	if rec := Record(r); rec != nil && apiErr.RequestID == "" {
+		e := *apiErr
+		e.RequestID = rec.RequestID
+		apiErr = &e
+	}
+	return WriteJSON(w, apiErr.Status, struct {
+		Error *APIError `json:"error"`
+	}{apiErr})
+}
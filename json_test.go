@@ -0,0 +1,160 @@
+package webapp
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type order struct {
+	Item  string `json:"item"`
+	Count int    `json:"count"`
+}
+
+func (o *order) Validate() error {
+	if o.Count < 1 {
+		return &FieldError{Field: "count", Message: "must be positive"}
+	}
+	return nil
+}
+
+func TestDecodeJSON(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		ctype  string
+		body   string
+		limit  int64
+		status int
+		code   string
+		field  string
+	}{
+		{"valid", "application/json", `{"item":"tea","count":2}`, 0, 0, "", ""},
+		{"charset", "application/json; charset=utf-8", `{"item":"tea","count":2}`, 0, 0, "", ""},
+		{"no content type", "", `{"item":"tea","count":2}`, 0, 0, "", ""},
+		{"form", "application/x-www-form-urlencoded", `item=tea`, 0, 415, "unsupported_media_type", ""},
+		{"empty", "application/json", ``, 0, 400, "empty_body", ""},
+		{"syntax", "application/json", `{"item":}`, 0, 400, "invalid_json", ""},
+		{"truncated", "application/json", `{"item":"tea"`, 0, 400, "invalid_json", ""},
+		{"trailing data", "application/json", `{"item":"tea","count":2} {}`, 0, 400, "invalid_json", ""},
+		{"wrong type", "application/json", `{"item":"tea","count":"two"}`, 0, 400, "invalid_field", "count"},
+		{"unknown field", "application/json", `{"item":"tea","count":2,"price":1}`, 0, 400, "unknown_field", "price"},
+		{"too large", "application/json", `{"item":"` + strings.Repeat("t", 100) + `","count":2}`, 64, 413, "body_too_large", ""},
+		{"invalid", "application/json", `{"item":"tea","count":0}`, 0, 422, "validation_failed", "count"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/orders", strings.NewReader(tc.body))
+			if tc.ctype != "" {
+				r.Header.Set("Content-Type", tc.ctype)
+			}
+			limit := tc.limit
+			if limit == 0 {
+				limit = DefaultMaxJSONBody
+			}
+			var o order
+			err := DecodeJSONLimit(httptest.NewRecorder(), r, &o, limit)
+			if tc.status == 0 {
+				if err != nil || o.Item != "tea" || o.Count != 2 {
+					t.Errorf("DecodeJSON = %+v, %v", o, err)
+				}
+				return
+			}
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("DecodeJSON = %v, want an *APIError", err)
+			}
+			if apiErr.Status != tc.status || apiErr.Code != tc.code || apiErr.Field != tc.field {
+				t.Errorf("error = %+v, want status %d, code %s, field %q", apiErr, tc.status, tc.code, tc.field)
+			}
+		})
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	w := httptest.NewRecorder()
+	if err := WriteJSON(w, http.StatusCreated, order{"tea", 2}); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 201 || w.Header().Get("Content-Type") != "application/json; charset=utf-8" || w.Body.String() != `{"item":"tea","count":2}`+"\n" {
+		t.Errorf("WriteJSON = %d %q %q", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+	w = httptest.NewRecorder()
+	if err := WriteJSON(w, 200, func() {}); err == nil || w.Code != 500 {
+		t.Errorf("WriteJSON of a func = %d, %v, want 500 and an error", w.Code, err)
+	}
+}
+
+// errorEnvelope is the body written by WriteError.
+type errorEnvelope struct {
+	Error APIError `json:"error"`
+}
+
+func TestWriteError(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		status int
+		code   string
+		msg    string
+	}{
+		{&APIError{Status: 404, Code: "not_found", Message: "no such order"}, 404, "not_found", "no such order"},
+		{errors.New("database password is hunter2"), 500, "internal_error", "Internal Server Error"},
+	} {
+		app := NewApp(func(w http.ResponseWriter, r *http.Request) {
+			WriteError(w, r, tc.err)
+		}, false)
+		r := httptest.NewRequest("GET", "/orders/1", nil)
+		r.Header.Set("X-Request-Id", "req-1")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		var env errorEnvelope
+		if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+			t.Fatalf("body %q: %v", w.Body, err)
+		}
+		if w.Code != tc.status || env.Error.Status != tc.status || env.Error.Code != tc.code || env.Error.Message != tc.msg || env.Error.RequestID != "req-1" {
+			t.Errorf("WriteError(%v) = %d %+v", tc.err, w.Code, env.Error)
+		}
+	}
+}
+
+func TestJSONErrorsPanic(t *testing.T) {
+	for _, detailed := range []bool{false, true} {
+		app := NewApp(func(w http.ResponseWriter, r *http.Request) {
+			panic("out of tea")
+		}, detailed)
+		app.JSONErrors = true
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		var env errorEnvelope
+		if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+			t.Fatalf("body %q: %v", w.Body, err)
+		}
+		if w.Code != 500 || env.Error.Code != "internal_error" || env.Error.RequestID != w.Header().Get("X-Request-Id") {
+			t.Errorf("panic response = %d %+v", w.Code, env.Error)
+		}
+		details, _ := env.Error.Details.(map[string]interface{})
+		if detailed != (details["panic"] == "out of tea") {
+			t.Errorf("detailed %v: details = %v", detailed, env.Error.Details)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		keep   bool
+	}{
+		{"abc-123", true},
+		{"", false},
+		{"with space", false},
+		{strings.Repeat("x", 129), false},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Request-Id", tc.header)
+		id := requestID(r)
+		if (id == tc.header) != tc.keep || id == "" {
+			t.Errorf("requestID with header %q = %q", tc.header, id)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package webapp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// LogfmtKeys name the keys of logfmt lines. An empty name leaves the value
+// out.
+type LogfmtKeys struct {
+	Time       string
+	Host       string
+	VHost      string
+	Ident      string
+	User       string
+	Method     string
+	Path       string
+	Proto      string
+	Status     string
+	Bytes      string
+	Referer    string
+	UserAgent  string
+	DurationMS string
+	DurationNS string
+	RequestID  string
+	Session    string
+}
+
+// DefaultLogfmtKeys are used by LogfmtFormat and LogfmtParser.
+var DefaultLogfmtKeys = LogfmtKeys{
+	Time:       "time",
+	Host:       "host",
+	VHost:      "vhost",
+	Ident:      "ident",
+	User:       "user",
+	Method:     "method",
+	Path:       "path",
+	Proto:      "proto",
+	Status:     "status",
+	Bytes:      "bytes",
+	Referer:    "referer",
+	UserAgent:  "user_agent",
+	DurationMS: "duration_ms",
+	DurationNS: "duration_ns",
+	RequestID:  "request_id",
+	Session:    "session",
+}
+
+func (k *LogfmtKeys) names() []string {
+	return []string{k.Time, k.Host, k.VHost, k.Ident, k.User, k.Method, k.Path, k.Proto,
+		k.Status, k.Bytes, k.Referer, k.UserAgent, k.DurationMS, k.DurationNS, k.RequestID, k.Session}
+}
+
+// logfmtNeedsQuote reports whether a logfmt value must be quoted.
+func logfmtNeedsQuote(s []byte) bool {
+	if len(s) == 0 {
+		return true
+	}
+	for _, c := range s {
+		if c <= ' ' || c == '"' || c == '=' || c == '\\' || c == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+// appendLogfmtQuoted appends s in double quotes, escaping quotes,
+// backslashes and control characters as in JSON strings.
+func appendLogfmtQuoted(b []byte, s []byte) []byte {
+	const hex = "0123456789abcdef"
+	b = append(b, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c >= utf8.RuneSelf {
+			r, size := utf8.DecodeRune(s[i:])
+			if r == utf8.RuneError && size == 1 {
+				b = append(b, `�`...)
+			} else {
+				b = append(b, s[i:i+size]...)
+			}
+			i += size
+			continue
+		}
+		switch c {
+		case '"', '\\':
+			b = append(b, '\\', c)
+		case '\n':
+			b = append(b, '\\', 'n')
+		case '\r':
+			b = append(b, '\\', 'r')
+		case '\t':
+			b = append(b, '\\', 't')
+		default:
+			if c < ' ' || c == 0x7f {
+				b = append(b, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+			} else {
+				b = append(b, c)
+			}
+		}
+		i++
+	}
+	return append(b, '"')
+}
+
+// logfmtKey appends " key=" and returns the start of the value. The
+// leading space is left out at the start of the line.
+func logfmtKey(b []byte, line int, key string) ([]byte, int) {
+	if len(b) > line {
+		b = append(b, ' ')
+	}
+	b = append(b, key...)
+	b = append(b, '=')
+	return b, len(b)
+}
+
+// logfmtValue quotes the value appended to b since start if needed.
+func logfmtValue(b []byte, start int) []byte {
+	if !logfmtNeedsQuote(b[start:]) {
+		return b
+	}
+	// the value is quoted after the end of b and moved back in place
+	end := len(b)
+	b = appendLogfmtQuoted(b, b[start:end])
+	n := copy(b[start:], b[end:])
+	return b[:start+n]
+}
+
+func appendLogfmtString(b []byte, line int, key, value string) []byte {
+	if key == "" {
+		return b
+	}
+	b, start := logfmtKey(b, line, key)
+	b = append(b, value...)
+	return logfmtValue(b, start)
+}
+
+func appendLogfmtInt(b []byte, line int, key string, value int64) []byte {
+	if key == "" {
+		return b
+	}
+	b, _ = logfmtKey(b, line, key)
+	return strconv.AppendInt(b, value, 10)
+}
+
+// AppendLogfmt returns a formatter writing records as logfmt lines with
+// the given key names:
+//
+//	time=2024-01-02T15:04:05.000Z host=10.0.0.1 method=GET path=/a status=200 duration_ms=1.25 user_id=42
+//
+// Fields attached with AddField follow the standard keys; a field named
+// like a standard key gets a "field_" prefix.
+func (o FormatOptions) AppendLogfmt(k LogfmtKeys) AppendFormatter {
+	reserved := k.reserved()
+	return func(b []byte, rec *LogRecord) []byte {
+		line := len(b)
+		method, path, query, proto := requestParts(rec.Request)
+		d := duration(rec)
+		if k.Time != "" {
+			b, _ = logfmtKey(b, line, k.Time)
+			b = o.AppendRFC3339(b, rec.RequestStarted)
+		}
+		b = appendLogfmtString(b, line, k.Host, rec.Host)
+		if rec.VirtualHost != "" {
+			b = appendLogfmtString(b, line, k.VHost, rec.VirtualHost)
+		}
+		b = appendLogfmtString(b, line, k.Ident, rec.Indent)
+		b = appendLogfmtString(b, line, k.User, rec.User)
+		b = appendLogfmtString(b, line, k.Method, method)
+		if k.Path != "" {
+			var start int
+			b, start = logfmtKey(b, line, k.Path)
+			b = append(b, path...)
+			b = append(b, query...)
+			b = logfmtValue(b, start)
+		}
+		b = appendLogfmtString(b, line, k.Proto, proto)
+		b = appendLogfmtInt(b, line, k.Status, int64(rec.Status))
+		if k.Bytes != "" {
+			b, _ = logfmtKey(b, line, k.Bytes)
+			b = strconv.AppendUint(b, rec.Bytes, 10)
+		}
+		b = appendLogfmtString(b, line, k.Referer, rec.Referer)
+		b = appendLogfmtString(b, line, k.UserAgent, rec.UserAgent)
+		if k.DurationMS != "" {
+			b, _ = logfmtKey(b, line, k.DurationMS)
+			b = strconv.AppendFloat(b, float64(d)/float64(time.Millisecond), 'f', -1, 64)
+		}
+		b = appendLogfmtInt(b, line, k.DurationNS, int64(d))
+		if rec.RequestID != "" {
+			b = appendLogfmtString(b, line, k.RequestID, rec.RequestID)
+		}
+		if rec.Session != "-" && rec.Session != "" {
+			b = appendLogfmtString(b, line, k.Session, rec.Session)
+		}
+		for _, f := range rec.Fields {
+			key := f.Key
+			if reserved[key] {
+				key = "field_" + key
+			}
+			var start int
+			b, start = logfmtKey(b, line, key)
+			b = appendFieldValue(b, f.Value)
+			b = logfmtValue(b, start)
+		}
+		return b
+	}
+}
+
+func (o FormatOptions) Logfmt(k LogfmtKeys) Formatter {
+	return o.AppendLogfmt(k).Formatter()
+}
+
+var (
+	AppendLogfmtFormat = FormatOptions{}.AppendLogfmt(DefaultLogfmtKeys)
+	logfmtFormat       = AppendLogfmtFormat.Formatter()
+
+	// LogfmtParser parses lines written by LogfmtFormat.
+	LogfmtParser Parser = DefaultLogfmtKeys.Parser()
+)
+
+// LogfmtFormat writes records as logfmt with DefaultLogfmtKeys.
+func LogfmtFormat(rec *LogRecord) string {
+	return logfmtFormat(rec)
+}
+
+// unquoteLogfmt reads a quoted value at the start of s and returns it with
+// the number of bytes consumed.
+func unquoteLogfmt(s string) (string, int, error) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			return b.String(), i + 1, nil
+		case '\\':
+			i++
+			if i >= len(s) {
+				return "", 0, fmt.Errorf("unterminated escape")
+			}
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'u':
+				if i+4 >= len(s) {
+					return "", 0, fmt.Errorf("short \\u escape")
+				}
+				r, err := strconv.ParseUint(s[i+1:i+5], 16, 32)
+				if err != nil {
+					return "", 0, fmt.Errorf("bad \\u escape")
+				}
+				b.WriteRune(rune(r))
+				i += 4
+			default:
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("missing closing quote")
+}
+
+// reserved returns the set of keys used by k.
+func (k LogfmtKeys) reserved() map[string]bool {
+	reserved := make(map[string]bool)
+	for _, name := range k.names() {
+		if name != "" {
+			reserved[name] = true
+		}
+	}
+	return reserved
+}
+
+// Parser returns a Parser for logfmt lines written with keys k. Keys not
+// named by k become Fields with string values, without the "field_"
+// prefix given to fields named like keys of k.
+func (k LogfmtKeys) Parser() Parser {
+	reserved := k.reserved()
+	return ParserFunc(func(line string) (*LogRecord, error) {
+		rec := &LogRecord{Indent: "-", User: "-", Session: "-"}
+		var method, path, proto string
+		var dur time.Duration
+		hasDur, hasNS := false, false
+		for pos := 0; pos < len(line); {
+			if line[pos] == ' ' {
+				pos++
+				continue
+			}
+			eq := strings.IndexAny(line[pos:], "= ")
+			if eq <= 0 || line[pos+eq] != '=' {
+				return nil, &ParseError{Column: pos + 1, Msg: "expected key=value"}
+			}
+			key := line[pos : pos+eq]
+			vpos := pos + eq + 1
+			var v string
+			if vpos < len(line) && line[vpos] == '"' {
+				s, n, err := unquoteLogfmt(line[vpos:])
+				if err != nil {
+					return nil, &ParseError{Column: vpos + 1, Field: key, Msg: err.Error()}
+				}
+				v, pos = s, vpos+n
+			} else {
+				end := strings.IndexByte(line[vpos:], ' ')
+				if end == -1 {
+					end = len(line) - vpos
+				}
+				v, pos = line[vpos:vpos+end], vpos+end
+			}
+			fail := func(format string, args ...interface{}) (*LogRecord, error) {
+				return nil, &ParseError{Column: vpos + 1, Field: key, Msg: fmt.Sprintf(format, args...)}
+			}
+			switch key {
+			case k.Time:
+				t, err := time.Parse(time.RFC3339Nano, v)
+				if err != nil {
+					return fail("bad time %q", v)
+				}
+				rec.RequestStarted = t
+			case k.Host:
+				rec.Host = v
+			case k.VHost:
+				rec.VirtualHost = v
+			case k.Ident:
+				rec.Indent = v
+			case k.User:
+				rec.User = v
+			case k.Method:
+				method = v
+			case k.Path:
+				path = v
+			case k.Proto:
+				proto = v
+			case k.Status:
+				s, err := strconv.Atoi(v)
+				if err != nil {
+					return fail("bad status %q", v)
+				}
+				rec.Status = s
+			case k.Bytes:
+				n, err := strconv.ParseUint(v, 10, 64)
+				if err != nil {
+					return fail("bad byte count %q", v)
+				}
+				rec.Bytes = n
+			case k.Referer:
+				rec.Referer = v
+			case k.UserAgent:
+				rec.UserAgent = v
+			case k.DurationMS:
+				ms, err := strconv.ParseFloat(v, 64)
+				if err != nil {
+					return fail("bad duration %q", v)
+				}
+				if !hasNS {
+					dur, hasDur = time.Duration(ms*float64(time.Millisecond)), true
+				}
+			case k.DurationNS:
+				ns, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					return fail("bad duration %q", v)
+				}
+				dur, hasDur, hasNS = time.Duration(ns), true, true
+			case k.RequestID:
+				rec.RequestID = v
+			case k.Session:
+				rec.Session = v
+			default:
+				if name := strings.TrimPrefix(key, "field_"); reserved[name] {
+					key = name
+				}
+				rec.Fields = append(rec.Fields, Field{key, v})
+			}
+		}
+		if method != "" || path != "" {
+			rec.Request = method + " " + path + " " + proto
+		}
+		if hasDur {
+			rec.RequestCompleted = rec.RequestStarted.Add(dur)
+		}
+		return rec, nil
+	})
+}
@@ -0,0 +1,114 @@
+package webapp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogfmtFormat(t *testing.T) {
+	rec := formatRecord()
+	rec.RequestStarted = rec.RequestStarted.In(time.UTC)
+	rec.RequestCompleted = rec.RequestStarted.Add(1250 * time.Microsecond)
+	rec.Request = "GET /search?q=a+b HTTP/1.1"
+	rec.UserAgent = "Mozilla/5.0 (X11)"
+	rec.Fields = []Field{{"user_id", 42}, {"status", "shadowed"}, {"note", "line\nbreak \"quoted\""}}
+	want := `time=2013-01-02T14:04:05.123Z host=192.0.2.1 ident=- user=frank method=GET path="/search?q=a+b" proto=HTTP/1.1 status=200 bytes=1234 referer=http://example.com/ user_agent="Mozilla/5.0 (X11)" duration_ms=1.25 duration_ns=1250000 request_id=req-1 user_id=42 field_status=shadowed note="line\nbreak \"quoted\""`
+	if got := LogfmtFormat(rec); got != want {
+		t.Errorf("LogfmtFormat =\n%s\nwant\n%s", got, want)
+	}
+
+	keys := LogfmtKeys{Time: "ts", Method: "m", Path: "p", Status: "code", DurationMS: "ms"}
+	want = `ts=2013-01-02T14:04:05.123Z m=GET p="/search?q=a+b" code=200 ms=1.25 user_id=42 status=shadowed note="line\nbreak \"quoted\""`
+	if got := (FormatOptions{}).Logfmt(keys)(rec); got != want {
+		t.Errorf("Logfmt with custom keys =\n%s\nwant\n%s", got, want)
+	}
+
+	// the line starts where dst ends
+	if got := string(AppendLogfmtFormat([]byte("> "), rec)); !strings.HasPrefix(got, "> time=") {
+		t.Errorf("AppendLogfmtFormat appended %q", got)
+	}
+}
+
+func TestLogfmtRoundTrip(t *testing.T) {
+	rec := formatRecord()
+	rec.VirtualHost = "shop.example.com"
+	rec.UserAgent = "Mozilla/5.0 \"quoted\"\tnaïve \x01"
+	rec.RequestCompleted = rec.RequestStarted.Add(1234567 * time.Nanosecond)
+	rec.Fields = []Field{{"user_id", 42}}
+	for _, p := range []Parser{LogfmtParser, AutoParser} {
+		got, err := p.Parse(LogfmtFormat(rec))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Host != rec.Host || got.User != rec.User || got.Request != rec.Request || got.Status != rec.Status || got.Bytes != rec.Bytes {
+			t.Errorf("round trip = %+v", got)
+		}
+		if got.VirtualHost != rec.VirtualHost || got.UserAgent != rec.UserAgent || got.RequestID != rec.RequestID ||
+			duration(got) != duration(rec) || !got.RequestStarted.Equal(rec.RequestStarted.Truncate(time.Millisecond)) {
+			t.Errorf("round trip = %+v", got)
+		}
+		if len(got.Fields) != 1 || got.Fields[0] != (Field{"user_id", "42"}) {
+			t.Errorf("fields %v", got.Fields)
+		}
+	}
+	if p, err := ParserByName("logfmt"); err != nil || p == nil {
+		t.Errorf("ParserByName(logfmt) = %v, %v", p, err)
+	}
+}
+
+func TestLogfmtParseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		line   string
+		column int
+		field  string
+		msg    string
+	}{
+		{"time=2013-01-02T15:04:05Z bare", 27, "", "expected key=value"},
+		{"=x", 1, "", "expected key=value"},
+		{"time=yesterday", 6, "time", "bad time"},
+		{"status=OK", 8, "status", "bad status"},
+		{"bytes=-1", 7, "bytes", "bad byte count"},
+		{"duration_ms=soon", 13, "duration_ms", "bad duration"},
+		{`user_agent="unterminated`, 12, "user_agent", "missing closing quote"},
+		{`user_agent="\u12"`, 12, "user_agent", `short \u escape`},
+		{`user_agent="\u12zz"`, 12, "user_agent", `bad \u escape`},
+	} {
+		_, err := LogfmtParser.Parse(tc.line)
+		var perr *ParseError
+		if !errors.As(err, &perr) || perr.Column != tc.column || perr.Field != tc.field || !strings.Contains(perr.Msg, tc.msg) {
+			t.Errorf("parse %q = %v, want column %d, field %q, %q", tc.line, err, tc.column, tc.field, tc.msg)
+		}
+	}
+}
+
+// TestReservedFieldRoundTrip checks that fields named like standard keys
+// come back from the parsers under their own name.
+func TestReservedFieldRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		format Formatter
+		parser Parser
+	}{
+		{"logfmt", LogfmtFormat, LogfmtParser},
+		{"JSON", JSONFormat, JSONParser},
+	} {
+		rec := benchRecord()
+		rec.Fields = []Field{{"status", "paid"}, {"field_x", "kept"}}
+		line := tc.format(rec)
+		got, err := tc.parser.Parse(line)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got.Status != 200 {
+			t.Errorf("%s: status = %d, want 200", tc.name, got.Status)
+		}
+		if v, _ := got.Field("status").(string); v != "paid" {
+			t.Errorf("%s: field status = %v, want paid in %s", tc.name, got.Field("status"), line)
+		}
+		if v, _ := got.Field("field_x").(string); v != "kept" {
+			t.Errorf("%s: field field_x = %v, want kept in %s", tc.name, got.Field("field_x"), line)
+		}
+	}
+}
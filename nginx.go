@@ -0,0 +1,119 @@
+package webapp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Layouts of nginx log_format definitions. NginxCombinedLayout is the
+// built-in combined format; NginxMainLayout is the main format of the stock
+// nginx.conf with $request_time appended, as it is usually configured.
+const (
+	NginxCombinedLayout = `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"`
+	NginxMainLayout     = `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent" "$http_x_forwarded_for" $request_time`
+)
+
+// nginxVars maps nginx variables to format directives.
+var nginxVars = map[string]formatPart{
+	"remote_addr":          {verb: 'h'},
+	"remote_user":          {verb: 'u'},
+	"time_local":           {verb: 't', arg: argRawTime},
+	"request":              {verb: 'r'},
+	"status":               {verb: 's'},
+	"body_bytes_sent":      {verb: 'B'},
+	"bytes_sent":           {verb: 'B'},
+	"request_time":         {verb: 'T', arg: argSecMS},
+	"request_method":       {verb: 'm'},
+	"uri":                  {verb: 'U'},
+	"server_protocol":      {verb: 'H'},
+	"host":                 {verb: 'v'},
+	"server_name":          {verb: 'v'},
+	"request_id":           {verb: 'i', arg: "X-Request-Id"},
+	"http_referer":         {verb: 'i', arg: "Referer"},
+	"http_user_agent":      {verb: 'i', arg: "User-Agent"},
+	"http_x_request_id":    {verb: 'i', arg: "X-Request-Id"},
+	"http_x_forwarded_for": {verb: verbIgnored},
+}
+
+func isNginxVarByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// CompileNginxFormat compiles an nginx log_format string into a format
+// which writes and parses the same lines. Supported variables are
+// $remote_addr, $remote_user, $time_local, $request, $status,
+// $body_bytes_sent, $bytes_sent, $request_time, $request_method, $uri,
+// $server_protocol, $host, $server_name, $request_id, $http_referer,
+// $http_user_agent and $http_x_request_id. $http_x_forwarded_for is not
+// recorded by LogRecord: it is written as "-" and skipped when parsing.
+func CompileNginxFormat(layout string) (*ApacheFormat, error) {
+	f := &ApacheFormat{Layout: layout}
+	var lit strings.Builder
+	flush := func() {
+		if lit.Len() > 0 {
+			f.parts = append(f.parts, formatPart{text: lit.String()})
+			lit.Reset()
+		}
+	}
+	for i := 0; i < len(layout); i++ {
+		if layout[i] != '$' {
+			lit.WriteByte(layout[i])
+			continue
+		}
+		start := i
+		var name string
+		if i+1 < len(layout) && layout[i+1] == '{' {
+			end := strings.IndexByte(layout[i:], '}')
+			if end == -1 {
+				return nil, &ParseError{Column: start + 1, Msg: "missing '}' in format"}
+			}
+			name = layout[i+2 : i+end]
+			i += end
+		} else {
+			j := i + 1
+			for j < len(layout) && isNginxVarByte(layout[j]) {
+				j++
+			}
+			name = layout[i+1 : j]
+			i = j - 1
+		}
+		p, ok := nginxVars[name]
+		if !ok {
+			return nil, &ParseError{Column: start + 1, Field: layout[start : i+1], Msg: "unsupported variable"}
+		}
+		p.text = layout[start : i+1]
+		flush()
+		f.parts = append(f.parts, p)
+	}
+	flush()
+	return f, nil
+}
+
+func MustCompileNginxFormat(layout string) *ApacheFormat {
+	f, err := CompileNginxFormat(layout)
+	if err != nil {
+		panic(fmt.Sprintf("webapp: nginx format %q: %v", layout, err))
+	}
+	return f
+}
+
+var (
+	nginxCombined = MustCompileNginxFormat(NginxCombinedLayout)
+	nginxMain     = MustCompileNginxFormat(NginxMainLayout)
+
+	// NginxCombinedParser and NginxMainParser parse lines of the nginx
+	// formats, whether written by nginx or by this package.
+	NginxCombinedParser Parser = nginxCombined
+	NginxMainParser     Parser = nginxMain
+)
+
+// NginxCombinedFormat writes records like the nginx combined format.
+func NginxCombinedFormat(rec *LogRecord) string {
+	return nginxCombined.Format(rec)
+}
+
+// NginxMainFormat writes records like the nginx main format with
+// $request_time.
+func NginxMainFormat(rec *LogRecord) string {
+	return nginxMain.Format(rec)
+}
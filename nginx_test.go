@@ -0,0 +1,75 @@
+package webapp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNginxFormats(t *testing.T) {
+	rec := formatRecord()
+	for _, tc := range []struct {
+		name string
+		f    Formatter
+		p    Parser
+		want string
+	}{
+		{"NginxCombinedFormat", NginxCombinedFormat, NginxCombinedParser, CombinedFormat(rec)},
+		{"NginxMainFormat", NginxMainFormat, NginxMainParser, `192.0.2.1 - frank [02/Jan/2013:15:04:05 +0100] "GET /index.html HTTP/1.1" 200 1234 "http://example.com/" "Mozilla/5.0" "-" 0.042`},
+	} {
+		line := tc.f(rec)
+		if line != tc.want {
+			t.Errorf("%s =\n%s\nwant\n%s", tc.name, line, tc.want)
+		}
+		got, err := tc.p.Parse(line)
+		if err != nil {
+			t.Fatalf("parse %q: %v", line, err)
+		}
+		if diffs := sameRecord(got, rec, tc.name == "NginxMainFormat"); len(diffs) > 0 || got.UserAgent != rec.UserAgent {
+			t.Errorf("%s round trip differs in %v: %+v", tc.name, diffs, got)
+		}
+	}
+
+	// as written by nginx, with a forwarded address and seconds of duration
+	line := `10.0.0.1 - - [02/Jan/2013:15:04:05 +0100] "POST /api HTTP/2.0" 201 0 "-" "curl/8.0" "203.0.113.7, 10.0.0.2" 1.500`
+	p, err := ParserByName("nginx_main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := p.Parse(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Host != "10.0.0.1" || got.Status != 201 || got.UserAgent != "curl/8.0" || duration(got).Milliseconds() != 1500 {
+		t.Errorf("parse %q = %+v", line, got)
+	}
+}
+
+func TestCompileNginxFormat(t *testing.T) {
+	rec := formatRecord()
+	rec.VirtualHost = "shop.example.com"
+	f, err := CompileNginxFormat(`${host} $request_method $uri $status`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := f.Format(rec); got != "shop.example.com GET /index.html 200" {
+		t.Errorf("Format = %q", got)
+	}
+	for _, tc := range []struct {
+		layout string
+		column int
+		field  string
+	}{
+		{`$remote_addr ${status`, 14, ""},
+		{`$remote_addr $cookie_id`, 14, "$cookie_id"},
+	} {
+		_, err := CompileNginxFormat(tc.layout)
+		var perr *ParseError
+		if !errors.As(err, &perr) || perr.Column != tc.column || perr.Field != tc.field {
+			t.Errorf("CompileNginxFormat(%q) = %v, want column %d, field %q", tc.layout, err, tc.column, tc.field)
+		}
+	}
+	if _, err := CompileNginxFormat(strings.Repeat("$status ", 3)); err != nil {
+		t.Error(err)
+	}
+}
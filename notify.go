@@ -0,0 +1,193 @@
+package webapp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// NotifyTimeout is the default limit for delivering one notification.
+const NotifyTimeout = 30 * time.Second
+
+// EmailNotifier sends notifications as plain text mail through the SMTP
+// server at Addr (host:port). Auth may be nil for servers that accept
+// mail without it. Timeout limits the whole SMTP conversation, zero means
+// NotifyTimeout. Messages are dated by Clock, the system clock by default.
+type EmailNotifier struct {
+	Addr    string
+	Auth    smtp.Auth
+	From    string
+	To      []string
+	Timeout time.Duration
+	Clock   Clock
+}
+
+func (e *EmailNotifier) now() time.Time {
+	if e.Clock != nil {
+		return e.Clock.Now()
+	}
+	return SystemClock.Now()
+}
+
+func (e *EmailNotifier) message(n *Notification, date time.Time) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", e.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", n.Subject()))
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.Replace(n.Text(), "\n", "\r\n", -1))
+	return b.Bytes()
+}
+
+func (e *EmailNotifier) Notify(n *Notification) error {
+	timeout := e.Timeout
+	if timeout <= 0 {
+		timeout = NotifyTimeout
+	}
+	conn, err := net.DialTimeout("tcp", e.Addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// connection deadlines are in real time, whatever the Clock
+	conn.SetDeadline(time.Now().Add(timeout))
+	return e.send(conn, e.message(n, e.now()))
+}
+
+// send is smtp.SendMail over conn.
+func (e *EmailNotifier) send(conn net.Conn, msg []byte) error {
+	host, _, _ := net.SplitHostPort(e.Addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if e.Auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return fmt.Errorf("webapp: %s does not support AUTH", e.Addr)
+		}
+		if err := c.Auth(e.Auth); err != nil {
+			return err
+		}
+	}
+	for _, addr := range append([]string{e.From}, e.To...) {
+		if strings.ContainsAny(addr, "\r\n") {
+			return fmt.Errorf("webapp: line break in mail address %q", addr)
+		}
+	}
+	if err := c.Mail(e.From); err != nil {
+		return err
+	}
+	for _, to := range e.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// DefaultWebhookTemplate posts the text of the notification in the
+// payload understood by Slack and Microsoft Teams incoming webhooks.
+const DefaultWebhookTemplate = `{"text": {{json .Text}}}`
+
+// WebhookNotifier posts notifications as JSON to URL. The payload is made
+// by Template, a text/template executed with the *Notification, which has
+// a json function for quoting values:
+//
+//	{"text": {{json .Subject}}, "count": {{len .Alerts}}}
+//
+// A nil Template means DefaultWebhookTemplate and a nil Client means one
+// with a Timeout of NotifyTimeout. Header is added to the requests.
+type WebhookNotifier struct {
+	URL      string
+	Template *template.Template
+	Client   *http.Client
+	Header   http.Header
+}
+
+var (
+	defaultWebhookTemplate = template.Must(ParseWebhookTemplate(DefaultWebhookTemplate))
+	defaultNotifyClient    = &http.Client{Timeout: NotifyTimeout}
+)
+
+// ParseWebhookTemplate parses a payload template for WebhookNotifier.
+func ParseWebhookTemplate(text string) (*template.Template, error) {
+	return template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(text)
+}
+
+// NewWebhookNotifier returns a notifier posting to url with the payload
+// template tmpl, or DefaultWebhookTemplate if it is empty.
+func NewWebhookNotifier(url, tmpl string) (*WebhookNotifier, error) {
+	w := &WebhookNotifier{URL: url}
+	if tmpl != "" {
+		t, err := ParseWebhookTemplate(tmpl)
+		if err != nil {
+			return nil, err
+		}
+		w.Template = t
+	}
+	return w, nil
+}
+
+func (w *WebhookNotifier) Notify(n *Notification) error {
+	t, client := w.Template, w.Client
+	if t == nil {
+		t = defaultWebhookTemplate
+	}
+	if client == nil {
+		client = defaultNotifyClient
+	}
+	var body bytes.Buffer
+	if err := t.Execute(&body, n); err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", w.URL, &body)
+	if err != nil {
+		return err
+	}
+	for k, v := range w.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webapp: webhook returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
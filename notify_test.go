@@ -0,0 +1,110 @@
+package webapp
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	var bodies []string
+	var headers []http.Header
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		headers = append(headers, r.Header)
+		if status != http.StatusOK {
+			http.Error(w, "invalid_payload", status)
+		}
+	}))
+	defer srv.Close()
+	n := &Notification{Name: "shop", Alerts: []Alert{{Kind: EventPanic, Message: `say "hi"`, Count: 1}}}
+
+	w, err := NewWebhookNotifier(srv.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Header = http.Header{"Authorization": {"Bearer token"}}
+	if err := w.Notify(n); err != nil {
+		t.Fatal(err)
+	}
+	var payload struct{ Text string }
+	if err := json.Unmarshal([]byte(bodies[0]), &payload); err != nil || payload.Text != n.Text() {
+		t.Errorf("default payload %s, %v", bodies[0], err)
+	}
+	if h := headers[0]; h.Get("Content-Type") != "application/json" || h.Get("Authorization") != "Bearer token" {
+		t.Errorf("headers %v", h)
+	}
+
+	w, err = NewWebhookNotifier(srv.URL, `{"text": {{json .Subject}}, "count": {{len .Alerts}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Notify(n); err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"text": "[shop] panic: say \"hi\"", "count": 1}`; bodies[1] != want {
+		t.Errorf("payload %s, want %s", bodies[1], want)
+	}
+
+	status = http.StatusBadRequest
+	if err := w.Notify(n); err == nil || !strings.Contains(err.Error(), "400 Bad Request: invalid_payload") {
+		t.Errorf("Notify with a failing webhook = %v", err)
+	}
+	if _, err := NewWebhookNotifier(srv.URL, "{{json"); err == nil {
+		t.Error("NewWebhookNotifier accepted a broken template")
+	}
+}
+
+func TestEmailMessage(t *testing.T) {
+	e := &EmailNotifier{From: "app@example.com", To: []string{"ops@example.com", "dev@example.com"}}
+	n := &Notification{Name: "shop", Alerts: []Alert{{Kind: EventPanic, Message: "naïve\nsecond line", Count: 1}}}
+	msg := string(e.message(n, time.Date(2013, time.January, 2, 15, 4, 5, 0, time.UTC)))
+	for _, want := range []string{
+		"From: app@example.com\r\n",
+		"To: ops@example.com, dev@example.com\r\n",
+		"Subject: =?utf-8?q?[shop]_panic:_na=C3=AFve?=\r\n",
+		"Date: Wed, 02 Jan 2013 15:04:05 +0000\r\n",
+		"\r\n\r\n[shop] panic: naïve\r\n\r\npanic: naïve\r\nsecond line\r\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("message lacks %q:\n%s", want, msg)
+		}
+	}
+}
+
+func TestEmailNotifierTimeout(t *testing.T) {
+	// a server which accepts connections but never greets
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	e := &EmailNotifier{Addr: l.Addr().String(), From: "app@example.com", To: []string{"ops@example.com"},
+		Timeout: 50 * time.Millisecond}
+	errc := make(chan error, 1)
+	go func() { errc <- e.Notify(&Notification{Name: "test"}) }()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("Notify to a silent server succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Notify did not time out")
+	}
+}
@@ -0,0 +1,228 @@
+package webapp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Parser turns log lines back into LogRecords. It is the inverse of a
+// Formatter.
+type Parser interface {
+	Parse(line string) (*LogRecord, error)
+}
+
+type ParserFunc func(line string) (*LogRecord, error)
+
+func (f ParserFunc) Parse(line string) (*LogRecord, error) {
+	return f(line)
+}
+
+// ErrSkipLine is returned by parsers for lines which carry no record, such
+// as W3C directives. LogScanner skips such lines.
+var ErrSkipLine = errors.New("webapp: line carries no record")
+
+// ParseError describes where a log line failed to parse. Column is the
+// 1-based byte offset in the line, Field names the format directive or
+// JSON key being parsed, Line is set by LogScanner.
+type ParseError struct {
+	Line   int
+	Column int
+	Field  string
+	Msg    string
+}
+
+func (e *ParseError) Error() string {
+	var b strings.Builder
+	if e.Line > 0 {
+		fmt.Fprintf(&b, "line %d, ", e.Line)
+	}
+	fmt.Fprintf(&b, "column %d", e.Column)
+	if e.Field != "" {
+		fmt.Fprintf(&b, " (%s)", e.Field)
+	}
+	b.WriteString(": ")
+	b.WriteString(e.Msg)
+	return b.String()
+}
+
+// Layouts of the package formatters as Apache format strings.
+const (
+	CombinedLayout = `%h %l %u %t "%r" %>s %B "%{Referer}i" "%{User-Agent}i"`
+	PerfLayout     = `%h %l %u %t "%r" %>s %B %{ms}Tms`
+
+	VHostCombinedLayout = `%v ` + CombinedLayout
+)
+
+var (
+	CombinedParser Parser = MustCompileFormat(CombinedLayout)
+	PerfParser     Parser = MustCompileFormat(PerfLayout)
+	VHostParser    Parser = MustCompileFormat(VHostCombinedLayout)
+	JSONParser     Parser = ParserFunc(parseJSON)
+
+	// AutoParser recognizes lines written by JSONFormat, LogfmtFormat,
+	// PerfFormat and CombinedFormat.
+	AutoParser Parser = ParserFunc(parseAuto)
+)
+
+// ParserByName returns the parser for one of the format names auto,
+// combined, vhost_combined, perf, json, logfmt, nginx_main and w3c, or
+// compiles name as an Apache format string otherwise.
+func ParserByName(name string) (Parser, error) {
+	switch name {
+	case "auto":
+		return AutoParser, nil
+	case "combined":
+		return CombinedParser, nil
+	case "vhost_combined":
+		return VHostParser, nil
+	case "perf":
+		return PerfParser, nil
+	case "json":
+		return JSONParser, nil
+	case "logfmt":
+		return LogfmtParser, nil
+	case "nginx_main":
+		return NginxMainParser, nil
+	case "w3c":
+		return W3CParser(), nil
+	}
+	f, err := CompileFormat(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// ParseCombined parses a line written by CombinedFormat.
+func ParseCombined(line string) (*LogRecord, error) {
+	return CombinedParser.Parse(line)
+}
+
+// ParsePerf parses a line written by PerfFormat.
+func ParsePerf(line string) (*LogRecord, error) {
+	return PerfParser.Parse(line)
+}
+
+// ParseJSON parses a line written by JSONFormat.
+func ParseJSON(line string) (*LogRecord, error) {
+	return JSONParser.Parse(line)
+}
+
+func parseAuto(line string) (*LogRecord, error) {
+	if strings.HasPrefix(line, "{") {
+		return parseJSON(line)
+	}
+	if strings.HasPrefix(line, DefaultLogfmtKeys.Time+"=") {
+		return LogfmtParser.Parse(line)
+	}
+	if base, _ := splitFields(line); strings.HasSuffix(base, "ms") {
+		if rec, err := PerfParser.Parse(line); err == nil {
+			return rec, nil
+		}
+	}
+	return CombinedParser.Parse(line)
+}
+
+func parseJSON(line string) (*LogRecord, error) {
+	var j jsonRecord
+	if err := json.Unmarshal([]byte(line), &j); err != nil {
+		perr := &ParseError{Column: 1, Msg: err.Error()}
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) {
+			perr.Column = int(syntaxErr.Offset)
+		} else if errors.As(err, &typeErr) {
+			perr.Column, perr.Field = int(typeErr.Offset), typeErr.Field
+		}
+		return nil, perr
+	}
+	started, err := time.Parse(time.RFC3339Nano, j.Time)
+	if err != nil {
+		col := strings.Index(line, `"time"`) + 1
+		return nil, &ParseError{Column: col, Field: "time", Msg: fmt.Sprintf("bad time %q", j.Time)}
+	}
+	rec := &LogRecord{
+		Host:             j.Host,
+		VirtualHost:      j.VHost,
+		Indent:           j.Ident,
+		User:             j.User,
+		RequestStarted:   started,
+		RequestCompleted: started.Add(time.Duration(j.DurationMS * float64(time.Millisecond))),
+		Request:          j.Request,
+		Status:           j.Status,
+		Bytes:            j.Bytes,
+		Referer:          j.Referer,
+		UserAgent:        j.UserAgent,
+		Session:          j.Session,
+		RequestID:        j.RequestID,
+		Fields:           parseJSONFields(line),
+	}
+	if rec.Session == "" {
+		rec.Session = "-"
+	}
+	return rec, nil
+}
+
+// LogScanner reads records from a log, one per line, skipping empty
+// lines and lines for which the parser returns ErrSkipLine. Parse errors
+// do not stop scanning and carry the line number.
+//
+//	ls := NewLogScanner(f, AutoParser)
+//	for ls.Scan() {
+//		rec, err := ls.Record()
+//		...
+//	}
+//	if err := ls.Err(); err != nil { ... }
+type LogScanner struct {
+	p    Parser
+	s    *bufio.Scanner
+	line int
+	rec  *LogRecord
+	err  error
+}
+
+func NewLogScanner(r io.Reader, p Parser) *LogScanner {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	return &LogScanner{p: p, s: s}
+}
+
+func (ls *LogScanner) Scan() bool {
+	for ls.s.Scan() {
+		ls.line++
+		text := strings.TrimRight(ls.s.Text(), "\r")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		ls.rec, ls.err = ls.p.Parse(text)
+		if ls.err == ErrSkipLine {
+			continue
+		}
+		var perr *ParseError
+		if errors.As(ls.err, &perr) {
+			perr.Line = ls.line
+		}
+		return true
+	}
+	return false
+}
+
+// Record returns the record of the current line or its parse error.
+func (ls *LogScanner) Record() (*LogRecord, error) {
+	return ls.rec, ls.err
+}
+
+// Line returns the number of the current line.
+func (ls *LogScanner) Line() int {
+	return ls.line
+}
+
+// Err returns the read error which stopped Scan, if any.
+func (ls *LogScanner) Err() error {
+	return ls.s.Err()
+}
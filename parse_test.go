@@ -0,0 +1,192 @@
+package webapp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sameRecord reports the fields of got differing from want, comparing
+// times to the second unless withDuration is set.
+func sameRecord(got, want *LogRecord, withDuration bool) []string {
+	var diffs []string
+	check := func(name string, ok bool) {
+		if !ok {
+			diffs = append(diffs, name)
+		}
+	}
+	check("Host", got.Host == want.Host)
+	check("Indent", got.Indent == want.Indent)
+	check("User", got.User == want.User)
+	check("RequestStarted", got.RequestStarted.Equal(want.RequestStarted.Truncate(time.Second)))
+	check("Request", got.Request == want.Request)
+	check("Status", got.Status == want.Status)
+	check("Bytes", got.Bytes == want.Bytes)
+	if withDuration {
+		check("duration", duration(got) == duration(want).Truncate(time.Millisecond))
+	}
+	return diffs
+}
+
+func TestParseRoundTrip(t *testing.T) {
+	rec := formatRecord()
+	rec.UserAgent = `Mozilla/5.0 "compatible" \o/`
+	for _, tc := range []struct {
+		name  string
+		f     Formatter
+		parse func(string) (*LogRecord, error)
+		perf  bool
+	}{
+		{"combined", CombinedFormat, ParseCombined, false},
+		{"perf", PerfFormat, ParsePerf, true},
+	} {
+		line := tc.f(rec)
+		got, err := tc.parse(line)
+		if err != nil {
+			t.Errorf("%s: parse %q: %v", tc.name, line, err)
+			continue
+		}
+		if diffs := sameRecord(got, rec, tc.perf); diffs != nil {
+			t.Errorf("%s: %v differ after a round trip of %q", tc.name, diffs, line)
+		}
+		if !tc.perf && (got.Referer != rec.Referer || got.UserAgent != rec.UserAgent) {
+			t.Errorf("%s: Referer %q, User-Agent %q", tc.name, got.Referer, got.UserAgent)
+		}
+	}
+
+	got, err := ParseJSON(JSONFormat(rec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.RequestStarted.Equal(rec.RequestStarted.Truncate(time.Millisecond)) || duration(got) != duration(rec) ||
+		got.UserAgent != rec.UserAgent || got.RequestID != rec.RequestID || got.Session != "-" {
+		t.Errorf("JSON round trip = %+v", got)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	line, perf := CombinedFormat(formatRecord()), PerfFormat(formatRecord())
+	col := func(s string) int { return strings.Index(line, s) + 1 }
+	for _, tc := range []struct {
+		name   string
+		p      Parser
+		line   string
+		column int
+		field  string
+		err    string
+	}{
+		{"empty", CombinedParser, "", 1, "%h", `missing " " after value`},
+		{"no time", CombinedParser, "host - - GET", 10, "%t", "expected '['"},
+		{"bad time", CombinedParser, strings.Replace(line, "Jan", "Foo", 1), col("[") + 1, "%t", "bad time"},
+		{"unterminated request", CombinedParser, `host - - [02/Jan/2013:15:04:05 +0100] "GET /`, 40, "%r", "missing"},
+		{"bad status", CombinedParser, strings.Replace(line, " 200 ", " OK ", 1), col(" 200 ") + 1, "%>s", "bad status"},
+		{"bad bytes", CombinedParser, strings.Replace(line, " 1234 ", " many ", 1), col(" 1234 ") + 1, "%B", "bad byte count"},
+		{"no user agent", CombinedParser, line[:strings.LastIndex(line, ` "`)], col(`"http`) + 1, "%{Referer}i", "missing"},
+		{"perf without duration", PerfParser, line, len(line) + 1, "%{ms}T", `expected "ms" at end of line`},
+		{"perf bad duration", PerfParser, perf[:col(`"http`)-1] + "soonms", col(`"http`), "%{ms}T", "bad duration"},
+		{"trailing text", PerfParser, perf + " x", len(perf) + 3, "%{ms}T", "expected"},
+		{"json syntax", JSONParser, `{"time":`, 8, "", "unexpected end"},
+		{"json type", JSONParser, `{"time":"x","status":"OK"}`, 25, "status", "cannot unmarshal"},
+		{"json time", JSONParser, `{"time":"yesterday"}`, 2, "time", "bad time"},
+	} {
+		_, err := tc.p.Parse(tc.line)
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("%s: error %v, want a *ParseError", tc.name, err)
+			continue
+		}
+		if perr.Column != tc.column || perr.Field != tc.field || !strings.Contains(perr.Msg, tc.err) {
+			t.Errorf("%s: error %q, want column %d, field %s, %q", tc.name, err, tc.column, tc.field, tc.err)
+		}
+	}
+	if rec, err := ParseCombined(strings.Replace(line, " 1234 ", " - ", 1)); err != nil || rec.Bytes != 0 {
+		t.Errorf("byte count - parsed as %v, %v", rec, err)
+	}
+}
+
+func TestParseAuto(t *testing.T) {
+	rec := formatRecord()
+	for _, f := range []Formatter{CombinedFormat, PerfFormat, JSONFormat} {
+		line := f(rec)
+		got, err := AutoParser.Parse(line)
+		if err != nil {
+			t.Errorf("AutoParser.Parse(%q): %v", line, err)
+		} else if got.Status != rec.Status || got.Request != rec.Request {
+			t.Errorf("AutoParser.Parse(%q) = %+v", line, got)
+		}
+	}
+	for name, f := range map[string]Formatter{"auto": PerfFormat, "combined": CombinedFormat, "perf": PerfFormat, "json": JSONFormat} {
+		p, err := ParserByName(name)
+		if err != nil {
+			t.Errorf("ParserByName(%s): %v", name, err)
+			continue
+		}
+		if _, err := p.Parse(f(rec)); err != nil {
+			t.Errorf("ParserByName(%s) parser: %v", name, err)
+		}
+	}
+	if p, err := ParserByName("%h %>s"); err != nil {
+		t.Errorf("ParserByName of a layout: %v", err)
+	} else if got, err := p.Parse("192.0.2.1 404"); err != nil || got.Host != "192.0.2.1" || got.Status != 404 {
+		t.Errorf("parser compiled by ParserByName = %+v, %v", got, err)
+	}
+	if p, err := ParserByName("%Z"); err == nil || p != nil {
+		t.Errorf("ParserByName of a bad layout = %v, %v", p, err)
+	}
+}
+
+func TestLogScanner(t *testing.T) {
+	rec := formatRecord()
+	log := CombinedFormat(rec) + "\r\n\n   \ngarbage\n" + CombinedFormat(rec) + "\n"
+	ls := NewLogScanner(strings.NewReader(log), CombinedParser)
+	var lines []int
+	for ls.Scan() {
+		lines = append(lines, ls.Line())
+		got, err := ls.Record()
+		var perr *ParseError
+		switch ls.Line() {
+		case 4:
+			if !errors.As(err, &perr) || perr.Line != 4 || !strings.HasPrefix(err.Error(), "line 4, column ") {
+				t.Errorf("line 4: error %v, want a *ParseError for line 4", err)
+			}
+		default:
+			if err != nil || got.UserAgent != rec.UserAgent {
+				t.Errorf("line %d: %+v, %v", ls.Line(), got, err)
+			}
+		}
+	}
+	if ls.Err() != nil || len(lines) != 3 || lines[0] != 1 || lines[1] != 4 || lines[2] != 5 {
+		t.Errorf("scanned lines %v, %v, want 1, 4 and 5", lines, ls.Err())
+	}
+}
+
+func TestVHostCombined(t *testing.T) {
+	rec := formatRecord()
+	rec.VirtualHost = "shop.example.com"
+	line := VHostCombinedFormat(rec)
+	if want := "shop.example.com " + CombinedFormat(rec); line != want {
+		t.Errorf("VHostCombinedFormat = %q, want %q", line, want)
+	}
+	p, err := ParserByName("vhost_combined")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		p    Parser
+		line string
+	}{
+		{p, line},
+		{JSONParser, JSONFormat(rec)},
+	} {
+		got, err := tc.p.Parse(tc.line)
+		if err != nil || got.VirtualHost != rec.VirtualHost || got.Host != rec.Host || got.UserAgent != rec.UserAgent {
+			t.Errorf("parse %q = %+v, %v", tc.line, got, err)
+		}
+	}
+	// requests without a Host header are written as "-"
+	rec.VirtualHost = ""
+	if got, err := p.Parse(VHostCombinedFormat(rec)); err != nil || got.VirtualHost != "" {
+		t.Errorf("parse of an empty virtual host = %+v, %v", got, err)
+	}
+}
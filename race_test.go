@@ -0,0 +1,7 @@
+//go:build race
+
+package webapp
+
+// raceEnabled skips allocation tests: the race detector allocates and
+// makes sync.Pool drop items.
+const raceEnabled = true
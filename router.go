@@ -0,0 +1,206 @@
+package webapp
+
+import (
+	"io"
+	"strings"
+	"time"
+)
+
+// LogFilter selects records for a Route.
+type LogFilter func(rec *LogRecord) bool
+
+// StatusBetween matches responses with status in [min, max], e.g.
+// StatusBetween(500, 599) for server errors.
+func StatusBetween(min, max int) LogFilter {
+	return func(rec *LogRecord) bool {
+		return rec.Status >= min && rec.Status <= max
+	}
+}
+
+// PathPrefix matches requests whose path starts with one of prefixes.
+func PathPrefix(prefixes ...string) LogFilter {
+	return func(rec *LogRecord) bool {
+		_, path, _, _ := requestParts(rec.Request)
+		for _, p := range prefixes {
+			if strings.HasPrefix(path, p) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// SlowerThan matches requests which took longer than d.
+func SlowerThan(d time.Duration) LogFilter {
+	return func(rec *LogRecord) bool {
+		return duration(rec) > d
+	}
+}
+
+// HostIn matches requests from one of hosts.
+func HostIn(hosts ...string) LogFilter {
+	return func(rec *LogRecord) bool {
+		for _, h := range hosts {
+			if rec.Host == h {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// VirtualHostIn matches requests for one of hosts, see
+// LogRecord.VirtualHost. Hosts are normalized the same way, so
+// "Example.com:8080" matches example.com.
+func VirtualHostIn(hosts ...string) LogFilter {
+	hosts = append([]string(nil), hosts...)
+	for i, h := range hosts {
+		hosts[i] = normalizeHost(h)
+	}
+	return func(rec *LogRecord) bool {
+		for _, h := range hosts {
+			if rec.VirtualHost == h {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// All matches records matching every filter.
+func All(filters ...LogFilter) LogFilter {
+	return func(rec *LogRecord) bool {
+		for _, f := range filters {
+			if !f(rec) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Any matches records matching at least one filter.
+func Any(filters ...LogFilter) LogFilter {
+	return func(rec *LogRecord) bool {
+		for _, f := range filters {
+			if f(rec) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Not matches records which f does not match, e.g. Not(PathPrefix("/static/"))
+// to leave out assets.
+func Not(f LogFilter) LogFilter {
+	return func(rec *LogRecord) bool {
+		return !f(rec)
+	}
+}
+
+// Appender adapts a Formatter, such as JSONFormat, for use with
+// AppendFormatter consumers.
+func Appender(f Formatter) AppendFormatter {
+	return func(b []byte, rec *LogRecord) []byte {
+		return append(b, f(rec)...)
+	}
+}
+
+// Route sends records matching Match, or all records if Match is nil, to
+// Sink formatted by Format, one per line. Writes to Sink are made from a
+// single goroutine per route, so sinks shared between routes must be safe
+// for concurrent use, as BufferedFile and *os.File are.
+type Route struct {
+	Match  LogFilter
+	Format AppendFormatter
+	Sink   io.Writer
+}
+
+type route struct {
+	Route
+	ch    chan *LogRecord
+	flush chan chan struct{}
+}
+
+// Router is a LogDispatcher delivering records to every matching route:
+//
+//	app.AddRouter(
+//		webapp.Route{Match: webapp.StatusBetween(500, 599), Format: webapp.Appender(webapp.JSONFormat), Sink: alerts},
+//		webapp.Route{Format: webapp.AppendCombinedFormat, Sink: archive},
+//	)
+//
+// Filters run in the request goroutine and should be cheap. Each route has
+// its own queue, so a slow sink does not hold up the others.
+type Router struct {
+	routes []*route
+}
+
+func NewRouter(routes ...Route) *Router {
+	rt := &Router{}
+	for _, r := range routes {
+		rr := &route{Route: r, ch: make(chan *LogRecord, 1000), flush: make(chan chan struct{})}
+		rt.routes = append(rt.routes, rr)
+		go rr.serve()
+	}
+	return rt
+}
+
+// AddRouter adds a Router with routes to app.
+func (app *App) AddRouter(routes ...Route) *Router {
+	rt := NewRouter(routes...)
+	app.AddDispatcher(rt)
+	return rt
+}
+
+// AddVirtualHostLogger writes the requests for host to w, so that every
+// virtual host can have its own log file.
+func (app *App) AddVirtualHostLogger(host string, f AppendFormatter, w io.Writer) {
+	app.AddRouter(Route{Match: VirtualHostIn(host), Format: f, Sink: w})
+}
+
+func (r *route) serve() {
+	b := make([]byte, 0, 512)
+	write := func(rec *LogRecord) {
+		b = append(r.Format(b[:0], rec), '\n')
+		rec.Release()
+		r.Sink.Write(b)
+	}
+	for {
+		select {
+		case rec := <-r.ch:
+			write(rec)
+		case done := <-r.flush:
+			for len(r.ch) > 0 {
+				write(<-r.ch)
+			}
+			close(done)
+		}
+	}
+}
+
+func (rt *Router) Dispatch(rec *LogRecord) {
+	var matched [8]*route
+	m := matched[:0]
+	for _, r := range rt.routes {
+		if r.Match == nil || r.Match(rec) {
+			m = append(m, r)
+		}
+	}
+	if len(m) == 0 {
+		rec.Release()
+		return
+	}
+	rec.retain(len(m) - 1)
+	for _, r := range m {
+		r.ch <- rec
+	}
+}
+
+func (rt *Router) Flush() {
+	flushes := make([]chan chan struct{}, len(rt.routes))
+	for i, r := range rt.routes {
+		flushes[i] = r.flush
+	}
+	flushAll(flushes)
+}
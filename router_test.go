@@ -0,0 +1,203 @@
+package webapp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLogFilters(t *testing.T) {
+	rec := formatRecord()
+	rec.Request = "GET /api/users?id=1 HTTP/1.1"
+	rec.Status = 503
+	yes := func(*LogRecord) bool { return true }
+	no := func(*LogRecord) bool { return false }
+	for name, tc := range map[string]struct {
+		f    LogFilter
+		want bool
+	}{
+		"StatusBetween":         {StatusBetween(500, 599), true},
+		"StatusBetween outside": {StatusBetween(400, 499), false},
+		"PathPrefix":            {PathPrefix("/static/", "/api/"), true},
+		"PathPrefix query":      {PathPrefix("/api/users?"), false},
+		"SlowerThan":            {SlowerThan(10 * time.Millisecond), true},
+		"SlowerThan faster":     {SlowerThan(time.Second), false},
+		"HostIn":                {HostIn("192.0.2.9", "192.0.2.1"), true},
+		"HostIn other":          {HostIn("192.0.2.9"), false},
+		"All":                   {All(yes, yes), true},
+		"All but one":           {All(yes, no), false},
+		"All of none":           {All(), true},
+		"Any":                   {Any(no, yes), true},
+		"Any of none":           {Any(), false},
+		"Not":                   {Not(no), true},
+	} {
+		if got := tc.f(rec); got != tc.want {
+			t.Errorf("%s = %v, want %v", name, got, tc.want)
+		}
+	}
+}
+
+// waitLines waits until b holds n lines.
+func waitLines(t *testing.T, b *lockedBuffer, n int) []string {
+	deadline := time.Now().Add(time.Second)
+	for strings.Count(b.String(), "\n") < n && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	s := strings.TrimSuffix(b.String(), "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+func TestRouter(t *testing.T) {
+	var errs, api, all lockedBuffer
+	rt := NewRouter(
+		Route{Match: StatusBetween(500, 599), Format: Appender(JSONFormat), Sink: &errs},
+		Route{Match: PathPrefix("/api/"), Format: AppendPerfFormat, Sink: &api},
+		Route{Format: AppendCombinedFormat, Sink: &all},
+	)
+	for _, tc := range []struct {
+		request string
+		status  int
+	}{
+		{"GET /api/users HTTP/1.1", 500},
+		{"GET /index.html HTTP/1.1", 200},
+		{"GET /api/items HTTP/1.1", 200},
+	} {
+		rec := formatRecord()
+		rec.Request, rec.Status = tc.request, tc.status
+		rt.Dispatch(rec)
+	}
+	if lines := waitLines(t, &errs, 1); len(lines) != 1 || !strings.HasPrefix(lines[0], `{"time":`) || !strings.Contains(lines[0], `"GET /api/users HTTP/1.1"`) {
+		t.Errorf("error route got %q", lines)
+	}
+	if lines := waitLines(t, &api, 2); len(lines) != 2 || !strings.HasSuffix(lines[0], " 42ms") || !strings.Contains(lines[1], "/api/items") {
+		t.Errorf("API route got %q", lines)
+	}
+	if lines := waitLines(t, &all, 3); len(lines) != 3 || !strings.HasSuffix(lines[1], `"Mozilla/5.0"`) {
+		t.Errorf("catch-all route got %q", lines)
+	}
+}
+
+func TestRouterFlush(t *testing.T) {
+	gates := []*gateWriter{{open: make(chan struct{})}, {open: make(chan struct{})}}
+	rt := NewRouter(
+		Route{Match: PathPrefix("/api/"), Format: AppendCombinedFormat, Sink: gates[0]},
+		Route{Format: AppendCombinedFormat, Sink: gates[1]},
+	)
+	const n = 10
+	for i := 0; i < n; i++ {
+		rec := formatRecord()
+		rec.Request = "GET /api/items HTTP/1.1"
+		rt.Dispatch(rec)
+	}
+	close(gates[0].open)
+	close(gates[1].open)
+	rt.Flush()
+	for i, g := range gates {
+		if got := strings.Count(g.out.String(), "\n"); got != n {
+			t.Errorf("route %d wrote %d lines by the end of Flush, want %d", i, got, n)
+		}
+	}
+}
+
+func TestRouterReleasesRecords(t *testing.T) {
+	var out lockedBuffer
+	rt := NewRouter(
+		Route{Match: StatusBetween(500, 599), Format: AppendCombinedFormat, Sink: &out},
+		Route{Match: PathPrefix("/api/"), Format: AppendCombinedFormat, Sink: &out},
+	)
+
+	// matched by no route: released at once
+	rec := &LogRecord{Request: "GET / HTTP/1.1", Status: 200, pooled: true, refs: 1}
+	rt.Dispatch(rec)
+	if rec.refs != 0 || rec.Request != "" {
+		t.Errorf("unmatched record has %d references", rec.refs)
+	}
+
+	// matched by both: released by the second route to format it; the
+	// routes write after releasing, so both lines being in out means both
+	// have let go
+	rec = &LogRecord{Request: "GET /api/x HTTP/1.1", Status: 500, pooled: true, refs: 1}
+	rt.Dispatch(rec)
+	if lines := waitLines(t, &out, 2); len(lines) != 2 || !strings.Contains(lines[0], "GET /api/x HTTP/1.1") || !strings.Contains(lines[1], "GET /api/x HTTP/1.1") {
+		t.Fatalf("routes wrote %q, want the record twice", lines)
+	}
+	if rec.refs != 0 || rec.Request != "" {
+		t.Errorf("record has %d references after both routes wrote it", rec.refs)
+	}
+}
+
+func TestAddVirtualHostLogger(t *testing.T) {
+	app := NewApp(func(w http.ResponseWriter, r *http.Request) {}, false)
+	var shop, blog lockedBuffer
+	app.AddVirtualHostLogger("shop.example.com", AppendVHostCombinedFormat, &shop)
+	app.AddVirtualHostLogger("blog.example.com", AppendCombinedFormat, &blog)
+	for _, host := range []string{"shop.example.com", "blog.example.com:8080", "shop.example.com", "other.example.com"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = host
+		app.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	if lines := waitLines(t, &shop, 2); len(lines) != 2 || !strings.HasPrefix(lines[0], "shop.example.com 192.0.2.1 - - [") {
+		t.Errorf("shop log %q", lines)
+	}
+	if lines := waitLines(t, &blog, 1); len(lines) != 1 || !strings.HasPrefix(lines[0], "192.0.2.1 - - [") {
+		t.Errorf("blog log %q", lines)
+	}
+}
+
+func TestVirtualHostNormalization(t *testing.T) {
+	app := NewApp(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("default"))
+	}, false)
+	app.VirtualHosts = map[string]http.HandlerFunc{
+		"Shop.Example.com.": func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("shop")) },
+	}
+	match := VirtualHostIn("SHOP.example.com:443")
+	logged := make(chan *LogRecord, 1)
+	app.Loggers = append(app.Loggers, logged)
+	for host, want := range map[string]string{
+		"shop.example.com":      "shop",
+		"shop.EXAMPLE.com:8080": "shop",
+		"other.example.com":     "default",
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = host
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		if got := w.Body.String(); got != want {
+			t.Errorf("Host %s served by %s, want %s", host, got, want)
+		}
+		if rec := <-logged; match(rec) != (want == "shop") {
+			t.Errorf("VirtualHostIn match for Host %s = %v", host, match(rec))
+		}
+	}
+}
+
+// TestVirtualHostsFirstUse serves concurrent first requests, which build
+// the normalized index of VirtualHosts once.
+func TestVirtualHostsFirstUse(t *testing.T) {
+	app := NewApp(http.NotFound, false)
+	app.VirtualHosts = map[string]http.HandlerFunc{
+		"Shop.Example.com": func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("shop")) },
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Host = "shop.example.com"
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			if w.Body.String() != "shop" {
+				t.Errorf("served %q, want shop", w.Body)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -1,16 +1,24 @@
 package webapp
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"html"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const errorPageShort = "<html><body><h1>500 Internal server error</h1></body></html>"
-const errorPageDetailed = "<html><body><h1>500 Internal server error</h1><p>A runtime error has just happened:</p><ul><li>%v</li></ul><p>Stack trace of the problem:</p><pre>%s</pre></body></html>"
+const errorPageDetailed = "<html><body><h1>500 Internal server error</h1><p>A runtime error has just happened:</p><ul><li>%s</li></ul><p>Stack trace of the problem:</p><pre>%s</pre></body></html>"
 
 const ApacheTime = "02/Jan/2006:15:04:05 -0700"
 
@@ -18,7 +26,9 @@ type LogRecord struct {
 	http.ResponseWriter
 
 	Host             string
+	VirtualHost      string
 	Indent           string
+	User             string
 	RequestStarted   time.Time
 	RequestCompleted time.Time
 	Request          string
@@ -26,9 +36,80 @@ type LogRecord struct {
 	Bytes            uint64
 	Referer          string
 	UserAgent        string
+	Session          string
+	RequestID        string
+
+	// Fields are attached by the handler with AddField.
+	Fields []Field
+
+	app       *App
+	ctx       recordContext
+	session   *Session
+	principal *Principal
+	capture   *captureState
+
+	wroteHeader bool
+	intercepted bool // the handler's error response is replaced by an ErrorPage
+	pending     bool // the error status waits for a body to decide on interception
+	panicked    bool
+	skipLog     bool
+
+	pooled bool
+	refs   int32
+}
+
+var recordPool = sync.Pool{
+	New: func() interface{} { return new(LogRecord) },
+}
+
+// Release returns a record of an App with PoolRecords to the pool once
+// every receiver of it has called Release. The record must not be used
+// after that. Not calling Release is safe, the record is then left to the
+// garbage collector; Release does nothing for records which are not
+// pooled.
+func (rec *LogRecord) Release() {
+	if rec.pooled && atomic.AddInt32(&rec.refs, -1) == 0 {
+		*rec = LogRecord{}
+		recordPool.Put(rec)
+	}
+}
+
+// retain adds n receivers of a pooled record.
+func (rec *LogRecord) retain(n int) {
+	if rec.pooled {
+		atomic.AddInt32(&rec.refs, int32(n))
+	}
+}
+
+type recordKey struct{}
+
+// recordContext carries the LogRecord in the request context. It lives in
+// the record, so that serving a request does not allocate a context.
+type recordContext struct {
+	context.Context
+	rec *LogRecord
+}
+
+func (c *recordContext) Value(key interface{}) interface{} {
+	if key == (recordKey{}) {
+		return c.rec
+	}
+	return c.Context.Value(key)
+}
+
+// Record returns the LogRecord of a request served by App, or nil if the
+// request did not come through App.ServeHTTP.
+func Record(r *http.Request) *LogRecord {
+	rec, _ := r.Context().Value(recordKey{}).(*LogRecord)
+	return rec
 }
 
 func (rec *LogRecord) Write(p []byte) (n int, err error) {
+	if rec.intercepted {
+		return len(p), nil
+	}
+	rec.sendPending()
+	rec.wroteHeader = true
 	n, err = rec.ResponseWriter.Write(p)
 	rec.Bytes += uint64(n)
 	return n, err
@@ -36,31 +117,118 @@ func (rec *LogRecord) Write(p []byte) (n int, err error) {
 
 func (rec *LogRecord) WriteHeader(status int) {
 	rec.Status = status
-	rec.ResponseWriter.WriteHeader(status)
+	if !rec.wroteHeader && rec.app != nil && rec.app.interceptError(status, rec.Header()) {
+		if rec.Header().Get("Content-Type") == "" {
+			rec.pending = true
+		} else {
+			rec.intercepted = true
+		}
+	}
+	rec.wroteHeader = true
+	if !rec.intercepted && !rec.pending {
+		rec.ResponseWriter.WriteHeader(status)
+	}
+}
+
+// sendPending sends an error status held back by WriteHeader, the handler
+// having written a body of its own.
+func (rec *LogRecord) sendPending() {
+	if rec.pending {
+		rec.pending = false
+		rec.ResponseWriter.WriteHeader(rec.Status)
+	}
 }
 
-type Formatter func(*LogRecord) string
+type writerOnly struct {
+	io.Writer
+}
 
-func CombinedFormat(rec *LogRecord) string {
-	return fmt.Sprintf(`%s - %s [%s] "%s" %d %d "%s" "%s"`,
-		rec.Host, rec.Indent, rec.RequestStarted.Format(ApacheTime),
-		rec.Request, rec.Status, rec.Bytes, rec.Referer, rec.UserAgent)
+// ReadFrom keeps io.Copy on the fast path of the underlying writer
+// (sendfile for plain TCP connections) while still counting bytes.
+func (rec *LogRecord) ReadFrom(src io.Reader) (n int64, err error) {
+	if rec.intercepted {
+		return io.Copy(io.Discard, src)
+	}
+	rec.sendPending()
+	rec.wroteHeader = true
+	if rf, ok := rec.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(writerOnly{rec.ResponseWriter}, src)
+	}
+	rec.Bytes += uint64(n)
+	return n, err
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (rec *LogRecord) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
 }
 
-func PerfFormat(rec *LogRecord) string {
-	return fmt.Sprintf(`%s - %s [%s] "%s" %d %d %dms`,
-		rec.Host, rec.Indent, rec.RequestStarted.Format(ApacheTime),
-		rec.Request, rec.Status, rec.Bytes,
-		rec.RequestCompleted.Sub(rec.RequestStarted).Nanoseconds()/1e6)
+// Clock tells the time to App. It can be replaced in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
 }
 
+// SystemClock is the Clock used by default.
+var SystemClock Clock = systemClock{}
+
 type App struct {
 	StackIn500 bool
 	StackInLog bool
 	Handler    http.HandlerFunc
+	Clock      Clock
+	Sessions   SessionStore
+
+	// VirtualHosts serve requests for their host name instead of
+	// Handler, see LogRecord.VirtualHost. Keys are compared like
+	// LogRecord.VirtualHost, without case, port or trailing dot. They are
+	// normalized on the first request, the map must not change after.
+	VirtualHosts map[string]http.HandlerFunc
+
+	// Auth authenticates every request, requests without valid
+	// credentials are rejected with 401 unless AuthOptional is set.
+	Auth         Authenticator
+	AuthOptional bool
+
+	// JSONErrors makes HandlePanic respond with a JSON error envelope
+	// instead of an HTML page.
+	JSONErrors bool
+
+	// ErrorPages replace the bodies of error responses, see SetErrorPage.
+	ErrorPages map[int]ErrorPage
+
+	// Health serves health check endpoints when set.
+	Health *Health
+
+	// Capture records full requests and responses for debugging when set.
+	Capture *Capture
+
+	// PoolRecords reuses LogRecords between requests. Receivers of
+	// records from Loggers and of ErrorEvent.Record must then call
+	// Release when they are done, and handlers must not keep the request
+	// or its record after they return.
+	PoolRecords bool
+
+	// ErrorTime controls the timestamps of messages sent to Errors.
+	ErrorTime FormatOptions
 
 	Errors  chan *string
+	Events  []chan *ErrorEvent
 	Loggers []chan *LogRecord
+
+	// Dispatchers receive logged requests along with Loggers.
+	Dispatchers []LogDispatcher
+
+	closers []io.Closer
+	flushes []chan chan struct{}
+	vhosts  *vhostIndex
 }
 
 func NewApp(h http.HandlerFunc, detailed_stacks bool) *App {
@@ -69,64 +237,270 @@ func NewApp(h http.HandlerFunc, detailed_stacks bool) *App {
 		StackInLog: detailed_stacks,
 		Handler:    h,
 		Loggers:    make([]chan *LogRecord, 0),
+		vhosts:     new(vhostIndex),
 	}
 	return app
 }
 
+func (app *App) now() time.Time {
+	if app.Clock != nil {
+		return app.Clock.Now()
+	}
+	return time.Now()
+}
+
+// requestClock returns the Clock of the App serving r.
+func requestClock(r *http.Request) Clock {
+	if rec := Record(r); rec != nil && rec.app != nil && rec.app.Clock != nil {
+		return rec.app.Clock
+	}
+	return SystemClock
+}
+
 func (app *App) HandlePanic(w http.ResponseWriter, r *http.Request) {
 	if e := recover(); e != nil {
-		w.WriteHeader(500)
-		if app.StackIn500 {
-			fmt.Fprintf(w, errorPageDetailed, e, Stack(2))
+		rec, isRec := w.(*LogRecord)
+		if isRec {
+			rec.panicked = true
+			if rec.intercepted || rec.pending {
+				// the intercepted error response was not sent, send the
+				// 500 in its place without interception
+				rec.intercepted, rec.pending = false, false
+				rec.Status = 500
+				rec.Header().Del("Content-Type")
+				rec.Header().Del("Content-Length")
+				w = &rawWriter{rec}
+			}
+		}
+		if app.JSONErrors {
+			apiErr := &APIError{Status: 500, Code: "internal_error", Message: http.StatusText(500)}
+			if app.StackIn500 {
+				apiErr.Details = map[string]string{"panic": fmt.Sprint(e), "stack": string(Stack(2))}
+			}
+			WriteError(w, r, apiErr)
+		} else if isRec && !app.StackIn500 && app.ErrorPages[500] != nil {
+			rec.Status = 500
+			app.writeErrorPage(rec, r)
+		} else if app.StackIn500 {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, errorPageDetailed, describePanic(e), html.EscapeString(string(Stack(2))))
 		} else {
+			w.WriteHeader(500)
 			fmt.Fprint(w, errorPageShort)
 		}
+		now := app.now()
 		if app.Errors != nil {
 			if app.StackInLog {
-				msg := fmt.Sprintf("[%s] [panic] %v [at %s]\n%s", time.Now().Format(ApacheTime), e, where(2), Stack(2))
+				msg := fmt.Sprintf("[%s] [panic] %v [at %s]\n%s", app.ErrorTime.Timestamp(now), e, where(2), Stack(2))
 				app.Errors <- &msg
 			} else {
-				msg := fmt.Sprintf("[%s] [panic] %v [at %s]", time.Now().Format(ApacheTime), e, where(2))
+				msg := fmt.Sprintf("[%s] [panic] %v [at %s]", app.ErrorTime.Timestamp(now), e, where(2))
 				app.Errors <- &msg
 			}
 		}
+		if len(app.Events) != 0 {
+			ev := &ErrorEvent{Kind: EventPanic, Time: now, Value: e, Where: where(2), Stack: Stack(2), Request: r}
+			if isRec {
+				ev.RequestID = rec.RequestID
+				ev.Record = rec
+				rec.retain(len(app.Events))
+			}
+			app.sendEvent(ev)
+		}
 	}
 }
 
 func (app App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	rec := &LogRecord{
+	var rec *LogRecord
+	if app.PoolRecords {
+		rec = recordPool.Get().(*LogRecord)
+	} else {
+		rec = new(LogRecord)
+	}
+	*rec = LogRecord{
 		ResponseWriter: w,
 		Indent:         "-",
-		RequestStarted: time.Now(),
+		User:           "-",
+		RequestStarted: app.now(),
 		// kind of cheating
 		Request:   r.Method + " " + r.RequestURI + " " + r.Proto,
 		Status:    http.StatusOK,
 		Bytes:     0,
 		Referer:   r.Referer(),
 		UserAgent: r.UserAgent(),
+		Session:   "-",
+		RequestID: requestID(r),
+		app:       &app,
+		pooled:    app.PoolRecords,
+		refs:      1,
 	}
+	rec.ctx = recordContext{r.Context(), rec}
+	w.Header().Set("X-Request-Id", rec.RequestID)
+	r = r.WithContext(&rec.ctx)
 
-	if n := strings.LastIndex(r.RemoteAddr, ":"); n != -1 {
-		rec.Host = r.RemoteAddr[:n]
-	} else {
-		rec.Host = r.RemoteAddr
+	rec.Host = remoteHost(r)
+	rec.VirtualHost = virtualHost(r)
+	if app.Capture != nil {
+		app.Capture.start(rec, r)
 	}
+	defer app.logRequest(rec)
 	defer app.HandlePanic(rec, r)
-	app.Handler(rec, r)
-	rec.RequestCompleted = time.Now()
+	switch {
+	case app.Health != nil && app.Health.serve(rec, r):
+		rec.skipLog = !app.Health.LogRequests
+	case app.Auth == nil || app.authenticate(rec, r):
+		if h := app.virtualHostHandler(rec.VirtualHost); h != nil {
+			h(rec, r)
+		} else {
+			app.Handler(rec, r)
+		}
+	}
+	if rec.intercepted || rec.pending {
+		rec.pending = false
+		app.writeErrorPage(rec, r)
+	}
+}
 
+// logRequest sends rec to the loggers once the request is complete,
+// including requests which panicked.
+func (app *App) logRequest(rec *LogRecord) {
+	defer rec.Release()
+	rec.RequestCompleted = app.now()
+	if rec.capture != nil {
+		app.Capture.finish(rec)
+	}
+	if rec.skipLog {
+		return
+	}
+	rec.retain(len(app.Loggers) + len(app.Dispatchers))
 	for _, logger := range app.Loggers {
 		logger <- rec
 	}
+	for _, d := range app.Dispatchers {
+		d.Dispatch(rec)
+	}
+}
+
+// remoteHost returns the client address of r without the port, and
+// without brackets for IPv6 like Apache and nginx log it.
+func remoteHost(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// virtualHost returns the lowercased host name requested by r, without
+// the port.
+func virtualHost(r *http.Request) string {
+	return normalizeHost(r.Host)
+}
+
+// normalizeHost drops the port and trailing dot of host and lowercases it.
+func normalizeHost(host string) string {
+	// SplitHostPort allocates an error for hosts without a port
+	if strings.IndexByte(host, ':') != -1 {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// vhostIndex holds VirtualHosts under normalized keys. It is made by
+// NewApp and shared by the copies of App which serve requests.
+type vhostIndex struct {
+	once  sync.Once
+	hosts map[string]http.HandlerFunc
+}
+
+// virtualHostHandler returns the handler of VirtualHosts for host, which
+// is normalized already.
+func (app *App) virtualHostHandler(host string) http.HandlerFunc {
+	if len(app.VirtualHosts) == 0 {
+		return nil
+	}
+	if app.vhosts == nil {
+		// not made by NewApp, only normalized keys match
+		return app.VirtualHosts[host]
+	}
+	app.vhosts.once.Do(func() {
+		app.vhosts.hosts = make(map[string]http.HandlerFunc, len(app.VirtualHosts))
+		for k, h := range app.VirtualHosts {
+			app.vhosts.hosts[normalizeHost(k)] = h
+		}
+	})
+	return app.vhosts.hosts[host]
+}
+
+// requestID returns the X-Request-Id of r if it looks sane, or a new
+// random ID.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" && len(id) <= 128 {
+		sane := true
+		for _, c := range id {
+			if c <= ' ' || c > '~' {
+				sane = false
+				break
+			}
+		}
+		if sane {
+			return id
+		}
+	}
+	var b [8]byte
+	var id [16]byte
+	rand.Read(b[:])
+	hex.Encode(id[:], b[:])
+	return string(id[:])
 }
 
 func (app *App) AddLogger(f Formatter, log *log.Logger) {
 	ch := make(chan *LogRecord, 1000)
 	app.Loggers = append(app.Loggers, ch)
+	app.serveRecords(ch, func(rec *LogRecord) {
+		log.Output(1, f(rec))
+		rec.Release()
+	})
+}
+
+// AddAppendLogger writes every record formatted by f to w, one per line,
+// without allocating. Writes are not synchronized with other users of w.
+func (app *App) AddAppendLogger(f AppendFormatter, w io.Writer) {
+	ch := make(chan *LogRecord, 1000)
+	app.Loggers = append(app.Loggers, ch)
+	b := make([]byte, 0, 512)
+	app.serveRecords(ch, func(rec *LogRecord) {
+		b = append(f(b[:0], rec), '\n')
+		rec.Release()
+		w.Write(b)
+	})
+}
+
+// addFlush registers the goroutine serving a queue of app for Shutdown,
+// which sends it a channel to close once everything queued before has
+// been handled.
+func (app *App) addFlush() chan chan struct{} {
+	flush := make(chan chan struct{})
+	app.flushes = append(app.flushes, flush)
+	return flush
+}
+
+// serveRecords calls handle for every record sent to ch from a new
+// goroutine, which Shutdown flushes.
+func (app *App) serveRecords(ch chan *LogRecord, handle func(*LogRecord)) {
+	flush := app.addFlush()
 	go func() {
 		for {
-			rec := <-ch
-			log.Print(f(rec))
+			select {
+			case rec := <-ch:
+				handle(rec)
+			case done := <-flush:
+				for len(ch) > 0 {
+					handle(<-ch)
+				}
+				close(done)
+			}
 		}
 	}()
 }
@@ -0,0 +1,353 @@
+package webapp
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock standing still at t.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.t
+}
+
+func TestPanicLogged(t *testing.T) {
+	logs := make(chan *LogRecord, 1)
+	app := NewApp(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}, false)
+	app.Loggers = append(app.Loggers, logs)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	select {
+	case rec := <-logs:
+		if rec.Status != 500 || rec.Bytes != uint64(len(errorPageShort)) || rec.RequestCompleted.Before(rec.RequestStarted) {
+			t.Errorf("logged status %d, %d bytes, completed %v", rec.Status, rec.Bytes, rec.RequestCompleted)
+		}
+	default:
+		t.Errorf("request which panicked was not logged")
+	}
+}
+
+func TestAppClock(t *testing.T) {
+	clock := &fakeClock{time.Date(2013, time.January, 2, 15, 4, 5, 0, time.UTC)}
+	key := []byte("secret")
+	app := NewApp(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			panic("boom")
+		}
+	}, false)
+	app.Clock = clock
+	app.Auth = &JWTAuth{Keys: [][]byte{key}}
+	app.ErrorTime = FormatOptions{Location: time.UTC}
+	logs := make(chan *LogRecord, 1)
+	app.Loggers = append(app.Loggers, logs)
+	errs := make(chan *string, 1)
+	app.Errors = errs
+
+	// the token expired long ago by the system clock, but not by the App's
+	token := signJWT("HS256", key, map[string]interface{}{"sub": "frank", "exp": clock.t.Add(time.Hour).Unix()})
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	rec := <-logs
+	if w.Code != 200 || rec.User != "frank" {
+		t.Errorf("request with a token valid by the App clock = %d, user %s", w.Code, rec.User)
+	}
+	if !rec.RequestStarted.Equal(clock.t) || !rec.RequestCompleted.Equal(clock.t) {
+		t.Errorf("request timed %v to %v, want the App clock", rec.RequestStarted, rec.RequestCompleted)
+	}
+
+	r = httptest.NewRequest("GET", "/panic", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	app.ServeHTTP(httptest.NewRecorder(), r)
+	<-logs
+	if msg := <-errs; !strings.HasPrefix(*msg, "[02/Jan/2013:15:04:05 +0000] [panic] boom") {
+		t.Errorf("error message %q, want the App clock time", *msg)
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe for use by a logger goroutine and
+// the test.
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestAddAppendLogger(t *testing.T) {
+	app := NewApp(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}, false)
+	app.PoolRecords = true
+	var out lockedBuffer
+	app.AddAppendLogger(AppendPerfFormat, &out)
+	for _, path := range []string{"/a", "/b"} {
+		app.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	deadline := time.Now().Add(time.Second)
+	for strings.Count(out.String(), "\n") < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"GET /a HTTP/1.1" 200 5 `) || !strings.Contains(lines[1], `"GET /b HTTP/1.1" 200 5 `) {
+		t.Errorf("logged %q", lines)
+	}
+}
+
+func TestPoolRecords(t *testing.T) {
+	app := NewApp(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			panic("boom")
+		}
+	}, false)
+	app.PoolRecords = true
+	logs := make(chan *LogRecord, 1)
+	app.Loggers = append(app.Loggers, logs)
+	events := make(chan *ErrorEvent, 1)
+	app.Events = append(app.Events, events)
+
+	app.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	rec := <-logs
+	if rec.Request != "GET / HTTP/1.1" || rec.refs != 1 {
+		t.Fatalf("logged record %q with %d references, want one held by the logger", rec.Request, rec.refs)
+	}
+	rec.Release()
+	if rec.Request != "" || rec.refs != 0 {
+		t.Errorf("released record %q with %d references, want it cleared", rec.Request, rec.refs)
+	}
+
+	// a record which panicked is held by the logger and the event handler
+	app.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/panic", nil))
+	rec = <-logs
+	ev := <-events
+	if ev.Record != rec || rec.refs != 2 {
+		t.Fatalf("event record %p, logged %p with %d references, want the same with 2", ev.Record, rec, rec.refs)
+	}
+	rec.Release()
+	if rec.Request != "GET /panic HTTP/1.1" {
+		t.Errorf("record cleared while the event handler holds it")
+	}
+	ev.Record.Release()
+	if rec.refs != 0 || rec.Request != "" {
+		t.Errorf("record not cleared by the last Release")
+	}
+
+	// records which are not pooled are left alone
+	rec = &LogRecord{Request: "GET / HTTP/1.1"}
+	rec.Release()
+	if rec.Request == "" {
+		t.Errorf("Release cleared a record which is not pooled")
+	}
+}
+
+func TestVirtualHosts(t *testing.T) {
+	app := NewApp(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("default"))
+	}, false)
+	app.VirtualHosts = map[string]http.HandlerFunc{
+		"shop.example.com": func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("shop")) },
+	}
+	logs := make(chan *LogRecord, 1)
+	app.Loggers = append(app.Loggers, logs)
+	for _, tc := range []struct {
+		host, vhost, body string
+	}{
+		{"shop.example.com", "shop.example.com", "shop"},
+		{"Shop.Example.COM:8080", "shop.example.com", "shop"},
+		{"shop.example.com.", "shop.example.com", "shop"},
+		{"[2001:db8::1]:443", "2001:db8::1", "default"},
+		{"other.example.com", "other.example.com", "default"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = tc.host
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		if rec := <-logs; rec.VirtualHost != tc.vhost || w.Body.String() != tc.body {
+			t.Errorf("Host %s: virtual host %q served by %q, want %q by %q", tc.host, rec.VirtualHost, w.Body, tc.vhost, tc.body)
+		}
+	}
+}
+
+// discardWriter is a ResponseWriter which keeps nothing, so that
+// benchmarks measure App and not httptest.ResponseRecorder.
+type discardWriter struct {
+	h http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.h }
+func (w *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+
+func benchRecord() *LogRecord {
+	t := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	return &LogRecord{
+		Host: "10.0.0.1", Indent: "-", User: "frank", Session: "-",
+		Request: "GET /index.html?q=1 HTTP/1.1", Status: 200, Bytes: 2326,
+		Referer: "http://example.com/start", UserAgent: "Mozilla/5.0 (X11; Linux x86_64)",
+		RequestStarted: t, RequestCompleted: t.Add(1250 * time.Microsecond),
+	}
+}
+
+func BenchmarkCombinedFormat(b *testing.B) {
+	rec := benchRecord()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		CombinedFormat(rec)
+	}
+}
+
+func BenchmarkAppendCombinedFormat(b *testing.B) {
+	rec := benchRecord()
+	buf := make([]byte, 0, 512)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = AppendCombinedFormat(buf[:0], rec)
+	}
+}
+
+// benchServe serves b.N requests through app. The loggers run on their own
+// goroutines, so their allocations are counted too.
+func benchServe(b *testing.B, app *App) {
+	w := &discardWriter{h: make(http.Header)}
+	r := httptest.NewRequest("GET", "/index.html?q=1", nil)
+	r.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64)")
+	r.Header.Set("Referer", "http://example.com/start")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		delete(w.h, "X-Request-Id")
+		app.ServeHTTP(w, r)
+	}
+}
+
+var hello = []byte("hello")
+
+func benchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write(hello)
+}
+
+func BenchmarkServeHTTP(b *testing.B) {
+	b.Run("Logger", func(b *testing.B) {
+		app := NewApp(benchHandler, false)
+		app.AddLogger(CombinedFormat, log.New(io.Discard, "", 0))
+		benchServe(b, app)
+	})
+	b.Run("AppendLogger", func(b *testing.B) {
+		app := NewApp(benchHandler, false)
+		app.AddAppendLogger(AppendCombinedFormat, io.Discard)
+		benchServe(b, app)
+	})
+	b.Run("AppendLoggerPooled", func(b *testing.B) {
+		app := NewApp(benchHandler, false)
+		app.PoolRecords = true
+		app.AddAppendLogger(AppendCombinedFormat, io.Discard)
+		benchServe(b, app)
+	})
+}
+
+func TestAppendCombinedMatchesCombined(t *testing.T) {
+	rec := benchRecord()
+	if got, want := string(AppendCombinedFormat(nil, rec)), CombinedFormat(rec); got != want {
+		t.Errorf("AppendCombinedFormat = %q, want %q", got, want)
+	}
+}
+
+// TestServeHTTPAllocs runs without loggers, which would make the reuse of
+// pooled records depend on scheduling.
+func TestServeHTTPAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocations differ under the race detector")
+	}
+	app := NewApp(benchHandler, false)
+	app.PoolRecords = true
+	w := &discardWriter{h: make(http.Header)}
+	r := httptest.NewRequest("GET", "/index.html?q=1", nil)
+	allocs := testing.AllocsPerRun(1000, func() {
+		delete(w.h, "X-Request-Id")
+		app.ServeHTTP(w, r)
+	})
+	// the request line, the request ID and its header, the request copy
+	// made by WithContext and the App copy of the value receiver
+	if allocs > 5 {
+		t.Errorf("ServeHTTP with pooled records: %v allocs per request, want at most 5", allocs)
+	}
+}
+
+func TestPanicAfterInterceptedStatus(t *testing.T) {
+	page, err := NewErrorPage(`<h1>{{.Status}} {{.StatusText}}</h1>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name  string
+		setup func(app *App)
+		body  string
+	}{
+		{"500 page", func(app *App) { app.SetErrorPage(500, page) }, "<h1>500 Internal Server Error</h1>"},
+		{"short page", func(app *App) {}, errorPageShort},
+		{"JSON", func(app *App) { app.JSONErrors = true }, `"internal_error"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			app := NewApp(func(w http.ResponseWriter, r *http.Request) {
+				http.NotFound(w, r)
+				panic("after 404")
+			}, false)
+			app.SetErrorPage(404, page)
+			tc.setup(app)
+			logged := make(chan *LogRecord, 1)
+			app.Loggers = append(app.Loggers, logged)
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/missing", nil)
+			r.Header.Set("Accept", "text/html")
+			app.ServeHTTP(w, r)
+			if w.Code != 500 {
+				t.Errorf("status = %d, want 500", w.Code)
+			}
+			if !strings.Contains(w.Body.String(), tc.body) {
+				t.Errorf("body = %q, want it to contain %q", w.Body.String(), tc.body)
+			}
+			if rec := <-logged; rec.Status != 500 || rec.Bytes != uint64(w.Body.Len()) {
+				t.Errorf("logged status %d and %d bytes, want 500 and %d", rec.Status, rec.Bytes, w.Body.Len())
+			}
+		})
+	}
+}
+
+func TestIPv6ClientAddress(t *testing.T) {
+	app := NewApp(benchHandler, false)
+	logged := make(chan *LogRecord, 1)
+	app.Loggers = append(app.Loggers, logged)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "[::1]:54321"
+	app.ServeHTTP(httptest.NewRecorder(), r)
+	rec := <-logged
+	if rec.Host != "::1" {
+		t.Errorf("Host = %q, want ::1", rec.Host)
+	}
+	if doc := ECSFormat(rec); !strings.Contains(doc, `"client":{"ip":"::1"}`) {
+		t.Errorf("ECS client.ip not a bare address: %s", doc)
+	}
+}
@@ -0,0 +1,499 @@
+package webapp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoSessionStore  = errors.New("webapp: no session store configured")
+	ErrNoSession       = errors.New("webapp: session not found")
+	ErrInvalidCookie   = errors.New("webapp: invalid session cookie")
+	ErrCookieTooLarge  = errors.New("webapp: session cookie is too large")
+	ErrNoSessionKeys   = errors.New("webapp: at least one session key is required")
+	ErrInvalidBlockKey = errors.New("webapp: session block key must be 16, 24 or 32 bytes long")
+)
+
+const maxCookieSize = 4096
+
+// SessionKey is a pair of keys protecting session cookies. Hash is the
+// HMAC-SHA256 key and is required. Block is optional and enables AES-GCM
+// encryption of the cookie contents.
+//
+// Stores accept several keys: the first one is used to issue new cookies,
+// all of them are tried when reading, which allows key rotation.
+type SessionKey struct {
+	Hash  []byte
+	Block []byte
+}
+
+// Session is a set of values associated with a client.
+type Session struct {
+	ID     string
+	Values map[string]interface{}
+	IsNew  bool
+
+	store SessionStore
+}
+
+func newSession(store SessionStore) *Session {
+	return &Session{
+		ID:     newSessionID(),
+		Values: make(map[string]interface{}),
+		IsNew:  true,
+		store:  store,
+	}
+}
+
+func (s *Session) Get(key string) interface{} {
+	return s.Values[key]
+}
+
+func (s *Session) Set(key string, value interface{}) {
+	s.Values[key] = value
+}
+
+func (s *Session) Delete(key string) {
+	delete(s.Values, key)
+}
+
+// Save stores the session and sets the session cookie. It must be called
+// before anything is written to the response body.
+func (s *Session) Save(w http.ResponseWriter, r *http.Request) error {
+	return s.store.Save(w, r, s)
+}
+
+// Destroy removes the session and expires the session cookie. The
+// session is left empty under a new ID, so saving it again starts a new
+// session rather than reviving the destroyed one.
+func (s *Session) Destroy(w http.ResponseWriter, r *http.Request) error {
+	return s.store.Destroy(w, r, s)
+}
+
+// Regenerate moves the session values to a new ID and saves the session,
+// removing the old one from server-side storage. Call it on login and
+// other privilege changes, so that a session ID planted in the client
+// before does not carry over.
+func (s *Session) Regenerate(w http.ResponseWriter, r *http.Request) error {
+	if ss, ok := s.store.(*ServerStore); ok {
+		if err := ss.Backend.Delete(s.ID); err != nil {
+			return err
+		}
+	}
+	s.ID = newSessionID()
+	s.IsNew = true
+	if rec := Record(r); rec != nil && rec.session == s {
+		rec.Session = HashSessionID(s.ID)
+	}
+	return s.Save(w, r)
+}
+
+// reset empties a destroyed session and gives it a new ID.
+func (s *Session) reset() {
+	s.ID = newSessionID()
+	s.Values = make(map[string]interface{})
+	s.IsNew = true
+}
+
+// SessionStore loads and saves sessions. Load returns a new session when
+// the request carries no valid session cookie.
+type SessionStore interface {
+	Load(r *http.Request) (*Session, error)
+	Save(w http.ResponseWriter, r *http.Request, s *Session) error
+	Destroy(w http.ResponseWriter, r *http.Request, s *Session) error
+}
+
+// GetSession returns the session of a request served by App, loading it
+// from App.Sessions on first use. The hashed session ID is recorded in the
+// Session field of the request LogRecord.
+func GetSession(r *http.Request) (*Session, error) {
+	rec := Record(r)
+	if rec == nil || rec.app == nil || rec.app.Sessions == nil {
+		return nil, ErrNoSessionStore
+	}
+	if rec.session == nil {
+		s, err := rec.app.Sessions.Load(r)
+		if err != nil {
+			return nil, err
+		}
+		rec.session = s
+		rec.Session = HashSessionID(s.ID)
+	}
+	return rec.session, nil
+}
+
+// HashSessionID returns a short digest of a session ID which is safe to
+// write to logs.
+func HashSessionID(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+func newSessionID() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// CookieOptions are the attributes of the session cookie.
+type CookieOptions struct {
+	Name     string
+	Path     string
+	Domain   string
+	MaxAge   time.Duration
+	Secure   bool
+	HttpOnly bool
+	SameSite http.SameSite
+}
+
+func defaultCookieOptions(name string) CookieOptions {
+	return CookieOptions{
+		Name:     name,
+		Path:     "/",
+		MaxAge:   30 * 24 * time.Hour,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func (o *CookieOptions) cookie(value string, expire bool) *http.Cookie {
+	c := &http.Cookie{
+		Name:     o.Name,
+		Value:    value,
+		Path:     o.Path,
+		Domain:   o.Domain,
+		Secure:   o.Secure,
+		HttpOnly: o.HttpOnly,
+		SameSite: o.SameSite,
+	}
+	if expire {
+		c.MaxAge = -1
+	} else if o.MaxAge > 0 {
+		c.MaxAge = int(o.MaxAge / time.Second)
+	}
+	return c
+}
+
+// codec signs and optionally encrypts cookie values.
+type codec struct {
+	keys  []SessionKey
+	aeads []cipher.AEAD
+}
+
+func newCodec(keys []SessionKey) (*codec, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoSessionKeys
+	}
+	c := &codec{keys: keys, aeads: make([]cipher.AEAD, len(keys))}
+	for i, k := range keys {
+		if len(k.Hash) == 0 {
+			return nil, ErrNoSessionKeys
+		}
+		if k.Block == nil {
+			continue
+		}
+		block, err := aes.NewCipher(k.Block)
+		if err != nil {
+			return nil, ErrInvalidBlockKey
+		}
+		c.aeads[i], err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func mac(key []byte, name string, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(name))
+	h.Write([]byte{'|'})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// encode produces base64(timestamp | data | hmac) with the first key, data
+// being nonce | ciphertext when encryption is enabled.
+func (c *codec) encode(name string, plain []byte, now time.Time) (string, error) {
+	buf := make([]byte, 8, 8+len(plain)+64)
+	binary.BigEndian.PutUint64(buf, uint64(now.Unix()))
+	if aead := c.aeads[0]; aead != nil {
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+		buf = append(buf, nonce...)
+		buf = aead.Seal(buf, nonce, plain, []byte(name))
+	} else {
+		buf = append(buf, plain...)
+	}
+	buf = append(buf, mac(c.keys[0].Hash, name, buf)...)
+	value := base64.RawURLEncoding.EncodeToString(buf)
+	if len(name)+len(value) > maxCookieSize {
+		return "", ErrCookieTooLarge
+	}
+	return value, nil
+}
+
+func (c *codec) decode(name, value string, maxAge time.Duration, now time.Time) ([]byte, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(buf) < 8+sha256.Size {
+		return nil, ErrInvalidCookie
+	}
+	data, sum := buf[:len(buf)-sha256.Size], buf[len(buf)-sha256.Size:]
+	for i, k := range c.keys {
+		if !hmac.Equal(sum, mac(k.Hash, name, data)) {
+			continue
+		}
+		ts := time.Unix(int64(binary.BigEndian.Uint64(data)), 0)
+		if maxAge > 0 && now.Sub(ts) > maxAge {
+			return nil, ErrInvalidCookie
+		}
+		data = data[8:]
+		aead := c.aeads[i]
+		if aead == nil {
+			return data, nil
+		}
+		if len(data) < aead.NonceSize() {
+			return nil, ErrInvalidCookie
+		}
+		plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(name))
+		if err != nil {
+			return nil, ErrInvalidCookie
+		}
+		return plain, nil
+	}
+	return nil, ErrInvalidCookie
+}
+
+type sessionData struct {
+	ID     string
+	Values map[string]interface{}
+}
+
+func encodeValues(d *sessionData) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(d); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeValues(b []byte) (*sessionData, error) {
+	d := &sessionData{}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(d); err != nil {
+		return nil, err
+	}
+	if d.Values == nil {
+		d.Values = make(map[string]interface{})
+	}
+	return d, nil
+}
+
+// CookieStore keeps the whole session in a signed and optionally
+// encrypted cookie. Values of custom types must be registered with
+// gob.Register.
+type CookieStore struct {
+	CookieOptions
+	codec *codec
+}
+
+func NewCookieStore(name string, keys ...SessionKey) (*CookieStore, error) {
+	c, err := newCodec(keys)
+	if err != nil {
+		return nil, err
+	}
+	return &CookieStore{CookieOptions: defaultCookieOptions(name), codec: c}, nil
+}
+
+func (cs *CookieStore) Load(r *http.Request) (*Session, error) {
+	c, err := r.Cookie(cs.Name)
+	if err != nil {
+		return newSession(cs), nil
+	}
+	plain, err := cs.codec.decode(cs.Name, c.Value, cs.MaxAge, requestClock(r).Now())
+	if err != nil {
+		return newSession(cs), nil
+	}
+	d, err := decodeValues(plain)
+	if err != nil {
+		return newSession(cs), nil
+	}
+	return &Session{ID: d.ID, Values: d.Values, store: cs}, nil
+}
+
+func (cs *CookieStore) Save(w http.ResponseWriter, r *http.Request, s *Session) error {
+	plain, err := encodeValues(&sessionData{ID: s.ID, Values: s.Values})
+	if err != nil {
+		return err
+	}
+	value, err := cs.codec.encode(cs.Name, plain, requestClock(r).Now())
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, cs.cookie(value, false))
+	s.IsNew = false
+	return nil
+}
+
+func (cs *CookieStore) Destroy(w http.ResponseWriter, r *http.Request, s *Session) error {
+	http.SetCookie(w, cs.cookie("", true))
+	s.reset()
+	return nil
+}
+
+// SessionBackend is a server-side storage for session values.
+// Get returns ErrNoSession for unknown or expired sessions.
+type SessionBackend interface {
+	Get(id string) (map[string]interface{}, error)
+	Put(id string, values map[string]interface{}, ttl time.Duration) error
+	Delete(id string) error
+}
+
+// ServerStore keeps session values in a SessionBackend, the cookie only
+// carries the signed session ID.
+type ServerStore struct {
+	CookieOptions
+	Backend SessionBackend
+	codec   *codec
+}
+
+func NewServerStore(name string, backend SessionBackend, keys ...SessionKey) (*ServerStore, error) {
+	c, err := newCodec(keys)
+	if err != nil {
+		return nil, err
+	}
+	return &ServerStore{CookieOptions: defaultCookieOptions(name), Backend: backend, codec: c}, nil
+}
+
+func (ss *ServerStore) Load(r *http.Request) (*Session, error) {
+	c, err := r.Cookie(ss.Name)
+	if err != nil {
+		return newSession(ss), nil
+	}
+	id, err := ss.codec.decode(ss.Name, c.Value, ss.MaxAge, requestClock(r).Now())
+	if err != nil {
+		return newSession(ss), nil
+	}
+	values, err := ss.Backend.Get(string(id))
+	if err == ErrNoSession {
+		return newSession(ss), nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &Session{ID: string(id), Values: values, store: ss}, nil
+}
+
+func (ss *ServerStore) Save(w http.ResponseWriter, r *http.Request, s *Session) error {
+	if err := ss.Backend.Put(s.ID, s.Values, ss.MaxAge); err != nil {
+		return err
+	}
+	value, err := ss.codec.encode(ss.Name, []byte(s.ID), requestClock(r).Now())
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, ss.cookie(value, false))
+	s.IsNew = false
+	return nil
+}
+
+func (ss *ServerStore) Destroy(w http.ResponseWriter, r *http.Request, s *Session) error {
+	http.SetCookie(w, ss.cookie("", true))
+	err := ss.Backend.Delete(s.ID)
+	s.reset()
+	return err
+}
+
+type memoryEntry struct {
+	values  map[string]interface{}
+	expires time.Time
+}
+
+// MemoryBackend is a SessionBackend keeping sessions in process memory.
+// Expiry is checked against Clock, the system clock by default. The zero
+// value is ready to use.
+type MemoryBackend struct {
+	Clock Clock
+
+	mu       sync.Mutex
+	sessions map[string]memoryEntry
+	puts     int
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{Clock: SystemClock, sessions: make(map[string]memoryEntry)}
+}
+
+func (m *MemoryBackend) now() time.Time {
+	if m.Clock != nil {
+		return m.Clock.Now()
+	}
+	return SystemClock.Now()
+}
+
+func copyValues(values map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		c[k] = v
+	}
+	return c
+}
+
+func (m *MemoryBackend) Get(id string) (map[string]interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.sessions[id]
+	if !ok {
+		return nil, ErrNoSession
+	}
+	if !e.expires.IsZero() && m.now().After(e.expires) {
+		delete(m.sessions, id)
+		return nil, ErrNoSession
+	}
+	return copyValues(e.values), nil
+}
+
+func (m *MemoryBackend) Put(id string, values map[string]interface{}, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := memoryEntry{values: copyValues(values)}
+	now := m.now()
+	if ttl > 0 {
+		e.expires = now.Add(ttl)
+	}
+	if m.sessions == nil {
+		m.sessions = make(map[string]memoryEntry)
+	}
+	m.sessions[id] = e
+	// sweep expired sessions every now and then
+	m.puts++
+	if m.puts%1000 == 0 {
+		for k, e := range m.sessions {
+			if !e.expires.IsZero() && now.After(e.expires) {
+				delete(m.sessions, k)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *MemoryBackend) Delete(id string) error {
+	m.mu.Lock()
+	delete(m.sessions, id)
+	m.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,320 @@
+package webapp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var (
+	hashKey  = bytes.Repeat([]byte{'h'}, 32)
+	blockKey = bytes.Repeat([]byte{'b'}, 16)
+)
+
+// withCookies returns a request carrying the cookies set on w.
+func withCookies(w *httptest.ResponseRecorder) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func TestCodec(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	plain := []byte("session data")
+	for _, tc := range []struct {
+		name string
+		key  SessionKey
+	}{
+		{"hmac", SessionKey{Hash: hashKey}},
+		{"aes-gcm", SessionKey{Hash: hashKey, Block: blockKey}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := newCodec([]SessionKey{tc.key})
+			if err != nil {
+				t.Fatal(err)
+			}
+			value, err := c.encode("sid", plain, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := c.decode("sid", value, time.Hour, now.Add(time.Minute))
+			if err != nil || !bytes.Equal(got, plain) {
+				t.Errorf("decode = %q, %v, want %q", got, err, plain)
+			}
+			if tc.key.Block != nil && bytes.Contains([]byte(value), []byte(base64.RawURLEncoding.EncodeToString(plain))) {
+				t.Errorf("encrypted value %q contains the plain text", value)
+			}
+			if _, err := c.decode("other", value, time.Hour, now); err != ErrInvalidCookie {
+				t.Errorf("decode under another name = %v, want ErrInvalidCookie", err)
+			}
+			if _, err := c.decode("sid", value, time.Hour, now.Add(2*time.Hour)); err != ErrInvalidCookie {
+				t.Errorf("decode after MaxAge = %v, want ErrInvalidCookie", err)
+			}
+			if _, err := c.decode("sid", value, 0, now.Add(1000*time.Hour)); err != nil {
+				t.Errorf("decode without MaxAge = %v", err)
+			}
+			buf, _ := base64.RawURLEncoding.DecodeString(value)
+			for _, i := range []int{0, 8, len(buf) / 2, len(buf) - 1} {
+				tampered := append([]byte(nil), buf...)
+				tampered[i] ^= 1
+				if _, err := c.decode("sid", base64.RawURLEncoding.EncodeToString(tampered), time.Hour, now); err != ErrInvalidCookie {
+					t.Errorf("decode with byte %d flipped = %v, want ErrInvalidCookie", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCodecKeyRotation(t *testing.T) {
+	now := time.Now()
+	oldKey := SessionKey{Hash: bytes.Repeat([]byte{'o'}, 32), Block: blockKey}
+	newKey := SessionKey{Hash: hashKey}
+	old, err := newCodec([]SessionKey{oldKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := newCodec([]SessionKey{newKey, oldKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := old.encode("sid", []byte("old"), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := rotated.decode("sid", value, 0, now); err != nil || string(got) != "old" {
+		t.Errorf("decode of an old cookie after rotation = %q, %v", got, err)
+	}
+	value, err = rotated.encode("sid", []byte("new"), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.decode("sid", value, 0, now); err != ErrInvalidCookie {
+		t.Errorf("old keys decode a cookie issued after rotation: %v", err)
+	}
+}
+
+func TestNewCodecErrors(t *testing.T) {
+	for _, keys := range [][]SessionKey{nil, {{}}, {{Hash: hashKey}, {Block: blockKey}}} {
+		if _, err := newCodec(keys); err != ErrNoSessionKeys {
+			t.Errorf("newCodec(%v) = %v, want ErrNoSessionKeys", keys, err)
+		}
+	}
+	if _, err := newCodec([]SessionKey{{Hash: hashKey, Block: []byte("short")}}); err != ErrInvalidBlockKey {
+		t.Errorf("newCodec with a short block key = %v, want ErrInvalidBlockKey", err)
+	}
+}
+
+func TestCookieStore(t *testing.T) {
+	cs, err := NewCookieStore("sid", SessionKey{Hash: hashKey, Block: blockKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := cs.Load(httptest.NewRequest("GET", "/", nil))
+	if err != nil || !s.IsNew {
+		t.Fatalf("Load without a cookie = %+v, %v, want a new session", s, err)
+	}
+	s.Set("user", "frank")
+	w := httptest.NewRecorder()
+	if err := s.Save(w, httptest.NewRequest("GET", "/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := cs.Load(withCookies(w))
+	if err != nil || loaded.IsNew || loaded.ID != s.ID || loaded.Get("user") != "frank" {
+		t.Errorf("Load = %+v, %v, want the saved session", loaded, err)
+	}
+
+	w = httptest.NewRecorder()
+	if err := loaded.Destroy(w, httptest.NewRequest("GET", "/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if c := w.Result().Cookies(); len(c) != 1 || c[0].MaxAge >= 0 {
+		t.Errorf("Destroy set cookies %v, want an expired one", c)
+	}
+}
+
+func TestServerStore(t *testing.T) {
+	backend := NewMemoryBackend()
+	ss, err := NewServerStore("sid", backend, SessionKey{Hash: hashKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := ss.Load(httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Set("cart", 3)
+	w := httptest.NewRecorder()
+	if err := s.Save(w, httptest.NewRequest("GET", "/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if c := w.Result().Cookies(); len(c) != 1 || bytes.Contains([]byte(c[0].Value), []byte("cart")) {
+		t.Errorf("cookies %v, want one carrying only the session ID", c)
+	}
+	r := withCookies(w)
+	loaded, err := ss.Load(r)
+	if err != nil || loaded.IsNew || loaded.ID != s.ID || loaded.Get("cart") != 3 {
+		t.Errorf("Load = %+v, %v, want the saved session", loaded, err)
+	}
+	// values changed after Load must not leak into the backend unsaved
+	loaded.Set("cart", 4)
+	if again, _ := ss.Load(r); again.Get("cart") != 3 {
+		t.Errorf("unsaved change visible in the backend: %v", again.Values)
+	}
+
+	if err := loaded.Destroy(httptest.NewRecorder(), r); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := ss.Load(r); !again.IsNew {
+		t.Errorf("Load after Destroy = %+v, want a new session", again)
+	}
+}
+
+func TestMemoryBackendExpiry(t *testing.T) {
+	clock := &fakeClock{time.Now()}
+	m := NewMemoryBackend()
+	m.Clock = clock
+	if err := m.Put("short", map[string]interface{}{}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Get("short"); err != nil {
+		t.Errorf("Get of a live session = %v", err)
+	}
+	clock.t = clock.t.Add(2 * time.Minute)
+	if _, err := m.Get("short"); err != ErrNoSession {
+		t.Errorf("Get of an expired session = %v, want ErrNoSession", err)
+	}
+}
+
+func TestSessionAppClock(t *testing.T) {
+	clock := &fakeClock{time.Now()}
+	cs, err := NewCookieStore("sid", SessionKey{Hash: hashKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs.MaxAge = time.Hour
+	app := NewApp(func(w http.ResponseWriter, r *http.Request) {
+		s, err := GetSession(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !s.IsNew {
+			w.Write([]byte("loaded"))
+			return
+		}
+		if err := s.Save(w, r); err != nil {
+			t.Fatal(err)
+		}
+	}, false)
+	app.Sessions = cs
+	app.Clock = clock
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	cookie := w.Result().Cookies()[0]
+	for _, tc := range []struct {
+		after time.Duration
+		body  string
+	}{
+		{time.Minute, "loaded"},
+		{2 * time.Hour, ""},
+	} {
+		clock.t = clock.t.Add(tc.after)
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		if w.Body.String() != tc.body {
+			t.Errorf("%v after Save: body %q, want %q", tc.after, w.Body, tc.body)
+		}
+	}
+}
+
+func TestMemoryBackendZeroValue(t *testing.T) {
+	var m MemoryBackend
+	if _, err := m.Get("missing"); err != ErrNoSession {
+		t.Errorf("Get on an empty backend = %v, want ErrNoSession", err)
+	}
+	if err := m.Put("id", map[string]interface{}{"user": "frank"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	values, err := m.Get("id")
+	if err != nil || values["user"] != "frank" {
+		t.Errorf("Get = %v, %v, want the stored session", values, err)
+	}
+	if err := m.Delete("id"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Get("id"); err != ErrNoSession {
+		t.Errorf("Get after Delete = %v, want ErrNoSession", err)
+	}
+}
+
+func TestSessionRegenerate(t *testing.T) {
+	cs, err := NewCookieStore("sid", SessionKey{Hash: hashKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := NewServerStore("sid", NewMemoryBackend(), SessionKey{Hash: hashKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, store := range []SessionStore{cs, ss} {
+		s, _ := store.Load(httptest.NewRequest("GET", "/", nil))
+		s.Set("cart", 3)
+		w := httptest.NewRecorder()
+		if err := s.Save(w, httptest.NewRequest("GET", "/", nil)); err != nil {
+			t.Fatal(err)
+		}
+		before := withCookies(w)
+		old, _ := store.Load(before)
+
+		w = httptest.NewRecorder()
+		if err := old.Regenerate(w, before); err != nil {
+			t.Fatal(err)
+		}
+		if old.ID == s.ID || old.IsNew {
+			t.Errorf("%T: Regenerate kept ID %q", store, old.ID)
+		}
+		loaded, err := store.Load(withCookies(w))
+		if err != nil || loaded.ID != old.ID || loaded.Get("cart") != 3 {
+			t.Errorf("%T: Load after Regenerate = %+v, %v, want the values under the new ID", store, loaded, err)
+		}
+		if store == SessionStore(ss) {
+			if again, _ := store.Load(before); !again.IsNew {
+				t.Errorf("old session ID still loads %+v", again)
+			}
+		}
+	}
+}
+
+func TestSessionDestroyDropsID(t *testing.T) {
+	ss, err := NewServerStore("sid", NewMemoryBackend(), SessionKey{Hash: hashKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := ss.Load(httptest.NewRequest("GET", "/", nil))
+	s.Set("user", "frank")
+	w := httptest.NewRecorder()
+	if err := s.Save(w, httptest.NewRequest("GET", "/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	r := withCookies(w)
+	id := s.ID
+	if err := s.Destroy(httptest.NewRecorder(), r); err != nil {
+		t.Fatal(err)
+	}
+	if s.ID == id || !s.IsNew || len(s.Values) != 0 {
+		t.Errorf("session after Destroy = %+v, want an empty one under a new ID", s)
+	}
+	// saving the destroyed session must not bring back the old ID
+	if err := s.Save(httptest.NewRecorder(), r); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := ss.Load(r); !again.IsNew {
+		t.Errorf("old cookie loads %+v after Destroy and Save", again)
+	}
+}
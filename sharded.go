@@ -0,0 +1,173 @@
+package webapp
+
+import (
+	"io"
+	mathrand "math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// LogDispatcher receives completed requests like the Loggers channels of
+// App, see App.AddDispatcher. Dispatch is called by concurrent requests
+// and should not block for long. Flush returns once the records
+// dispatched before have been written, so that App.Shutdown can close the
+// sinks after the last write.
+type LogDispatcher interface {
+	Dispatch(rec *LogRecord)
+	Flush()
+}
+
+// AddDispatcher sends every logged request to d.
+func (app *App) AddDispatcher(d LogDispatcher) {
+	app.Dispatchers = append(app.Dispatchers, d)
+}
+
+// ShardStats are the counters of a ShardedLogger. Blocked is the number of
+// records which found every shard queue full and had to wait.
+type ShardStats struct {
+	Records uint64
+	Blocked uint64
+	Queued  []int
+}
+
+// ShardedLogger spreads records over several queues, each served by its
+// own goroutine, so that logging does not serialize requests on a single
+// channel. Records of one shard are written in order, but records of
+// different shards may be written out of order relative to each other;
+// sort by timestamp if the order matters.
+//
+// Requests pick a shard at random, moving on to the next one when its
+// queue is full, so they share no counter. Every shard formats a batch of
+// records into its own buffer and writes it to w at once, holding a lock
+// so that lines are never interleaved, unless w is a BufferedFile, which
+// already makes every write whole.
+type ShardedLogger struct {
+	f      AppendFormatter
+	w      io.Writer
+	mu     *sync.Mutex
+	shards []*shard
+}
+
+// shard is padded to a cache line so that the counters of neighbouring
+// shards do not share one.
+type shard struct {
+	ch               chan *LogRecord
+	flush            chan chan struct{}
+	records, blocked uint64
+	_                [32]byte
+}
+
+// NewShardedLogger starts a logger with n shards of queue records each.
+// n <= 0 means runtime.GOMAXPROCS.
+func NewShardedLogger(f AppendFormatter, w io.Writer, n, queue int) *ShardedLogger {
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	if queue <= 0 {
+		queue = 1000
+	}
+	sl := &ShardedLogger{f: f, w: w, shards: make([]*shard, n)}
+	if _, ok := w.(*BufferedFile); !ok {
+		sl.mu = new(sync.Mutex)
+	}
+	for i := range sl.shards {
+		sh := &shard{ch: make(chan *LogRecord, queue), flush: make(chan chan struct{})}
+		sl.shards[i] = sh
+		go sl.serve(sh)
+	}
+	return sl
+}
+
+// AddShardedLogger is AddAppendLogger with a ShardedLogger.
+func (app *App) AddShardedLogger(f AppendFormatter, w io.Writer, n int) *ShardedLogger {
+	sl := NewShardedLogger(f, w, n, 0)
+	app.AddDispatcher(sl)
+	return sl
+}
+
+func (sl *ShardedLogger) Dispatch(rec *LogRecord) {
+	n := uint32(len(sl.shards))
+	i := mathrand.Uint32() % n
+	for try := uint32(0); try < n; try++ {
+		sh := sl.shards[(i+try)%n]
+		select {
+		case sh.ch <- rec:
+			atomic.AddUint64(&sh.records, 1)
+			return
+		default:
+		}
+	}
+	sh := sl.shards[i]
+	atomic.AddUint64(&sh.records, 1)
+	atomic.AddUint64(&sh.blocked, 1)
+	sh.ch <- rec
+}
+
+func (sl *ShardedLogger) serve(sh *shard) {
+	b := make([]byte, 0, 4096)
+	for {
+		select {
+		case rec := <-sh.ch:
+			b = sl.write(b[:0], sh.ch, rec)
+		case done := <-sh.flush:
+			for len(sh.ch) > 0 {
+				b = sl.write(b[:0], sh.ch, <-sh.ch)
+			}
+			close(done)
+		}
+	}
+}
+
+// write formats rec and whatever else is already queued on ch into b and
+// writes them to sl.w at once.
+func (sl *ShardedLogger) write(b []byte, ch chan *LogRecord, rec *LogRecord) []byte {
+	b = append(sl.f(b, rec), '\n')
+	rec.Release()
+	for more := true; more && len(b) < 64<<10; {
+		select {
+		case rec := <-ch:
+			b = append(sl.f(b, rec), '\n')
+			rec.Release()
+		default:
+			more = false
+		}
+	}
+	if sl.mu != nil {
+		sl.mu.Lock()
+		defer sl.mu.Unlock()
+	}
+	sl.w.Write(b)
+	return b
+}
+
+func (sl *ShardedLogger) Flush() {
+	flushes := make([]chan chan struct{}, len(sl.shards))
+	for i, sh := range sl.shards {
+		flushes[i] = sh.flush
+	}
+	flushAll(flushes)
+}
+
+// flushAll asks every goroutine of flushes to write its queue and waits
+// until they all have.
+func flushAll(flushes []chan chan struct{}) {
+	done := make([]chan struct{}, len(flushes))
+	for i, flush := range flushes {
+		done[i] = make(chan struct{})
+		flush <- done[i]
+	}
+	for _, d := range done {
+		<-d
+	}
+}
+
+func (sl *ShardedLogger) Stats() ShardStats {
+	st := ShardStats{Queued: make([]int, len(sl.shards))}
+	for i, sh := range sl.shards {
+		st.Records += atomic.LoadUint64(&sh.records)
+		st.Blocked += atomic.LoadUint64(&sh.blocked)
+		st.Queued[i] = len(sh.ch)
+	}
+	return st
+}
@@ -0,0 +1,156 @@
+package webapp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gateWriter blocks writes until open is closed.
+type gateWriter struct {
+	open chan struct{}
+	out  lockedBuffer
+}
+
+func (w *gateWriter) Write(p []byte) (int, error) {
+	<-w.open
+	return w.out.Write(p)
+}
+
+func TestShardedLogger(t *testing.T) {
+	w := &gateWriter{open: make(chan struct{})}
+	sl := NewShardedLogger(AppendPerfFormat, w, 2, 1)
+	const n = 20
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < n; i++ {
+			rec := formatRecord()
+			rec.Status = 200 + i
+			sl.Dispatch(rec)
+		}
+		close(done)
+	}()
+	// with the writer stuck and queues of one, Dispatch has to wait
+	deadline := time.Now().Add(time.Second)
+	for sl.Stats().Blocked == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	st := sl.Stats()
+	queued := 0
+	for _, n := range st.Queued {
+		queued += n
+	}
+	if st.Blocked == 0 || len(st.Queued) != 2 || queued == 0 {
+		t.Errorf("stats with a stuck writer = %+v", st)
+	}
+	close(w.open)
+	<-done
+	sl.Flush()
+	if got := strings.Count(w.out.String(), "\n"); got != n {
+		t.Fatalf("%d lines written after Flush, want %d", got, n)
+	}
+	if st := sl.Stats(); st.Records != n {
+		t.Errorf("counted %d records, want %d", st.Records, n)
+	}
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSuffix(w.out.String(), "\n"), "\n") {
+		if !strings.HasPrefix(line, "192.0.2.1 - frank [") || !strings.HasSuffix(line, " 1234 42ms") {
+			t.Errorf("line %q is not a whole record", line)
+		}
+		seen[line] = true
+	}
+	if len(seen) != n {
+		t.Errorf("%d distinct lines, want %d", len(seen), n)
+	}
+}
+
+func TestAddShardedLogger(t *testing.T) {
+	app := NewApp(func(w http.ResponseWriter, r *http.Request) {}, false)
+	app.PoolRecords = true
+	var out lockedBuffer
+	app.AddShardedLogger(AppendCombinedFormat, &out, 0)
+	for i := 0; i < 10; i++ {
+		app.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := app.Shutdown(ctx, &http.Server{}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(out.String(), `"GET / HTTP/1.1" 200 0`); n != 10 {
+		t.Errorf("%d requests logged by Shutdown, want 10", n)
+	}
+}
+
+// BenchmarkDispatchParallel serves requests from every P into a single
+// logger channel and into a ShardedLogger, writing to a BufferedFile.
+func BenchmarkDispatchParallel(b *testing.B) {
+	for _, procs := range []int{1, 2, 4, 8, 16} {
+		for _, sharded := range []bool{false, true} {
+			name := fmt.Sprintf("AppendLogger/procs=%d", procs)
+			if sharded {
+				name = fmt.Sprintf("ShardedLogger/procs=%d", procs)
+			}
+			b.Run(name, func(b *testing.B) {
+				defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+				bf, err := OpenBufferedFile(filepath.Join(b.TempDir(), "access.log"), BufferOptions{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer bf.Close()
+				app := NewApp(benchHandler, false)
+				app.PoolRecords = true
+				if sharded {
+					app.AddShardedLogger(AppendCombinedFormat, bf, 0)
+				} else {
+					app.AddAppendLogger(AppendCombinedFormat, bf)
+				}
+				b.ReportAllocs()
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					w := &discardWriter{h: make(http.Header)}
+					r := httptest.NewRequest("GET", "/index.html?q=1", nil)
+					for pb.Next() {
+						delete(w.h, "X-Request-Id")
+						app.ServeHTTP(w, r)
+					}
+				})
+				app.flush()
+			})
+		}
+	}
+}
+
+func TestShardedLoggerWritesAll(t *testing.T) {
+	const n = 2000
+	var out countWriter
+	sl := NewShardedLogger(AppendCombinedFormat, &out, 4, 8)
+	for i := 0; i < n; i++ {
+		sl.Dispatch(benchRecord())
+	}
+	sl.Flush()
+	st := sl.Stats()
+	if out.lines != n || st.Records != n {
+		t.Errorf("wrote %d lines and counted %d records, want %d", out.lines, st.Records, n)
+	}
+}
+
+// countWriter counts lines, relying on ShardedLogger to serialize writes.
+type countWriter struct {
+	lines int
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	for _, c := range p {
+		if c == '\n' {
+			w.lines++
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,215 @@
+package webapp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var fingerprinted = regexp.MustCompile(`[.-][0-9a-fA-F]{8,}\.[^./]+$`)
+
+// Fingerprinted reports whether a file name contains a content hash, like
+// "app.3f2a9c1d.js" or "style-0a1b2c3d4e.css".
+func Fingerprinted(name string) bool {
+	return fingerprinted.MatchString(path.Base(name))
+}
+
+// FileServer serves files from an fs.FS, including embed.FS.
+//
+// Files get an ETag and, when the file system provides modification
+// times, a Last-Modified header. If the client accepts gzip and a
+// "name.gz" file exists next to "name", the compressed variant is sent.
+// Files for which Immutable returns true are cached forever, other files
+// are cached for MaxAge or revalidated on each request when MaxAge is 0.
+// Files and directories whose name starts with a dot, like .git or .env,
+// are neither served nor listed unless Dotfiles is set.
+type FileServer struct {
+	FS        fs.FS
+	Index     string
+	Listing   bool
+	Dotfiles  bool
+	MaxAge    time.Duration
+	Immutable func(name string) bool
+
+	etags sync.Map
+}
+
+func NewFileServer(fsys fs.FS) *FileServer {
+	return &FileServer{
+		FS:        fsys,
+		Index:     "index.html",
+		Immutable: Fingerprinted,
+	}
+}
+
+func (fsrv *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		name = "."
+	}
+	if !fsrv.Dotfiles && isDotfile(name) {
+		http.NotFound(w, r)
+		return
+	}
+	info, err := fs.Stat(fsrv.FS, name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if info.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, path.Base(r.URL.Path)+"/", http.StatusMovedPermanently)
+			return
+		}
+		if fsrv.Index != "" {
+			index := path.Join(name, fsrv.Index)
+			if info, err := fs.Stat(fsrv.FS, index); err == nil && !info.IsDir() {
+				fsrv.serveFile(w, r, index, info)
+				return
+			}
+		}
+		if !fsrv.Listing {
+			http.NotFound(w, r)
+			return
+		}
+		fsrv.serveDir(w, r, name)
+		return
+	}
+	fsrv.serveFile(w, r, name, info)
+}
+
+// isDotfile reports whether an element of a cleaned path starts with a
+// dot.
+func isDotfile(name string) bool {
+	for _, elem := range strings.Split(name, "/") {
+		if len(elem) > 1 && elem[0] == '.' {
+			return true
+		}
+	}
+	return false
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(enc, ";")
+		if strings.TrimSpace(coding) != "gzip" {
+			continue
+		}
+		q := strings.ReplaceAll(params, " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+	return false
+}
+
+func (fsrv *FileServer) serveFile(w http.ResponseWriter, r *http.Request, name string, info fs.FileInfo) {
+	h := w.Header()
+	served := name
+	if gzInfo, err := fs.Stat(fsrv.FS, name+".gz"); err == nil && !gzInfo.IsDir() {
+		h.Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r) {
+			served, info = name+".gz", gzInfo
+			h.Set("Content-Encoding", "gzip")
+		}
+	}
+	f, err := fsrv.FS.Open(served)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		content = bytes.NewReader(data)
+	}
+
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		h.Set("Content-Type", ctype)
+	}
+	if etag, err := fsrv.etag(served, info, content); err == nil {
+		h.Set("ETag", etag)
+	}
+	switch {
+	case fsrv.Immutable != nil && fsrv.Immutable(name):
+		h.Set("Cache-Control", "public, max-age=31536000, immutable")
+	case fsrv.MaxAge > 0:
+		h.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(fsrv.MaxAge/time.Second)))
+	default:
+		h.Set("Cache-Control", "no-cache")
+	}
+	http.ServeContent(w, r, name, info.ModTime(), content)
+}
+
+type etagEntry struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+// etag returns a validator based on size and modification time, or on a
+// content hash for file systems without modification times (embed.FS).
+// Hashes are cached by name, size and modification time.
+func (fsrv *FileServer) etag(name string, info fs.FileInfo, content io.ReadSeeker) (string, error) {
+	if !info.ModTime().IsZero() {
+		return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()), nil
+	}
+	if e, ok := fsrv.etags.Load(name); ok {
+		if e := e.(etagEntry); e.size == info.Size() && e.modTime.Equal(info.ModTime()) {
+			return e.etag, nil
+		}
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, content); err != nil {
+		return "", err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	etag := `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+	fsrv.etags.Store(name, etagEntry{size: info.Size(), modTime: info.ModTime(), etag: etag})
+	return etag, nil
+}
+
+func (fsrv *FileServer) serveDir(w http.ResponseWriter, r *http.Request, name string) {
+	entries, err := fs.ReadDir(fsrv.FS, name)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprintf(w, "<html><body><h1>Index of /%s</h1><ul>\n", html.EscapeString(strings.TrimPrefix(name, ".")))
+	for _, e := range entries {
+		n := e.Name()
+		if !fsrv.Dotfiles && strings.HasPrefix(n, ".") {
+			continue
+		}
+		if e.IsDir() {
+			n += "/"
+		}
+		link := url.URL{Path: n}
+		fmt.Fprintf(w, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(link.String()), html.EscapeString(n))
+	}
+	fmt.Fprint(w, "</ul></body></html>")
+}
@@ -0,0 +1,209 @@
+package webapp
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func serveFile(fsrv http.Handler, path string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	fsrv.ServeHTTP(w, r)
+	return w
+}
+
+func TestFileServerETag(t *testing.T) {
+	modTime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name    string
+		modTime time.Time
+	}{
+		{"hash", time.Time{}},
+		{"modtime", modTime},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fsrv := NewFileServer(fstest.MapFS{"app.js": {Data: []byte("alert(1)"), ModTime: tc.modTime}})
+			w := serveFile(fsrv, "/app.js")
+			etag := w.Header().Get("ETag")
+			if w.Code != 200 || etag == "" || w.Body.String() != "alert(1)" {
+				t.Fatalf("GET = %d, ETag %q, body %q", w.Code, etag, w.Body)
+			}
+			if tc.modTime.IsZero() != (w.Header().Get("Last-Modified") == "") {
+				t.Errorf("Last-Modified = %q", w.Header().Get("Last-Modified"))
+			}
+			if again := serveFile(fsrv, "/app.js").Header().Get("ETag"); again != etag {
+				t.Errorf("ETag changed from %s to %s", etag, again)
+			}
+			w = serveFile(fsrv, "/app.js", "If-None-Match", etag)
+			if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+				t.Errorf("GET with If-None-Match = %d, body %q, want 304", w.Code, w.Body)
+			}
+			if w := serveFile(fsrv, "/app.js", "If-None-Match", `"other"`); w.Code != 200 {
+				t.Errorf("GET with a stale If-None-Match = %d, want 200", w.Code)
+			}
+
+			fsrv.FS.(fstest.MapFS)["app.js"].Data = []byte("alert(42)")
+			if changed := serveFile(fsrv, "/app.js").Header().Get("ETag"); changed == etag {
+				t.Errorf("ETag %s unchanged after the file changed", etag)
+			}
+		})
+	}
+}
+
+func TestFileServerGzip(t *testing.T) {
+	fsrv := NewFileServer(fstest.MapFS{
+		"app.js":    {Data: []byte("plain")},
+		"app.js.gz": {Data: []byte("compressed")},
+		"other.js":  {Data: []byte("other")},
+	})
+	for _, tc := range []struct {
+		path, accept string
+		body         string
+		encoding     string
+		vary         bool
+	}{
+		{"/app.js", "gzip, deflate", "compressed", "gzip", true},
+		{"/app.js", "deflate, gzip;q=0.5", "compressed", "gzip", true},
+		{"/app.js", "gzip;q=0", "plain", "", true},
+		{"/app.js", "", "plain", "", true},
+		{"/other.js", "gzip", "other", "", false},
+	} {
+		w := serveFile(fsrv, tc.path, "Accept-Encoding", tc.accept)
+		if w.Body.String() != tc.body || w.Header().Get("Content-Encoding") != tc.encoding {
+			t.Errorf("GET %s with Accept-Encoding %q = %q, encoding %q, want %q, %q",
+				tc.path, tc.accept, w.Body, w.Header().Get("Content-Encoding"), tc.body, tc.encoding)
+		}
+		if vary := w.Header().Get("Vary") == "Accept-Encoding"; vary != tc.vary {
+			t.Errorf("GET %s: Vary = %q", tc.path, w.Header().Get("Vary"))
+		}
+		if ctype := w.Header().Get("Content-Type"); !strings.HasPrefix(ctype, "text/javascript") {
+			t.Errorf("GET %s: Content-Type = %q, want the type of the uncompressed file", tc.path, ctype)
+		}
+	}
+	// the variants differ, so do their validators
+	plain := serveFile(fsrv, "/app.js").Header().Get("ETag")
+	gz := serveFile(fsrv, "/app.js", "Accept-Encoding", "gzip").Header().Get("ETag")
+	if plain == gz {
+		t.Errorf("plain and gzip variants share the ETag %s", plain)
+	}
+}
+
+func TestFileServerCacheControl(t *testing.T) {
+	fsys := fstest.MapFS{
+		"app.3f2a9c1d.js": {Data: []byte("a")},
+		"style.css":       {Data: []byte("b")},
+	}
+	fsrv := NewFileServer(fsys)
+	if cc := serveFile(fsrv, "/app.3f2a9c1d.js").Header().Get("Cache-Control"); cc != "public, max-age=31536000, immutable" {
+		t.Errorf("fingerprinted file Cache-Control = %q", cc)
+	}
+	if cc := serveFile(fsrv, "/style.css").Header().Get("Cache-Control"); cc != "no-cache" {
+		t.Errorf("Cache-Control without MaxAge = %q, want no-cache", cc)
+	}
+	fsrv.MaxAge = time.Hour
+	if cc := serveFile(fsrv, "/style.css").Header().Get("Cache-Control"); cc != "public, max-age=3600" {
+		t.Errorf("Cache-Control with MaxAge = %q", cc)
+	}
+	for name, want := range map[string]bool{
+		"app.3f2a9c1d.js":      true,
+		"style-0a1b2c3d4e.css": true,
+		"app.js":               false,
+		"v1.2.3.js":            false,
+	} {
+		if got := Fingerprinted(name); got != want {
+			t.Errorf("Fingerprinted(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestFileServerDirectories(t *testing.T) {
+	fsrv := NewFileServer(fstest.MapFS{
+		"docs/index.html": {Data: []byte("<h1>docs</h1>")},
+		"files/a&b.txt":   {Data: []byte("a")},
+		"files/sub/c.txt": {Data: []byte("c")},
+	})
+	if w := serveFile(fsrv, "/docs"); w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/docs/" {
+		t.Errorf("GET /docs = %d to %q, want a redirect to /docs/", w.Code, w.Header().Get("Location"))
+	}
+	if w := serveFile(fsrv, "/docs/"); w.Body.String() != "<h1>docs</h1>" {
+		t.Errorf("GET /docs/ = %q, want the index", w.Body)
+	}
+	if w := serveFile(fsrv, "/files/"); w.Code != http.StatusNotFound {
+		t.Errorf("GET /files/ without Listing = %d, want 404", w.Code)
+	}
+	fsrv.Listing = true
+	w := serveFile(fsrv, "/files/")
+	body := w.Body.String()
+	if w.Code != 200 || !strings.Contains(body, `<a href="a&amp;b.txt">a&amp;b.txt</a>`) || !strings.Contains(body, `<a href="sub/">sub/</a>`) {
+		t.Errorf("listing = %d:\n%s", w.Code, body)
+	}
+	if w := serveFile(fsrv, "/../files/a&b.txt"); w.Body.String() != "a" {
+		t.Errorf("GET of a path with .. = %q", w.Body)
+	}
+	w = httptest.NewRecorder()
+	fsrv.ServeHTTP(w, httptest.NewRequest("POST", "/files/a&b.txt", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, HEAD" {
+		t.Errorf("POST = %d, Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+}
+
+func TestFileServerCountsSentBytes(t *testing.T) {
+	dir := t.TempDir()
+	data := strings.Repeat("0123456789", 100000)
+	if err := os.WriteFile(filepath.Join(dir, "big.txt"), []byte(data), 0666); err != nil {
+		t.Fatal(err)
+	}
+	logs := make(chan *LogRecord, 1)
+	app := NewApp(NewFileServer(os.DirFS(dir)).ServeHTTP, false)
+	app.Loggers = append(app.Loggers, logs)
+	srv := httptest.NewServer(app)
+	defer srv.Close()
+	res, err := http.Get(srv.URL + "/big.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	if rec := <-logs; n != int64(len(data)) || rec.Bytes != uint64(n) {
+		t.Errorf("received %d bytes, logged %d, want %d", n, rec.Bytes, len(data))
+	}
+}
+
+func TestFileServerDotfiles(t *testing.T) {
+	fsrv := NewFileServer(fstest.MapFS{
+		".env":             {Data: []byte("SECRET=1")},
+		".git/config":      {Data: []byte("[core]")},
+		"public/.htaccess": {Data: []byte("deny")},
+		"public/app.js":    {Data: []byte("alert(1)")},
+	})
+	fsrv.Listing = true
+	for _, path := range []string{"/.env", "/.git/config", "/.git/", "/public/.htaccess", "/public/../.env"} {
+		if w := serveFile(fsrv, path); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want 404", path, w.Code)
+		}
+	}
+	if w := serveFile(fsrv, "/public/"); strings.Contains(w.Body.String(), ".htaccess") || !strings.Contains(w.Body.String(), "app.js") {
+		t.Errorf("listing shows dotfiles:\n%s", w.Body)
+	}
+	if w := serveFile(fsrv, "/"); strings.Contains(w.Body.String(), ".env") {
+		t.Errorf("listing shows dotfiles:\n%s", w.Body)
+	}
+
+	fsrv.Dotfiles = true
+	if w := serveFile(fsrv, "/.env"); w.Code != 200 || w.Body.String() != "SECRET=1" {
+		t.Errorf("GET /.env with Dotfiles = %d %q", w.Code, w.Body)
+	}
+	if w := serveFile(fsrv, "/public/"); !strings.Contains(w.Body.String(), ".htaccess") {
+		t.Errorf("listing with Dotfiles hides .htaccess:\n%s", w.Body)
+	}
+}
@@ -0,0 +1,243 @@
+package webapp
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TemplateError is raised by Templates.Render when a template fails to
+// parse or execute. HandlePanic shows the template name, line and the
+// source around it on the detailed error page.
+type TemplateError struct {
+	Name   string
+	Line   int
+	Source []string // lines Line-2 to Line+2, when available
+	Err    error
+}
+
+func (e *TemplateError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("template %s, line %d: %v", e.Name, e.Line, e.Err)
+	}
+	return fmt.Sprintf("template %s: %v", e.Name, e.Err)
+}
+
+func (e *TemplateError) Unwrap() error {
+	return e.Err
+}
+
+var templateErrorLocation = regexp.MustCompile(`template: ?([^:\s]+):(\d+)`)
+
+// Templates renders html/template pages from an fs.FS. Every file matching
+// Pages is parsed together with all Layouts and Partials. If the page set
+// contains a template named Layout, it is executed, otherwise the page
+// itself is. A typical page defines a "content" block used by the layout.
+//
+// With Reload set, the files are checked for changes on every render and
+// reparsed when needed, which is meant for development. Otherwise Load
+// must be called once on startup and the parsed templates are reused.
+type Templates struct {
+	FS       fs.FS
+	Layouts  string
+	Partials string
+	Pages    string
+	Layout   string
+	Funcs    template.FuncMap
+	Reload   bool
+
+	mu      sync.RWMutex
+	pages   map[string]*template.Template
+	files   map[string]string // template name -> file path
+	modTime map[string]time.Time
+}
+
+func NewTemplates(fsys fs.FS, reload bool) *Templates {
+	return &Templates{
+		FS:       fsys,
+		Layouts:  "layouts/*.html",
+		Partials: "partials/*.html",
+		Pages:    "pages/*.html",
+		Layout:   "layout",
+		Reload:   reload,
+	}
+}
+
+func (t *Templates) glob(pattern string) ([]string, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return fs.Glob(t.FS, pattern)
+}
+
+// scan returns the modification times of all template files.
+func (t *Templates) scan() (shared, pages []string, mod map[string]time.Time, err error) {
+	layouts, err := t.glob(t.Layouts)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	partials, err := t.glob(t.Partials)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	pages, err = t.glob(t.Pages)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	shared = append(layouts, partials...)
+	mod = make(map[string]time.Time)
+	for _, name := range append(shared, pages...) {
+		info, err := fs.Stat(t.FS, name)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		mod[name] = info.ModTime()
+	}
+	return shared, pages, mod, nil
+}
+
+// Load parses all templates. Parse errors are returned as *TemplateError.
+func (t *Templates) Load() error {
+	shared, pages, mod, err := t.scan()
+	if err != nil {
+		return err
+	}
+	files := make(map[string]string)
+	for name := range mod {
+		files[path.Base(name)] = name
+	}
+	parsed := make(map[string]*template.Template)
+	for _, page := range pages {
+		name := path.Base(page)
+		tmpl := template.New(name).Funcs(t.Funcs)
+		if _, err := tmpl.ParseFS(t.FS, append(shared, page)...); err != nil {
+			return t.wrapError(files, name, err)
+		}
+		parsed[name] = tmpl
+	}
+	t.mu.Lock()
+	t.pages, t.files, t.modTime = parsed, files, mod
+	t.mu.Unlock()
+	return nil
+}
+
+func (t *Templates) changed() bool {
+	_, _, mod, err := t.scan()
+	if err != nil {
+		return true
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.pages == nil || len(mod) != len(t.modTime) {
+		return true
+	}
+	for name, mtime := range mod {
+		if old, ok := t.modTime[name]; !ok || !old.Equal(mtime) {
+			return true
+		}
+	}
+	return false
+}
+
+// Execute renders page name into w. Output is buffered, so nothing is
+// written if execution fails.
+func (t *Templates) Execute(w io.Writer, name string, data interface{}) error {
+	if t.Reload && t.changed() {
+		if err := t.Load(); err != nil {
+			return err
+		}
+	}
+	t.mu.RLock()
+	tmpl, files := t.pages[name], t.files
+	t.mu.RUnlock()
+	if tmpl == nil {
+		return &TemplateError{Name: name, Err: fmt.Errorf("no such page")}
+	}
+	entry := name
+	if t.Layout != "" && tmpl.Lookup(t.Layout) != nil {
+		entry = t.Layout
+	}
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, entry, data); err != nil {
+		return t.wrapError(files, name, err)
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// Render writes page name as an HTML response. Template errors panic with
+// *TemplateError to be reported by App.HandlePanic.
+func (t *Templates) Render(w http.ResponseWriter, name string, data interface{}) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, name, data); err != nil {
+		if _, ok := err.(*TemplateError); !ok {
+			err = &TemplateError{Name: name, Err: err}
+		}
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+// wrapError locates the template and line mentioned in a text/template or
+// html/template error message.
+func (t *Templates) wrapError(files map[string]string, name string, err error) error {
+	te := &TemplateError{Name: name, Err: err}
+	m := templateErrorLocation.FindStringSubmatch(err.Error())
+	if m == nil {
+		return te
+	}
+	te.Name = m[1]
+	te.Line, _ = strconv.Atoi(m[2])
+	if file, ok := files[te.Name]; ok {
+		if data, err := fs.ReadFile(t.FS, file); err == nil {
+			lines := strings.Split(string(data), "\n")
+			from, to := te.Line-3, te.Line+2
+			if from < 0 {
+				from = 0
+			}
+			if to > len(lines) {
+				to = len(lines)
+			}
+			if from < to {
+				te.Source = lines[from:to]
+			}
+		}
+	}
+	return te
+}
+
+// describePanic returns the HTML description of a panic value for the
+// detailed error page.
+func describePanic(e interface{}) string {
+	te, ok := e.(*TemplateError)
+	if !ok || len(te.Source) == 0 {
+		return template.HTMLEscapeString(fmt.Sprint(e))
+	}
+	var buf bytes.Buffer
+	buf.WriteString(template.HTMLEscapeString(te.Error()))
+	buf.WriteString("<pre>")
+	first := te.Line - 2
+	if first < 1 {
+		first = 1
+	}
+	for i, line := range te.Source {
+		n := first + i
+		if n == te.Line {
+			fmt.Fprintf(&buf, "<b>%4d: %s</b>\n", n, template.HTMLEscapeString(line))
+		} else {
+			fmt.Fprintf(&buf, "%4d: %s\n", n, template.HTMLEscapeString(line))
+		}
+	}
+	buf.WriteString("</pre>")
+	return buf.String()
+}
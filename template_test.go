@@ -0,0 +1,101 @@
+package webapp
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func templateFS() fstest.MapFS {
+	return fstest.MapFS{
+		"layouts/base.html":  {Data: []byte(`{{define "layout"}}<title>{{.Title}}</title>{{template "content" .}}{{end}}`)},
+		"partials/item.html": {Data: []byte(`{{define "item"}}<li>{{.}}</li>{{end}}`)},
+		"pages/list.html":    {Data: []byte(`{{define "content"}}<ul>{{range .Items}}{{template "item" .}}{{end}}</ul>{{end}}`)},
+		"pages/plain.html":   {Data: []byte(`{{define "layout"}}plain {{.Title}}{{end}}`)},
+		"pages/broken.html":  {Data: []byte("{{define \"content\"}}\n<p>one</p>\n<p>{{index .Items 5}}</p>\n<p>four</p>\n{{end}}")},
+	}
+}
+
+func TestTemplatesRender(t *testing.T) {
+	tmpl := NewTemplates(templateFS(), false)
+	if err := tmpl.Load(); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	tmpl.Render(w, "list.html", map[string]interface{}{"Title": "A & B", "Items": []string{"x", "<y>"}})
+	want := `<title>A &amp; B</title><ul><li>x</li><li>&lt;y&gt;</li></ul>`
+	if w.Body.String() != want {
+		t.Errorf("Render = %q, want %q", w.Body, want)
+	}
+	if ctype := w.Header().Get("Content-Type"); ctype != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ctype)
+	}
+}
+
+func TestTemplatesErrors(t *testing.T) {
+	tmpl := NewTemplates(templateFS(), false)
+	if err := tmpl.Load(); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	err := tmpl.Execute(&b, "broken.html", map[string]interface{}{"Items": []string{}})
+	var te *TemplateError
+	if !errors.As(err, &te) {
+		t.Fatalf("Execute = %v, want a *TemplateError", err)
+	}
+	if te.Name != "broken.html" || te.Line != 3 || len(te.Source) != 5 || te.Source[2] != "<p>{{index .Items 5}}</p>" {
+		t.Errorf("error = %+v, want line 3 of broken.html with its context", te)
+	}
+	if b.Len() != 0 {
+		t.Errorf("failed Execute wrote %q", b.String())
+	}
+	if err := tmpl.Execute(&b, "nosuch.html", nil); !errors.As(err, &te) || te.Name != "nosuch.html" {
+		t.Errorf("Execute of a missing page = %v", err)
+	}
+
+	fsys := templateFS()
+	fsys["pages/syntax.html"] = &fstest.MapFile{Data: []byte("<p>\n{{if}}\n</p>")}
+	err = NewTemplates(fsys, false).Load()
+	if !errors.As(err, &te) || te.Name != "syntax.html" || te.Line != 2 {
+		t.Errorf("Load with a syntax error = %#v", err)
+	}
+}
+
+func TestTemplatesRenderPanics(t *testing.T) {
+	tmpl := NewTemplates(templateFS(), false)
+	if err := tmpl.Load(); err != nil {
+		t.Fatal(err)
+	}
+	app := NewApp(func(w http.ResponseWriter, r *http.Request) {
+		tmpl.Render(w, "broken.html", map[string]interface{}{"Items": []string{}})
+	}, true)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	body := w.Body.String()
+	if w.Code != 500 || !strings.Contains(body, "<b>   3: &lt;p&gt;{{index .Items 5}}&lt;/p&gt;</b>") || !strings.Contains(body, "   4: &lt;p&gt;four") {
+		t.Errorf("detailed error page = %d:\n%s", w.Code, body)
+	}
+}
+
+func TestTemplatesReload(t *testing.T) {
+	fsys := templateFS()
+	tmpl := NewTemplates(fsys, true)
+	var b strings.Builder
+	if err := tmpl.Execute(&b, "plain.html", map[string]string{"Title": "one"}); err != nil || b.String() != "plain one" {
+		t.Fatalf("Execute = %q, %v", b.String(), err)
+	}
+	fsys["pages/plain.html"] = &fstest.MapFile{Data: []byte(`{{define "layout"}}changed {{.Title}}{{end}}`), ModTime: time.Now()}
+	b.Reset()
+	if err := tmpl.Execute(&b, "plain.html", map[string]string{"Title": "two"}); err != nil || b.String() != "changed two" {
+		t.Errorf("Execute after a change = %q, %v", b.String(), err)
+	}
+	fsys["pages/new.html"] = &fstest.MapFile{Data: []byte(`{{define "layout"}}new{{end}}`)}
+	b.Reset()
+	if err := tmpl.Execute(&b, "new.html", nil); err != nil || b.String() != "new" {
+		t.Errorf("Execute of an added page = %q, %v", b.String(), err)
+	}
+}
@@ -0,0 +1,266 @@
+package webapp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultW3CFields are the fields written by W3CFormat, as in the default
+// IIS configuration.
+var DefaultW3CFields = []string{
+	"date", "time", "c-ip", "cs-username", "cs-method", "cs-uri-stem", "cs-uri-query",
+	"sc-status", "sc-bytes", "time-taken", "cs(User-Agent)", "cs(Referer)",
+}
+
+// W3CFormat writes records in the W3C Extended Log File Format. Supported
+// fields are date, time, c-ip, cs-username, cs-host, cs-method,
+// cs-uri-stem, cs-uri-query, cs-uri, cs-version, sc-status, sc-bytes,
+// time-taken (in milliseconds, like IIS), cs(User-Agent), cs(Referer) and
+// cs(X-Request-Id). Fields named x-KEY hold the field KEY attached with
+// AddField. Times are in UTC, empty values are written as "-" and spaces
+// as "+".
+//
+// Logs must start with the directives returned by Header, pass it as
+// BufferOptions.Header to have it written whenever the file is opened.
+type W3CFormat struct {
+	Fields []string
+}
+
+func w3cFieldSupported(name string) bool {
+	switch name {
+	case "date", "time", "c-ip", "cs-username", "cs-host", "cs-method", "cs-uri-stem",
+		"cs-uri-query", "cs-uri", "cs-version", "sc-status", "sc-bytes", "time-taken",
+		"cs(User-Agent)", "cs(Referer)", "cs(X-Request-Id)":
+		return true
+	}
+	return strings.HasPrefix(name, "x-") && len(name) > 2
+}
+
+// NewW3CFormat returns a format with fields, or DefaultW3CFields if none
+// are given.
+func NewW3CFormat(fields ...string) (*W3CFormat, error) {
+	if len(fields) == 0 {
+		fields = DefaultW3CFields
+	}
+	for _, name := range fields {
+		if !w3cFieldSupported(name) {
+			return nil, fmt.Errorf("webapp: unsupported W3C field %q", name)
+		}
+	}
+	return &W3CFormat{Fields: fields}, nil
+}
+
+// Header returns the directives starting a log file opened at t.
+func (f *W3CFormat) Header(t time.Time) []byte {
+	return []byte("#Software: go-webapp\n#Version: 1.0\n#Date: " +
+		t.UTC().Format("2006-01-02 15:04:05") + "\n#Fields: " + strings.Join(f.Fields, " ") + "\n")
+}
+
+// HeaderFunc returns Header dated by c, usually the App Clock, for use as
+// BufferOptions.Header. A nil c means SystemClock.
+func (f *W3CFormat) HeaderFunc(c Clock) func() []byte {
+	if c == nil {
+		c = SystemClock
+	}
+	return func() []byte { return f.Header(c.Now()) }
+}
+
+// appendW3CValue appends s with spaces replaced by '+', or "-" if s is
+// empty.
+func appendW3CValue(b []byte, s string) []byte {
+	if s == "" || s == "-" {
+		return append(b, '-')
+	}
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == ' ':
+			b = append(b, '+')
+		case c < ' ' || c == 0x7f:
+			b = append(b, '?')
+		default:
+			b = append(b, c)
+		}
+	}
+	return b
+}
+
+// AppendFormat appends rec as a line of the format to b.
+func (f *W3CFormat) AppendFormat(b []byte, rec *LogRecord) []byte {
+	method, path, query, proto := requestParts(rec.Request)
+	t := rec.RequestStarted.UTC()
+	for i, name := range f.Fields {
+		if i > 0 {
+			b = append(b, ' ')
+		}
+		switch name {
+		case "date":
+			b = t.AppendFormat(b, "2006-01-02")
+		case "time":
+			b = t.AppendFormat(b, "15:04:05")
+		case "c-ip":
+			b = appendW3CValue(b, rec.Host)
+		case "cs-username":
+			b = appendW3CValue(b, rec.User)
+		case "cs-host":
+			b = appendW3CValue(b, rec.VirtualHost)
+		case "cs-method":
+			b = appendW3CValue(b, method)
+		case "cs-uri-stem":
+			b = appendW3CValue(b, path)
+		case "cs-uri-query":
+			b = appendW3CValue(b, strings.TrimPrefix(query, "?"))
+		case "cs-uri":
+			b = appendW3CValue(b, path+query)
+		case "cs-version":
+			b = appendW3CValue(b, proto)
+		case "sc-status":
+			b = strconv.AppendInt(b, int64(rec.Status), 10)
+		case "sc-bytes":
+			b = strconv.AppendUint(b, rec.Bytes, 10)
+		case "time-taken":
+			b = strconv.AppendInt(b, duration(rec).Milliseconds(), 10)
+		case "cs(User-Agent)":
+			b = appendW3CValue(b, rec.UserAgent)
+		case "cs(Referer)":
+			b = appendW3CValue(b, rec.Referer)
+		case "cs(X-Request-Id)":
+			b = appendW3CValue(b, rec.RequestID)
+		default:
+			v := rec.Field(name[2:])
+			if v == nil {
+				b = append(b, '-')
+			} else {
+				b = appendW3CValue(b, string(appendFieldValue(nil, v)))
+			}
+		}
+	}
+	return b
+}
+
+func (f *W3CFormat) Format(rec *LogRecord) string {
+	return string(f.AppendFormat(nil, rec))
+}
+
+// w3cParser follows the #Fields directives of the log it reads.
+type w3cParser struct {
+	fields []string
+}
+
+// Parser returns a parser for logs of the format. It switches to the
+// fields of #Fields directives found in the log, so it can read logs
+// written by IIS, and must not be shared between logs.
+func (f *W3CFormat) Parser() Parser {
+	return &w3cParser{fields: f.Fields}
+}
+
+// W3CParser returns a parser for W3C logs which learns the fields from
+// the #Fields directives of the log.
+func W3CParser() Parser {
+	return &w3cParser{fields: DefaultW3CFields}
+}
+
+func w3cValue(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return strings.ReplaceAll(s, "+", " ")
+}
+
+func (p *w3cParser) Parse(line string) (*LogRecord, error) {
+	if strings.HasPrefix(line, "#") {
+		if strings.HasPrefix(line, "#Fields:") {
+			p.fields = strings.Fields(line[len("#Fields:"):])
+		}
+		return nil, ErrSkipLine
+	}
+	rec := &LogRecord{Indent: "-", User: "-", Session: "-"}
+	var date, clock, method, path, query, proto, uri string
+	var taken time.Duration
+	hasTaken := false
+	pos := 0
+	values := strings.Split(line, " ")
+	if len(values) != len(p.fields) {
+		return nil, &ParseError{Column: 1, Msg: fmt.Sprintf("%d values for %d fields", len(values), len(p.fields))}
+	}
+	for i, v := range values {
+		name := p.fields[i]
+		fail := func(format string, args ...interface{}) (*LogRecord, error) {
+			return nil, &ParseError{Column: pos + 1, Field: name, Msg: fmt.Sprintf(format, args...)}
+		}
+		switch name {
+		case "date":
+			date = v
+		case "time":
+			clock = v
+		case "c-ip":
+			rec.Host = v
+		case "cs-username":
+			rec.User = v
+		case "cs-host":
+			rec.VirtualHost = w3cValue(v)
+		case "cs-method":
+			method = v
+		case "cs-uri-stem":
+			path = v
+		case "cs-uri-query":
+			if v != "-" {
+				query = "?" + v
+			}
+		case "cs-uri":
+			uri = v
+		case "cs-version":
+			proto = v
+		case "sc-status":
+			s, err := strconv.Atoi(v)
+			if err != nil {
+				return fail("bad status %q", v)
+			}
+			rec.Status = s
+		case "sc-bytes":
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return fail("bad byte count %q", v)
+			}
+			rec.Bytes = n
+		case "time-taken":
+			ms, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return fail("bad duration %q", v)
+			}
+			taken, hasTaken = time.Duration(ms)*time.Millisecond, true
+		case "cs(User-Agent)":
+			rec.UserAgent = w3cValue(v)
+		case "cs(Referer)":
+			rec.Referer = w3cValue(v)
+		case "cs(X-Request-Id)":
+			rec.RequestID = w3cValue(v)
+		default:
+			if strings.HasPrefix(name, "x-") && v != "-" {
+				rec.Fields = append(rec.Fields, Field{name[2:], w3cValue(v)})
+			}
+		}
+		pos += len(v) + 1
+	}
+	if date != "" {
+		t, err := time.Parse("2006-01-02 15:04:05", date+" "+clock)
+		if err != nil {
+			return nil, &ParseError{Column: 1, Field: "date", Msg: fmt.Sprintf("bad time %q", date+" "+clock)}
+		}
+		rec.RequestStarted = t
+	}
+	if hasTaken {
+		rec.RequestCompleted = rec.RequestStarted.Add(taken)
+	}
+	if uri == "" {
+		uri = path + query
+	}
+	if proto == "" {
+		proto = "-"
+	}
+	if method != "" {
+		rec.Request = method + " " + uri + " " + proto
+	}
+	return rec, nil
+}
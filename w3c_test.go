@@ -0,0 +1,117 @@
+package webapp
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestW3CFormat(t *testing.T) {
+	rec := formatRecord()
+	rec.Request = "GET /search?q=green+tea HTTP/1.1"
+	rec.UserAgent = "Mozilla/5.0 (X11)"
+	rec.VirtualHost = "shop.example.com"
+	rec.Fields = []Field{{"user_id", 42}}
+	f, err := NewW3CFormat("date", "time", "c-ip", "cs-username", "cs-host", "cs-method", "cs-uri-stem",
+		"cs-uri-query", "cs-version", "sc-status", "sc-bytes", "time-taken", "cs(User-Agent)", "cs(Referer)",
+		"cs(X-Request-Id)", "x-user_id", "x-missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = "2013-01-02 14:04:05 192.0.2.1 frank shop.example.com GET /search q=green+tea HTTP/1.1 200 1234 42 Mozilla/5.0+(X11) http://example.com/ req-1 42 -"
+	if got := f.Format(rec); got != want {
+		t.Errorf("Format =\n%s\nwant\n%s", got, want)
+	}
+
+	got, err := f.Parser().Parse(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := sameRecord(got, rec, true); len(diffs) > 0 {
+		t.Errorf("round trip differs in %v: %+v", diffs, got)
+	}
+	if got.UserAgent != rec.UserAgent || got.VirtualHost != rec.VirtualHost || got.RequestID != rec.RequestID ||
+		len(got.Fields) != 1 || got.Fields[0] != (Field{"user_id", "42"}) {
+		t.Errorf("round trip = %+v", got)
+	}
+
+	if _, err := NewW3CFormat("date", "cs(Cookie)"); err == nil {
+		t.Error("NewW3CFormat accepted cs(Cookie)")
+	}
+	if f, _ := NewW3CFormat(); strings.Join(f.Fields, " ") != strings.Join(DefaultW3CFields, " ") {
+		t.Errorf("default fields %v", f.Fields)
+	}
+}
+
+func TestW3CParserFields(t *testing.T) {
+	p, err := ParserByName("w3c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an IIS log switching fields part way through
+	log := "#Software: Microsoft Internet Information Services 10.0\n" +
+		"#Fields: date time cs-method cs-uri-stem sc-status\n" +
+		"2013-01-02 14:04:05 GET /a 200\n" +
+		"#Fields: date time c-ip cs-uri sc-status time-taken\n" +
+		"2013-01-02 14:04:06 192.0.2.1 /b?x=1 404 15\n" +
+		"2013-01-02 14:04:07 192.0.2.1 /c\n"
+	ls := NewLogScanner(strings.NewReader(log), p)
+	var got []*LogRecord
+	for ls.Scan() {
+		rec, err := ls.Record()
+		if ls.Line() == 6 {
+			var perr *ParseError
+			if !errors.As(err, &perr) || perr.Line != 6 {
+				t.Errorf("line 6: %v, want a *ParseError", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("line %d: %v", ls.Line(), err)
+		}
+		got = append(got, rec)
+	}
+	if len(got) != 2 {
+		t.Fatalf("parsed %d records, want the directives skipped", len(got))
+	}
+	if got[0].Request != "GET /a -" || got[0].Status != 200 || got[0].Host != "" {
+		t.Errorf("first record %+v", got[0])
+	}
+	if got[1].Request != "" || got[1].Host != "192.0.2.1" || got[1].Status != 404 || duration(got[1]) != 15*time.Millisecond {
+		t.Errorf("second record %+v", got[1])
+	}
+}
+
+func TestW3CHeader(t *testing.T) {
+	f, _ := NewW3CFormat("date", "time", "sc-status")
+	clock := &fakeClock{time.Date(2013, 1, 2, 15, 4, 5, 0, time.UTC)}
+	name := filepath.Join(t.TempDir(), "access.log")
+	bf, err := OpenBufferedFile(name, BufferOptions{FlushInterval: time.Hour, Header: f.HeaderFunc(clock)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bf.Write([]byte(f.Format(formatRecord()) + "\n"))
+	if err := os.Rename(name, name+".1"); err != nil {
+		t.Fatal(err)
+	}
+	clock.t = clock.t.Add(24 * time.Hour)
+	if err := bf.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	bf.Write([]byte(f.Format(formatRecord()) + "\n"))
+	if err := bf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, date := range map[string]string{name + ".1": "2013-01-02 15:04:05", name: "2013-01-03 15:04:05"} {
+		lines := strings.Split(readFile(t, name), "\n")
+		if len(lines) != 6 || lines[0] != "#Software: go-webapp" || lines[1] != "#Version: 1.0" ||
+			lines[2] != "#Date: "+date || lines[3] != "#Fields: date time sc-status" ||
+			lines[4] != "2013-01-02 14:04:05 200" {
+			t.Errorf("%s holds %q, want the header and one record", filepath.Base(name), lines)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package webapptest
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	webapp "github.com/abbot/go-webapp"
+)
+
+// SentryServer is a local stand-in for the Sentry ingest endpoint, for
+// testing webapp.SentryReporter. It keeps the events of the envelopes
+// posted to it in memory.
+type SentryServer struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	events     []*webapp.SentryEvent
+	status     int
+	retryAfter int
+}
+
+const sentryKey = "public"
+
+func NewSentryServer() *SentryServer {
+	s := &SentryServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// DSN returns the DSN of project 1 on the server.
+func (s *SentryServer) DSN() string {
+	return "http://" + sentryKey + "@" + strings.TrimPrefix(s.URL, "http://") + "/1"
+}
+
+// SetStatus makes the server reject envelopes with status, to simulate
+// outages and rate limits. Zero accepts them again.
+func (s *SentryServer) SetStatus(status int) {
+	s.mu.Lock()
+	s.status = status
+	s.mu.Unlock()
+}
+
+// SetRetryAfter sets the Retry-After seconds of 429 responses, zero by
+// default.
+func (s *SentryServer) SetRetryAfter(secs int) {
+	s.mu.Lock()
+	s.retryAfter = secs
+	s.mu.Unlock()
+}
+
+func (s *SentryServer) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.URL.Path != "/api/1/envelope/" {
+		http.NotFound(w, r)
+		return
+	}
+	if !strings.Contains(r.Header.Get("X-Sentry-Auth"), "sentry_key="+sentryKey) {
+		http.Error(w, "bad auth", http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	status, retryAfter := s.status, s.retryAfter
+	s.mu.Unlock()
+	if status != 0 {
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	events, err := readEnvelope(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.events = append(s.events, events...)
+	s.mu.Unlock()
+	w.Write([]byte(`{}`))
+}
+
+// readEnvelope returns the event items of an envelope.
+func readEnvelope(body io.Reader) ([]*webapp.SentryEvent, error) {
+	r := bufio.NewReader(body)
+	var header struct {
+		EventID string `json:"event_id"`
+	}
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(line, &header); err != nil {
+		return nil, err
+	}
+	var events []*webapp.SentryEvent
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return events, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var item struct {
+			Type   string `json:"type"`
+			Length int    `json:"length"`
+		}
+		if err := json.Unmarshal(line, &item); err != nil {
+			return nil, err
+		}
+		payload := make([]byte, item.Length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, err
+		}
+		r.ReadByte() // newline after the payload
+		if item.Type != "event" {
+			continue
+		}
+		ev := &webapp.SentryEvent{}
+		if err := json.Unmarshal(payload, ev); err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+}
+
+// Events returns and forgets the received events.
+func (s *SentryServer) Events() []*webapp.SentryEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := s.events
+	s.events = nil
+	return out
+}
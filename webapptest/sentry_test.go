@@ -0,0 +1,212 @@
+package webapptest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	webapp "github.com/abbot/go-webapp"
+)
+
+func newReporter(t *testing.T, dsn string) *webapp.SentryReporter {
+	s, err := webapp.NewSentryReporter(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SpoolDir = t.TempDir()
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func panicEvent(msg string) *webapp.ErrorEvent {
+	return &webapp.ErrorEvent{Kind: webapp.EventPanic, Time: time.Now(), Value: errors.New(msg),
+		Request: httptest.NewRequest("GET", "/items?access_token=secret", nil)}
+}
+
+func spooled(t *testing.T, s *webapp.SentryReporter) int {
+	names, err := filepath.Glob(filepath.Join(s.SpoolDir, "*.envelope"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(names)
+}
+
+func TestSentryReporter(t *testing.T) {
+	srv := NewSentryServer()
+	defer srv.Close()
+	s := newReporter(t, srv.DSN())
+	s.Handle(panicEvent("boom"))
+	s.Handle(&webapp.ErrorEvent{Kind: webapp.EventAuthFailure, Value: webapp.ErrUnauthorized})
+	s.Flush()
+	events := srv.Events()
+	if len(events) != 1 {
+		t.Fatalf("server received %d events, want 1", len(events))
+	}
+	ev := events[0]
+	if v := ev.Exception.Values; len(v) != 1 || v[0].Value != "boom" {
+		t.Errorf("exception = %+v, want boom", v)
+	}
+	if ev.Request == nil || strings.Contains(ev.Request.QueryString, "secret") {
+		t.Errorf("request = %+v, want the access token redacted", ev.Request)
+	}
+}
+
+func TestSentryReporterSpoolsOnServerError(t *testing.T) {
+	srv := NewSentryServer()
+	defer srv.Close()
+	s := newReporter(t, srv.DSN())
+	srv.SetStatus(http.StatusServiceUnavailable)
+	s.Handle(panicEvent("during outage"))
+	s.Flush()
+	if n := len(srv.Events()); n != 0 {
+		t.Fatalf("server received %d events during the outage", n)
+	}
+	if n := spooled(t, s); n != 1 {
+		t.Fatalf("%d envelopes spooled, want 1", n)
+	}
+	srv.SetStatus(0)
+	s.Flush()
+	if events := srv.Events(); len(events) != 1 || events[0].Exception.Values[0].Value != "during outage" {
+		t.Errorf("events after the outage = %v, want the spooled one", events)
+	}
+	if n := spooled(t, s); n != 0 {
+		t.Errorf("%d envelopes left in the spool", n)
+	}
+}
+
+func TestSentryReporterClientError(t *testing.T) {
+	srv := NewSentryServer()
+	defer srv.Close()
+	s := newReporter(t, srv.DSN())
+	s.Errors = make(chan *string, 1)
+	srv.SetStatus(http.StatusBadRequest)
+	s.Handle(panicEvent("rejected"))
+	s.Flush()
+	if n := spooled(t, s); n != 0 {
+		t.Errorf("%d envelopes spooled, want a rejected one dropped", n)
+	}
+	select {
+	case msg := <-s.Errors:
+		if !strings.Contains(*msg, "[sentry] server returned 400 Bad Request") {
+			t.Errorf("error %q", *msg)
+		}
+	default:
+		t.Error("rejected envelope not reported")
+	}
+}
+
+func TestSentryReporterSampleRate(t *testing.T) {
+	const n = 1000
+	s := newReporter(t, "http://public@127.0.0.1:1/1")
+	s.SampleRate = 0.5
+	sampled := 0
+	s.BeforeSend = func(se *webapp.SentryEvent, ev *webapp.ErrorEvent) bool {
+		sampled++
+		return false
+	}
+	for i := 0; i < n; i++ {
+		s.Handle(panicEvent("sampled"))
+	}
+	if sampled < n/2-100 || sampled > n/2+100 {
+		t.Errorf("%d of %d events sampled at 0.5", sampled, n)
+	}
+}
+
+func TestSentryReporterRetryAfter(t *testing.T) {
+	srv := NewSentryServer()
+	defer srv.Close()
+	s := newReporter(t, srv.DSN())
+	clock := NewClock(Start, 0)
+	s.Clock = clock
+	srv.SetStatus(http.StatusTooManyRequests)
+	srv.SetRetryAfter(60)
+	s.Handle(panicEvent("limited"))
+	s.Flush()
+	// the server accepts again, but the reporter waits for Retry-After
+	srv.SetStatus(0)
+	s.Handle(panicEvent("while waiting"))
+	s.Flush()
+	if n := len(srv.Events()); n != 0 {
+		t.Errorf("server received %d events before Retry-After passed", n)
+	}
+	if n := spooled(t, s); n != 2 {
+		t.Errorf("%d envelopes spooled, want 2", n)
+	}
+	clock.Advance(time.Minute + time.Second)
+	s.Flush()
+	if n := len(srv.Events()); n != 2 {
+		t.Errorf("server received %d events after Retry-After passed, want 2", n)
+	}
+}
+
+func TestSentryReporterClock(t *testing.T) {
+	srv := NewSentryServer()
+	defer srv.Close()
+	app := webapp.NewApp(http.NotFound, false)
+	h := New(t, app)
+	s, err := app.AddSentryReporter(srv.DSN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Clock != h.Clock {
+		t.Fatalf("reporter Clock = %v, want the App Clock", s.Clock)
+	}
+	h.Clock.Set(Start)
+	s.Handle(&webapp.ErrorEvent{Kind: webapp.EventPanic, Value: errors.New("undated")})
+	s.Flush()
+	if events := srv.Events(); len(events) != 1 || !events[0].Timestamp.Equal(Start) {
+		t.Errorf("events %v, want one dated by the App Clock", events)
+	}
+}
+
+func TestSentryReporterShutdownDeadline(t *testing.T) {
+	hang := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-hang:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(hang)
+	s := newReporter(t, "http://public@"+strings.TrimPrefix(srv.URL, "http://")+"/1")
+	s.Handle(panicEvent("stuck"))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown with a hung server = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if n := spooled(t, s); n != 1 {
+		t.Errorf("%d envelopes spooled, want the one in flight", n)
+	}
+}
+
+func TestSentryReporterAfterShutdown(t *testing.T) {
+	srv := NewSentryServer()
+	defer srv.Close()
+	s := newReporter(t, srv.DSN())
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Shutdown(context.Background())
+		}()
+	}
+	wg.Wait()
+	s.Handle(panicEvent("late"))
+	s.Flush()
+	if n := len(srv.Events()); n != 0 || s.Lost() != 1 {
+		t.Errorf("server received %d events after Shutdown, %d lost, want 0 and 1", n, s.Lost())
+	}
+	if n := spooled(t, s); n != 0 {
+		t.Errorf("%d envelopes spooled after Shutdown", n)
+	}
+}
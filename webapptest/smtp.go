@@ -0,0 +1,150 @@
+package webapptest
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Mail is a message received by SMTPServer.
+type Mail struct {
+	From string
+	To   []string
+	Data string
+}
+
+// SMTPServer is a local stand-in for a mail server, for testing
+// webapp.EmailNotifier. It accepts every message, and any credentials
+// offered with AUTH PLAIN, and keeps the messages in memory.
+type SMTPServer struct {
+	Addr string
+
+	l    net.Listener
+	mu   sync.Mutex
+	mail []Mail
+	wg   sync.WaitGroup
+}
+
+// NewSMTPServer starts an SMTPServer on a random port of 127.0.0.1.
+func NewSMTPServer() (*SMTPServer, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &SMTPServer{Addr: l.Addr().String(), l: l}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+func (s *SMTPServer) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.session(c)
+		}()
+	}
+}
+
+func (s *SMTPServer) session(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	w := bufio.NewWriter(c)
+	reply := func(line string) bool {
+		w.WriteString(line + "\r\n")
+		return w.Flush() == nil
+	}
+	if !reply("220 localhost webapptest") {
+		return
+	}
+	var m Mail
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(line)
+		var ok bool
+		switch {
+		case strings.HasPrefix(verb, "EHLO"):
+			ok = reply("250-localhost") && reply("250-AUTH PLAIN") && reply("250 8BITMIME")
+		case strings.HasPrefix(verb, "HELO"):
+			ok = reply("250 localhost")
+		case strings.HasPrefix(verb, "AUTH"):
+			ok = reply("235 2.7.0 Authentication successful")
+		case strings.HasPrefix(verb, "MAIL FROM:"):
+			m = Mail{From: mailPath(line[len("MAIL FROM:"):])}
+			ok = reply("250 OK")
+		case strings.HasPrefix(verb, "RCPT TO:"):
+			m.To = append(m.To, mailPath(line[len("RCPT TO:"):]))
+			ok = reply("250 OK")
+		case verb == "DATA":
+			if !reply("354 End data with <CR><LF>.<CR><LF>") {
+				return
+			}
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" || l == ".\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(l, "."))
+			}
+			m.Data = data.String()
+			s.mu.Lock()
+			s.mail = append(s.mail, m)
+			s.mu.Unlock()
+			ok = reply("250 OK")
+		case verb == "RSET":
+			m = Mail{}
+			ok = reply("250 OK")
+		case verb == "NOOP":
+			ok = reply("250 OK")
+		case verb == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			ok = reply("502 Command not implemented")
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// mailPath returns the address of a MAIL FROM or RCPT TO argument,
+// without parameters such as BODY=8BITMIME.
+func mailPath(arg string) string {
+	arg = strings.TrimSpace(arg)
+	if n := strings.IndexAny(arg, "> "); n != -1 {
+		arg = arg[:n]
+	}
+	return strings.TrimPrefix(arg, "<")
+}
+
+// Mail returns and forgets the received messages.
+func (s *SMTPServer) Mail() []Mail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := s.mail
+	s.mail = nil
+	return out
+}
+
+// Close stops the server and waits for open connections to finish.
+func (s *SMTPServer) Close() error {
+	err := s.l.Close()
+	s.wg.Wait()
+	return err
+}
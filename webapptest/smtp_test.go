@@ -0,0 +1,45 @@
+package webapptest
+
+import (
+	"net/smtp"
+	"strings"
+	"testing"
+
+	webapp "github.com/abbot/go-webapp"
+)
+
+func TestEmailNotifier(t *testing.T) {
+	srv, err := NewSMTPServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	e := &webapp.EmailNotifier{
+		Addr:  srv.Addr,
+		Auth:  smtp.PlainAuth("", "app", "password", "127.0.0.1"),
+		From:  "app@example.com",
+		To:    []string{"ops@example.com", "dev@example.com"},
+		Clock: NewClock(Start, 0),
+	}
+	n := &webapp.Notification{Name: "shop", Alerts: []webapp.Alert{{Kind: webapp.EventPanic, Message: "boom", Count: 1}}}
+	if err := e.Notify(n); err != nil {
+		t.Fatal(err)
+	}
+	mail := srv.Mail()
+	if len(mail) != 1 {
+		t.Fatalf("server received %d messages, want 1", len(mail))
+	}
+	m := mail[0]
+	if m.From != e.From || strings.Join(m.To, ",") != "ops@example.com,dev@example.com" {
+		t.Errorf("envelope from %s to %v", m.From, m.To)
+	}
+	if !strings.Contains(m.Data, "Subject: [shop] panic: boom\r\n") || !strings.Contains(m.Data, "\r\n\r\n[shop] panic: boom\r\n\r\npanic: boom\r\n") {
+		t.Errorf("message has no subject line or text:\n%s", m.Data)
+	}
+	if !strings.Contains(m.Data, "Date: Wed, 02 Jan 2013 15:04:05 +0000\r\n") {
+		t.Errorf("message not dated by Clock:\n%s", m.Data)
+	}
+	if len(srv.Mail()) != 0 {
+		t.Error("Mail kept the messages it returned")
+	}
+}
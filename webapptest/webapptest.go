@@ -0,0 +1,245 @@
+// Package webapptest provides helpers for testing handlers served by
+// webapp.App.
+package webapptest
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	webapp "github.com/abbot/go-webapp"
+)
+
+// Clock is a webapp.Clock for tests. Every call to Now returns the current
+// time and then moves it forward by Step, so request durations are
+// deterministic.
+type Clock struct {
+	Step time.Duration
+
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewClock(start time.Time, step time.Duration) *Clock {
+	return &Clock{now: start, Step: step}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := c.now
+	c.now = c.now.Add(c.Step)
+	return t
+}
+
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func (c *Clock) Set(t time.Time) {
+	c.mu.Lock()
+	c.now = t
+	c.mu.Unlock()
+}
+
+// Sink captures the log records, error messages and error events of an
+// App in memory. Records are sent before App.ServeHTTP returns, so they
+// can be read right after a request.
+type Sink struct {
+	records chan *webapp.LogRecord
+	errors  chan *string
+	events  chan *webapp.ErrorEvent
+}
+
+// NewSink attaches a Sink to app. It replaces app.Errors.
+func NewSink(app *webapp.App) *Sink {
+	s := &Sink{
+		records: make(chan *webapp.LogRecord, 1000),
+		errors:  make(chan *string, 1000),
+		events:  make(chan *webapp.ErrorEvent, 1000),
+	}
+	app.Loggers = append(app.Loggers, s.records)
+	app.Events = append(app.Events, s.events)
+	app.Errors = s.errors
+	return s
+}
+
+// Records returns and forgets the captured log records.
+func (s *Sink) Records() []*webapp.LogRecord {
+	var out []*webapp.LogRecord
+	for {
+		select {
+		case rec := <-s.records:
+			out = append(out, rec)
+		default:
+			return out
+		}
+	}
+}
+
+// Errors returns and forgets the captured error log messages.
+func (s *Sink) Errors() []string {
+	var out []string
+	for {
+		select {
+		case msg := <-s.errors:
+			out = append(out, *msg)
+		default:
+			return out
+		}
+	}
+}
+
+// Events returns and forgets the captured error events.
+func (s *Sink) Events() []*webapp.ErrorEvent {
+	var out []*webapp.ErrorEvent
+	for {
+		select {
+		case ev := <-s.events:
+			out = append(out, ev)
+		default:
+			return out
+		}
+	}
+}
+
+// Harness runs requests through an App and captures what it logs.
+type Harness struct {
+	App   *webapp.App
+	Sink  *Sink
+	Clock *Clock
+	t     testing.TB
+}
+
+// Start is the time of the Harness clock.
+var Start = time.Date(2013, time.January, 2, 15, 4, 5, 0, time.UTC)
+
+// New attaches a Sink and, unless app already has one, a Clock starting at
+// Start and ticking by one millisecond to app.
+func New(t testing.TB, app *webapp.App) *Harness {
+	h := &Harness{App: app, Sink: NewSink(app), t: t}
+	if app.Clock == nil {
+		h.Clock = NewClock(Start, time.Millisecond)
+		app.Clock = h.Clock
+	}
+	return h
+}
+
+// Do serves r and collects the response, the log record and error events.
+func (h *Harness) Do(r *http.Request) *Result {
+	res := &Result{ResponseRecorder: httptest.NewRecorder(), t: h.t}
+	h.App.ServeHTTP(res.ResponseRecorder, r)
+	if recs := h.Sink.Records(); len(recs) > 0 {
+		res.Record = recs[len(recs)-1]
+	}
+	res.Errors = h.Sink.Errors()
+	res.Events = h.Sink.Events()
+	return res
+}
+
+func (h *Harness) Get(target string) *Result {
+	return h.Do(httptest.NewRequest("GET", target, nil))
+}
+
+func (h *Harness) Post(target, contentType string, body io.Reader) *Result {
+	r := httptest.NewRequest("POST", target, body)
+	r.Header.Set("Content-Type", contentType)
+	return h.Do(r)
+}
+
+// Result is the outcome of Harness.Do. Expect methods report failures
+// with t.Errorf and return the Result for chaining.
+type Result struct {
+	*httptest.ResponseRecorder
+	Record *webapp.LogRecord
+	Errors []string
+	Events []*webapp.ErrorEvent
+	t      testing.TB
+}
+
+func (res *Result) ExpectStatus(status int) *Result {
+	res.t.Helper()
+	if res.Code != status {
+		res.t.Errorf("status = %d, want %d", res.Code, status)
+	}
+	return res
+}
+
+func (res *Result) ExpectBody(substr string) *Result {
+	res.t.Helper()
+	if !strings.Contains(res.Body.String(), substr) {
+		res.t.Errorf("body %q does not contain %q", res.Body.String(), substr)
+	}
+	return res
+}
+
+// ExpectLogged checks a field of the logged LogRecord by name, for
+// example ExpectLogged("Status", 404) or ExpectLogged("User", "bob").
+func (res *Result) ExpectLogged(field string, want interface{}) *Result {
+	res.t.Helper()
+	if res.Record == nil {
+		res.t.Errorf("request was not logged")
+		return res
+	}
+	v := reflect.ValueOf(res.Record).Elem().FieldByName(field)
+	if !v.IsValid() {
+		res.t.Errorf("LogRecord has no field %s", field)
+		return res
+	}
+	got := v.Interface()
+	if w := reflect.ValueOf(want); w.IsValid() && w.Type() != v.Type() && w.Type().ConvertibleTo(v.Type()) {
+		want = w.Convert(v.Type()).Interface()
+	}
+	if !reflect.DeepEqual(got, want) {
+		res.t.Errorf("logged %s = %v, want %v", field, got, want)
+	}
+	return res
+}
+
+// ExpectNotLogged checks that the request was not sent to the loggers.
+func (res *Result) ExpectNotLogged() *Result {
+	res.t.Helper()
+	if res.Record != nil {
+		res.t.Errorf("request was logged: %s", webapp.CombinedFormat(res.Record))
+	}
+	return res
+}
+
+// Panic returns the panic event of the request, or nil.
+func (res *Result) Panic() *webapp.ErrorEvent {
+	for _, ev := range res.Events {
+		if ev.Kind == webapp.EventPanic {
+			return ev
+		}
+	}
+	return nil
+}
+
+// ExpectPanic checks that the handler panicked with a value containing
+// substr.
+func (res *Result) ExpectPanic(substr string) *Result {
+	res.t.Helper()
+	ev := res.Panic()
+	if ev == nil {
+		res.t.Errorf("handler did not panic")
+	} else if msg := fmt.Sprint(ev.Value); !strings.Contains(msg, substr) {
+		res.t.Errorf("panic %q does not contain %q", msg, substr)
+	}
+	return res
+}
+
+func (res *Result) ExpectNoPanic() *Result {
+	res.t.Helper()
+	if ev := res.Panic(); ev != nil {
+		res.t.Errorf("handler panicked: %v [at %s]", ev.Value, ev.Where)
+	}
+	return res
+}
@@ -0,0 +1,117 @@
+package webapptest
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	webapp "github.com/abbot/go-webapp"
+)
+
+// recordingT collects the failures reported by Expect methods, so that
+// they can be checked without failing the test itself.
+type recordingT struct {
+	testing.TB
+	errors []string
+}
+
+func (t *recordingT) Helper() {}
+
+func (t *recordingT) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func newHarness(h http.HandlerFunc) (*Harness, *recordingT) {
+	rt := &recordingT{}
+	return New(rt, webapp.NewApp(h, false)), rt
+}
+
+func TestExpectLogged(t *testing.T) {
+	h, rt := newHarness(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusGone)
+	})
+	res := h.Get("/old")
+	// untyped constants are converted to the type of the field
+	res.ExpectLogged("Status", 410).ExpectLogged("Bytes", 5).ExpectLogged("Request", "GET /old HTTP/1.1")
+	if len(rt.errors) != 0 {
+		t.Errorf("matching fields reported %q", rt.errors)
+	}
+	res.ExpectLogged("Status", 200)
+	res.ExpectLogged("Bytes", "5")
+	res.ExpectLogged("NoSuchField", 1)
+	if len(rt.errors) != 3 {
+		t.Errorf("mismatches reported %q, want 3 failures", rt.errors)
+	}
+}
+
+func TestExpectPanic(t *testing.T) {
+	h, rt := newHarness(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			panic("out of cheese")
+		}
+	})
+	h.Get("/panic").ExpectStatus(500).ExpectPanic("cheese")
+	if len(rt.errors) != 0 {
+		t.Errorf("expected panic reported %q", rt.errors)
+	}
+	h.Get("/panic").ExpectPanic("wine")
+	h.Get("/").ExpectPanic("cheese")
+	h.Get("/panic").ExpectNoPanic()
+	if len(rt.errors) != 3 {
+		t.Errorf("mismatches reported %q, want 3 failures", rt.errors)
+	}
+}
+
+func TestClock(t *testing.T) {
+	c := NewClock(Start, time.Second)
+	if got := c.Now(); !got.Equal(Start) {
+		t.Errorf("first Now = %v, want %v", got, Start)
+	}
+	if got := c.Now(); !got.Equal(Start.Add(time.Second)) {
+		t.Errorf("second Now = %v, want a Step later", got)
+	}
+	c.Advance(time.Hour)
+	if got := c.Now(); !got.Equal(Start.Add(time.Hour + 2*time.Second)) {
+		t.Errorf("Now after Advance = %v", got)
+	}
+	c.Set(Start)
+	if got := c.Now(); !got.Equal(Start) {
+		t.Errorf("Now after Set = %v, want %v", got, Start)
+	}
+}
+
+func TestHarnessDurations(t *testing.T) {
+	h, _ := newHarness(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	first := h.Get("/").Record
+	second := h.Get("/").Record
+	if !first.RequestStarted.Equal(Start) {
+		t.Errorf("first request started at %v, want %v", first.RequestStarted, Start)
+	}
+	d1 := first.RequestCompleted.Sub(first.RequestStarted)
+	d2 := second.RequestCompleted.Sub(second.RequestStarted)
+	if d1 <= 0 || d1%time.Millisecond != 0 || d1 != d2 {
+		t.Errorf("durations %v and %v, want the same whole number of clock steps", d1, d2)
+	}
+}
+
+func TestSink(t *testing.T) {
+	app := webapp.NewApp(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}, false)
+	app.Health = webapp.NewHealth()
+	h := New(t, app)
+	res := h.Get("/")
+	if res.Record == nil || len(res.Errors) != 1 || len(res.Events) != 1 {
+		t.Fatalf("captured record %v, errors %q and %d events", res.Record, res.Errors, len(res.Events))
+	}
+	if ev := res.Panic(); ev.RequestID != res.Record.RequestID || ev.Record != res.Record || !ev.Time.Equal(res.Record.RequestStarted.Add(time.Millisecond)) {
+		t.Errorf("panic event %+v does not match the request", ev)
+	}
+	h.Get("/healthz").ExpectStatus(200).ExpectNotLogged()
+	if recs := h.Sink.Records(); len(recs) != 0 {
+		t.Errorf("%d records left in the sink", len(recs))
+	}
+}